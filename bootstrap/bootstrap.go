@@ -55,3 +55,47 @@ func Bootstrap(rt RTType, id string) ([]byte, error) {
 		panic("Unknown runtime type")
 	}
 }
+
+func (rt RTType) String() string {
+	switch rt {
+	case DOCKER:
+		return "docker"
+	case KUBERNETES:
+		return "kubernetes"
+	case PODMAN:
+		return "podman"
+	default:
+		return "unknown"
+	}
+}
+
+func ParseRTType(s string) (RTType, error) {
+	switch s {
+	case "docker":
+		return DOCKER, nil
+	case "kubernetes", "k8s":
+		return KUBERNETES, nil
+	case "podman":
+		return PODMAN, nil
+	default:
+		return 0, fmt.Errorf("unknown runtime: %s", s)
+	}
+}
+
+// AgentCommand returns the command line to run the agent that has been bootstrapped into the container,
+// with the agentArgs passed to the agent
+func AgentCommand(rt RTType, id string, agentArgs ...string) []string {
+	var cmd []string
+	switch rt {
+	case DOCKER:
+		cmd = []string{"docker", "exec", "-i", id, "/apf-agent"}
+	case KUBERNETES:
+		splits := strings.SplitN(id, "/", 2)
+		cmd = []string{"kubectl", "exec", "-i", "-n", splits[0], splits[1], "/apf-agent"}
+	case PODMAN:
+		cmd = []string{"podman", "exec", "-i", id, "/apf-agent"}
+	default:
+		panic("Unknown runtime type")
+	}
+	return append(cmd, agentArgs...)
+}
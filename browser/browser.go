@@ -0,0 +1,25 @@
+package browser
+
+import (
+	"os/exec"
+	"runtime"
+)
+
+// Open launches the default browser of the local machine with the url.
+func Open(url string) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("open", url)
+	case "windows":
+		cmd = exec.Command("rundll32", "url.dll,FileProtocolHandler", url)
+	default:
+		cmd = exec.Command("xdg-open", url)
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	// Don't leave a zombie behind
+	go cmd.Wait()
+	return nil
+}
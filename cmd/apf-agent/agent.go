@@ -2,6 +2,7 @@ package main
 
 import (
 	"flag"
+	"strings"
 	"syscall"
 
 	"github.com/ruoshan/autoportforward/logger"
@@ -14,6 +15,12 @@ import (
 // NB: agent CAN NOT use stdout as log output! stdout has been taken by the StdioMuxClient.
 var log = logger.GetNullLogger()
 var dbg = flag.Bool("d", false, "log debug info to /tmp/autoportforward.log")
+var scanMin = flag.Duration("scan-min", portscan.DefaultMinInterval, "the scan interval right after the listening ports change")
+var probe = flag.String("probe", "", "only forward the ports passing the probe: tcp, http[:{path}] or exec:{command}")
+var debounce = flag.Duration("debounce", 0, "only forward the ports listened for the duration, and keep forwarding the closed ports for the duration")
+var allow = flag.String("allow", "", "comma-separated CIDRs / domains allowed to be dialed for the SOCKS5 / HTTP proxies, all if empty")
+var tunnel = flag.String("tunnel", "", "the secret of the encrypted tunnel to apf, see mux.Tunnel")
+var scanMax = flag.Duration("scan-max", portscan.DefaultMaxInterval, "the scan interval to back off up to while the listening ports are stable")
 
 func main() {
 	flag.Parse()
@@ -22,8 +29,14 @@ func main() {
 	}
 
 	log.Println("Agent starts")
-	mc := mux.NewStdioMuxClient()
-	if mc == nil {
+	var mc *mux.YAMux
+	if *tunnel != "" {
+		var err error
+		if mc, err = mux.NewSecureStdioMuxClient(*tunnel); err != nil {
+			log.Printf("Failed to establish the tunnel: %s", err)
+			panic(err)
+		}
+	} else if mc = mux.NewStdioMuxClient(); mc == nil {
 		panic("Failed to create mux client")
 	}
 
@@ -40,21 +53,58 @@ func main() {
 		panic("Failed to create proxy server")
 	}
 	mgr.SetCallbacks(pl.NewListener, pl.CloseListener)
+	mgr.SetDestinationCallback(pl.SetDestination)
+	mgr.SetPathCallback(pl.SetUnixPath)
 	mgr.Run()
 
+	portscanner := &portscan.TCPListenerScanner{
+		MinInterval: *scanMin,
+		MaxInterval: *scanMax,
+	}
+	// Scan as soon as a port is listened / closed if the agent is capable of tracing
+	trigger, err := portscan.NewTracepointTrigger()
+	if err == nil {
+		log.Println("Scanning on inet_sock_set_state tracepoint")
+		triggerCh := make(chan struct{}, 1)
+		portscanner.Trigger = triggerCh
+		go trigger.Run(triggerCh)
+	} else {
+		log.Printf("Tracepoint trigger unavailable: %s", err)
+	}
+
 	// Keep scanning listening ports
 	go func() {
 		log.Println("Starting portscanner")
-		portscanner := &portscan.TCPListenerScanner{}
-		portsCh := make(chan []uint16)
-		go portscanner.Run(portsCh)
-		for ports := range portsCh {
+		listenersCh := make(chan []portscan.Listener)
+		go portscanner.Run(listenersCh)
+		if *probe != "" || *debounce > 0 {
+			gate := &portscan.ReadinessGate{Debounce: *debounce, Interval: *scanMin}
+			if *probe != "" {
+				prober, err := portscan.ParseProber(*probe)
+				if err != nil {
+					log.Printf("Ignore the probe: %s", err)
+				}
+				gate.Prober = prober
+			}
+			scannedCh := listenersCh
+			listenersCh = make(chan []portscan.Listener)
+			go gate.Run(scannedCh, listenersCh)
+		}
+		for listeners := range listenersCh {
 			filtered := make([]uint16, 0, 10)
-			for _, p := range ports {
+			for _, p := range portscan.Ports(listeners) {
 				if !pl.PortInUsed(p) {
 					filtered = append(filtered, p)
 				}
 			}
+			procs := portscan.FindProcesses(listeners)
+			for p := range procs {
+				if pl.PortInUsed(p) {
+					delete(procs, p)
+				}
+			}
+			// The processes go first, so that they are known when the ports are forwarded
+			mgr.UpdatePeerProcesses(procs)
 			mgr.UpdatePeerPorts(filtered)
 		}
 	}()
@@ -64,9 +114,21 @@ func main() {
 	if pf == nil {
 		panic("Failed to create proxy forwarder")
 	}
+	if *allow != "" {
+		allowlist, err := proxy.ParseAllowlist(strings.Split(*allow, ","))
+		if err != nil {
+			panic(err)
+		}
+		pf.SetAllowlist(allowlist)
+	}
 	go pf.Start()
 	log.Println("Waiting")
 	mgr.Wait()
+	// Remove the unix sockets in the container
+	pl.CloseAll()
+	if trigger != nil {
+		trigger.Close()
+	}
 	log.Println("Agent stops")
 	syscall.Unlink("/apf-agent")
 }
@@ -1,18 +1,25 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
+	"net"
 	"os"
 	"os/signal"
 	"strconv"
 	"strings"
 
 	"github.com/ruoshan/autoportforward/bootstrap"
+	"github.com/ruoshan/autoportforward/config"
+	"github.com/ruoshan/autoportforward/events"
+	"github.com/ruoshan/autoportforward/front"
+	"github.com/ruoshan/autoportforward/hooks"
 	"github.com/ruoshan/autoportforward/logger"
 	"github.com/ruoshan/autoportforward/manager"
-	"github.com/ruoshan/autoportforward/mux"
 	"github.com/ruoshan/autoportforward/proxy"
+	"github.com/ruoshan/autoportforward/session"
+	"github.com/ruoshan/autoportforward/tui"
 )
 
 var version string = "dev"
@@ -20,7 +27,7 @@ var version string = "dev"
 var log = logger.GetNullLogger()
 
 func sigHandler(fn func()) {
-	c := make(chan os.Signal)
+	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt)
 	go func() {
 		for range c {
@@ -33,14 +40,59 @@ func sigHandler(fn func()) {
 var isK8s = flag.Bool("k", false, "proxy for Kubernetes pod")
 var isPodman = flag.Bool("p", false, "proxy for Podman container")
 var dbg = flag.Bool("d", false, "log debug info to /tmp/autoportforward.log")
-var reverse = flag.String("r", "", "comma-separated port list. eg. 8080,9090\nlistening ports in the container and forwarding them back")
+var reverse = flag.String("r", "", "comma-separated port list. eg. 8080,9090,9000:8000,5432:db.internal:5432\nlistening ports in the container and forwarding them back to the same / given local port, or the given destination\nor unix:{local socket}:{path}, eg. unix:$SSH_AUTH_SOCK:/tmp/ssh-agent.sock, listening the path in the container")
+var reverseScan = flag.String("reverse-scan", "", "comma-separated port ranges. eg. 3000-3999,8080\nforward the local listening ports in the ranges to the container as they appear")
+var ui = flag.Bool("ui", false, "show an interactive dashboard of the forwarded ports")
+var output = flag.String("output", "text", "output format: text, json (newline-delimited JSON events on stdout)")
+var process = flag.String("process", "", "comma-separated process names. eg. node,python\nonly forward the ports listened by these processes in the container")
+var excludeProcess = flag.String("exclude-process", "", "comma-separated process names, don't forward the ports listened by these processes")
+var scanMin = flag.Duration("scan-min", 0, "the scan interval of the listening ports in the container right after a change (default 250ms)")
+var scanMax = flag.Duration("scan-max", 0, "the scan interval to back off up to while the listening ports are stable (default 4s)")
+var probe = flag.String("probe", "", "only forward the ports passing the probe in the container: tcp, http[:{path}] or exec:{command}")
+var debounce = flag.Duration("debounce", 0, "only forward the ports listened for the duration, eg. 2s, and keep forwarding the closed ports for the duration")
+var openAll = flag.Bool("open", false, "open the browser for the ports speaking HTTP when they first appear (they are probed with a HEAD request)")
+var openPorts = flag.String("open-port", "", "comma-separated port list. eg. 3000\nopen the browser for these ports in the container when they first appear")
+var frontAddr = flag.String("front", "", "the address of the front proxy routing by the hostnames, eg. 127.0.0.1:8000\n{target}-{port}.localhost, {target}.apf.localhost or {port / process / service}.{target}.apf.localhost")
+var socks = flag.String("socks", "", "the address (or port on 127.0.0.1) of the SOCKS5 server, eg. 1080\nthe connections are dialed from the container, eg. to the other pods and the internal DNS names")
+var httpProxy = flag.String("http-proxy", "", "the address (or port on 127.0.0.1) of the HTTP proxy (CONNECT and plain HTTP), eg. 3128\nthe connections are dialed from the container, like -socks")
+var allow = flag.String("allow", "", "comma-separated CIDRs / domains. eg. 10.0.0.0/8,svc.cluster.local\nonly allow the SOCKS5 / HTTP proxies to dial these destinations from the container")
+var encrypt = flag.Bool("encrypt", false, "encrypt the tunnel to the agent (TLS 1.3) with an ephemeral key of the session, eg. for DOCKER_HOST=tcp://")
+var frontToken = flag.String("front-token", "", "the token required by the front proxy: the X-Apf-Token header, or ?apf_token={token} to set the cookie")
+var allowFrom = flag.String("allow-from", "", "comma-separated CIDRs, or {remote port}={CIDR}. eg. 192.168.1.0/24,6379=10.0.0.5\nonly allow these source addresses (and the loopback) to connect to the local listeners")
+var bind = flag.String("bind", "", "the address of the local listeners, eg. 127.0.0.1 (default all the interfaces)")
+
+// Only set when the output format is json or there are hooks configured
+var emitter *events.Emitter
+
+// fatal reports the error in the selected output format and exits
+func fatal(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	if *output == "json" {
+		e := emitter
+		if e == nil {
+			e = events.NewEmitter(os.Stdout, "")
+		}
+		e.Error(errors.New(msg))
+		os.Exit(1)
+	}
+	panic(msg)
+}
 
 func init() {
 	flag.Usage = func() {
 		fmt.Fprintln(flag.CommandLine.Output(), `Usage:
     * apf {docker container ID / name}
+    * apf [{target name}]: the target defined in the config file (.apf.yaml)
+    * apf config validate [{file}]: validate the config file
     * apf -k {namespace}/{pod ID}
     * apf -p {podman container ID / name}
+    * apf ctl {target} {command}: control a running apf, run "apf ctl" for the commands
+    * apf daemon [-f] [-front {addr}]: run the daemon in the background (or foreground with -f)
+    * apf attach [-k|-p] [-r ports] [{target}]: let the daemon forward ports of the target
+    * apf detach {target}
+    * apf ls: list the targets attached by the daemon
+    * apf [-p] watch [-label apf.enable=true]: attach to the containers with the label as they start
+    * apf -k watch [-n namespace] [-l selector]: attach to the pods matching the selector as they run
 Flags:`)
 		flag.PrintDefaults()
 		fmt.Printf("Version: %s\n", version)
@@ -55,105 +107,195 @@ func printPrelude() {
 `)
 }
 
+func runtimeFromFlags() bootstrap.RTType {
+	var rt bootstrap.RTType = bootstrap.DOCKER
+	if *isK8s {
+		rt = bootstrap.KUBERNETES
+	}
+	if *isPodman {
+		rt = bootstrap.PODMAN
+	}
+	return rt
+}
+
+// parsePortList parses comma-separated port list. eg. 8080,9090
+func parsePortList(s string) ([]uint16, error) {
+	var ports []uint16
+	if len(s) == 0 {
+		return ports, nil
+	}
+	for _, p := range strings.Split(s, ",") {
+		i, err := strconv.ParseUint(p, 10, 16)
+		if err != nil {
+			return nil, err
+		}
+		ports = append(ports, uint16(i))
+	}
+	return ports, nil
+}
+
+// parseNameList parses comma-separated name list. eg. node,python
+func parseNameList(s string) []string {
+	names := make([]string, 0)
+	for _, name := range strings.Split(s, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
 func main() {
 	flag.Parse()
-	if flag.NArg() != 1 {
+	if flag.NArg() >= 1 {
+		subcommands := map[string]func(args []string){
+			"ctl":    runCtl,
+			"daemon": runDaemon,
+			"attach": runAttach,
+			"detach": runDetach,
+			"ls":     runLs,
+			"watch":  runWatch,
+			"config": runConfig,
+		}
+		if fn, ok := subcommands[flag.Arg(0)]; ok {
+			fn(flag.Args()[1:])
+			return
+		}
+	}
+	if flag.NArg() > 1 {
 		flag.Usage()
 		os.Exit(1)
 	}
-	containerId := flag.Arg(0)
 
 	if *dbg {
 		log = logger.GetLogger()
 	}
 
-	var rt bootstrap.RTType = bootstrap.DOCKER
-	if *isK8s {
-		rt = bootstrap.KUBERNETES
-	}
-	if *isPodman {
-		rt = bootstrap.PODMAN
+	switch *output {
+	case "text":
+	case "json":
+		if *ui {
+			fmt.Fprintln(os.Stderr, "-ui can not be used with -output json")
+			os.Exit(1)
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown output format: %s\n", *output)
+		os.Exit(1)
 	}
 
-	// Bootstrap: copy the agent(tar archive) into the container
-	log.Println("Bootstraping")
-	msg, err := bootstrap.Bootstrap(rt, containerId)
+	t, err := resolveTarget(flag.Args())
 	if err != nil {
-		panic(fmt.Sprintf("Failed to bootstrap: %s", msg))
+		fatal("Invalid configuration: %s", err)
 	}
-
-	var cmd []string
-	switch rt {
-	case bootstrap.DOCKER:
-		cmd = []string{"docker", "exec", "-i", containerId, "/apf-agent"}
-	case bootstrap.KUBERNETES:
-		splits := strings.SplitN(containerId, "/", 2)
-		cmd = []string{"kubectl", "exec", "-i", "-n", splits[0], splits[1], "/apf-agent"}
-	case bootstrap.PODMAN:
-		cmd = []string{"podman", "exec", "-i", containerId, "/apf-agent"}
+	if t.Target == "" {
+		flag.Usage()
+		os.Exit(1)
 	}
-	if *dbg {
-		cmd = append(cmd, "-d")
+	opts, err := sessionOptions(t)
+	if err != nil {
+		fatal("Invalid configuration: %s", err)
 	}
 
-	var reversePorts []uint16
-	if len(*reverse) > 0 {
-		splits := strings.Split(*reverse, ",")
-		for _, p := range splits {
-			i, err := strconv.ParseUint(p, 10, 16)
-			if err != nil {
-				panic("Invalid port in -r option")
-			}
-			reversePorts = append(reversePorts, uint16(i))
-		}
+	sinks := make([]func(ev events.Event), 0, 2)
+	if *output == "json" {
+		sinks = append(sinks, events.JSONSink(os.Stdout))
 	}
-
-	log.Println("Creating pipe mux server")
-	ms := mux.NewCmdPipeMuxServer(cmd[0], cmd[1:]...)
-	if ms == nil {
-		panic("Failed to create mux server")
+	if t.Hooks != (config.Hooks{}) {
+		sinks = append(sinks, hooks.NewRunner(t.Hooks, log).Handle)
+	}
+	if len(sinks) > 0 {
+		emitter = events.NewEmitterFunc(t.Target, sinks...)
 	}
 
-	printPrelude()
+	if !*ui && *output == "text" {
+		printPrelude()
+	}
 
-	log.Println("Starting manager")
-	// Open two streams for manager. NB: the order of Accept() is different from Connect() in the remote agent
-	mgrReceivingStream, err := ms.Accept()
-	if err != nil {
-		panic(fmt.Sprintf("Failed to establish manager stream: %s", err))
+	if *ui {
+		opts.Stats = proxy.NewStats()
 	}
-	mgrSendingStream, err := ms.Accept()
+	s, err := session.New(opts, log)
 	if err != nil {
-		panic(fmt.Sprintf("Failed to establish manager stream: %s", err))
+		fatal("Failed to start: %s", err)
 	}
-	mgr := manager.NewManager(mgrReceivingStream, mgrSendingStream, log, func() {
-		ms.Shutdown()
-	})
-	sigHandler(func() {
-		mgr.Shutdown()
-	})
+	sigHandler(s.Shutdown)
 
-	log.Println("Starting proxy listener")
-	pl := proxy.NewProxyListener(ms, log)
-	if pl == nil {
-		panic("Failed to create proxy listener")
+	dumpCallbacks := make([]func(localPortMap, peerPortMap map[uint16]uint16), 0, 2)
+	var connCallbacks []func(ev proxy.ConnEvent)
+	if *ui {
+		dashboard := tui.NewDashboard(t.Target, opts.Stats, s.ProxyListener(), s.ProxyForwarder(), log)
+		dashboard.SetProcessSource(s.Processes)
+		dashboard.SetURLSource(s.LocalURL)
+		dashboard.SetServices(s.Services())
+		dumpCallbacks = append(dumpCallbacks, dashboard.Update)
+		go func() {
+			if err := dashboard.Run(s.Shutdown); err != nil {
+				log.Printf("Failed to start the dashboard: %s", err)
+			}
+		}()
+		defer dashboard.Stop()
+	} else if *output == "text" {
+		dumpCallbacks = append(dumpCallbacks, func(localPortMap, peerPortMap map[uint16]uint16) {
+			manager.DumpWithLabelsToStderr(localPortMap, peerPortMap, s.PortLabel)
+		})
+		connCallbacks = append(connCallbacks, func(ev proxy.ConnEvent) {
+			if errors.Is(ev.Err, proxy.ErrSourceNotAllowed) {
+				fmt.Fprintf(os.Stderr, "Rejected connection from %s to port %d\n", ev.Addr, ev.Port)
+			}
+		})
 	}
-	mgr.SetCallbacks(pl.NewListener, pl.CloseListener)
-	mgr.SetDumpCallback(manager.DumpToStderr)
-	mgr.DumpPorts()
-	mgr.Run()
-	if len(reversePorts) > 0 {
-		mgr.UpdatePeerPorts(reversePorts)
+	if t.OpenAll() || len(t.OpenPorts) > 0 {
+		dumpCallbacks = append(dumpCallbacks, newOpener(s, t.OpenAll(), t.OpenPorts).DumpPorts)
 	}
-
-	log.Println("Starting proxy forwarder")
-	pf := proxy.NewProxyForwarder(ms, log)
-	if pf == nil {
-		panic("Failed to create proxy forwarder")
+	if emitter != nil {
+		connCallbacks = append(connCallbacks, emitter.Conn)
+		s.SetServiceCallback(emitter.Service)
+		dumpCallbacks = append(dumpCallbacks, emitter.DumpPorts)
+		emitter.SessionStarted()
+	}
+	if len(connCallbacks) > 0 {
+		s.SetConnCallback(func(ev proxy.ConnEvent) {
+			for _, cb := range connCallbacks {
+				cb(ev)
+			}
+		})
+	}
+	s.SetDumpCallback(func(localPortMap, peerPortMap map[uint16]uint16) {
+		for _, cb := range dumpCallbacks {
+			cb(localPortMap, peerPortMap)
+		}
+	})
+	if t.Front != "" {
+		fp, err := startFront(t.Front, t.FrontToken, func() []*session.Session { return []*session.Session{s} })
+		if err != nil {
+			s.Shutdown()
+			fatal("Failed to start the front proxy: %s", err)
+		}
+		defer fp.Close()
+		if !*ui && *output == "text" {
+			port := fp.Addr().(*net.TCPAddr).Port
+			fmt.Fprintf(os.Stderr, "Front proxy on %s, eg. http://%s.apf.localhost:%d\n", fp.Addr(), front.Name(t.Target), port)
+		}
+	}
+	s.Run()
+	reloadOnHUP(s)
+	// The dashboard reads the keys from stdin
+	if input, ok := commandInput(); ok && !*ui {
+		go readCommands(input, s)
+	}
+	if !*ui && *output == "text" {
+		if addr := s.SocksAddr(); addr != nil {
+			fmt.Fprintf(os.Stderr, "SOCKS5 proxy on %s\n", addr)
+		}
+		if addr := s.HTTPProxyAddr(); addr != nil {
+			fmt.Fprintf(os.Stderr, "HTTP proxy on %s\n", addr)
+		}
 	}
-	go pf.Start()
 
 	log.Println("Waiting")
-	mgr.Wait()
+	s.Wait()
+	if emitter != nil {
+		emitter.SessionStopped()
+	}
 	log.Println("Byebye")
 }
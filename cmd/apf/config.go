@@ -0,0 +1,225 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/ruoshan/autoportforward/bootstrap"
+	"github.com/ruoshan/autoportforward/config"
+	"github.com/ruoshan/autoportforward/portscan"
+	"github.com/ruoshan/autoportforward/proxy"
+	"github.com/ruoshan/autoportforward/session"
+)
+
+// resolveTarget resolves the target of the command line arguments (at most one target name) with the
+// configuration files, the flags given on the command line override the values in the files.
+func resolveTarget(args []string) (config.Target, error) {
+	cwd, err := os.Getwd()
+	if err != nil {
+		return config.Target{}, err
+	}
+	cfg, err := config.Discover(cwd)
+	if err != nil {
+		return config.Target{}, err
+	}
+	name := ""
+	if len(args) > 0 {
+		name = args[0]
+	}
+	for _, u := range cfg.Untrusted {
+		fmt.Fprintf(os.Stderr, "Ignoring %s in the untrusted %s, run `apf config trust` to allow them\n",
+			strings.Join(u.Settings, ", "), u.File)
+	}
+	t := cfg.Resolve(name)
+	var portErr error
+	parsePorts := func(option, s string) []uint16 {
+		ports, err := parsePortList(s)
+		if err != nil && portErr == nil {
+			portErr = fmt.Errorf("invalid port in -%s option: %s", option, s)
+		}
+		return ports
+	}
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "k", "p":
+			t.Runtime = runtimeFromFlags().String()
+		case "r":
+			t.Reverse = config.ReverseSpecs(parseNameList(*reverse))
+		case "reverse-scan":
+			t.ReverseScan = parseNameList(*reverseScan)
+		case "bind":
+			t.Bind = *bind
+		case "process":
+			t.Processes = parseNameList(*process)
+		case "exclude-process":
+			t.ExcludeProcesses = parseNameList(*excludeProcess)
+		case "scan-min":
+			t.ScanMin = scanMin.String()
+		case "scan-max":
+			t.ScanMax = scanMax.String()
+		case "open":
+			t.Open = openAll
+		case "open-port":
+			t.OpenPorts = parsePorts("open-port", *openPorts)
+		case "probe":
+			t.Probe = *probe
+		case "debounce":
+			t.Debounce = debounce.String()
+		case "front":
+			t.Front = *frontAddr
+		case "front-token":
+			t.FrontToken = *frontToken
+		case "allow-from":
+			t.AllowFrom = parseNameList(*allowFrom)
+		case "socks":
+			t.Socks = *socks
+		case "http-proxy":
+			t.HTTPProxy = *httpProxy
+		case "allow":
+			t.Allow = parseNameList(*allow)
+		case "encrypt":
+			t.Encrypt = encrypt
+		}
+	})
+	if portErr != nil {
+		return t, portErr
+	}
+	if t.Runtime == "" {
+		t.Runtime = bootstrap.DOCKER.String()
+	}
+	return t, t.Validate()
+}
+
+func sessionOptions(t config.Target) (session.Options, error) {
+	rt, err := bootstrap.ParseRTType(t.Runtime)
+	if err != nil {
+		return session.Options{}, err
+	}
+	pins, err := config.ParsePins(t.Pins)
+	if err != nil {
+		return session.Options{}, err
+	}
+	scanMin, scanMax, err := t.ScanIntervals()
+	if err != nil {
+		return session.Options{}, err
+	}
+	debounce, err := t.DebounceDuration()
+	if err != nil {
+		return session.Options{}, err
+	}
+	reversePorts, dests, sockets, err := config.ParseReverse(t.Reverse)
+	if err != nil {
+		return session.Options{}, err
+	}
+	reverseScan, err := portscan.ParsePortRanges(t.ReverseScan)
+	if err != nil {
+		return session.Options{}, err
+	}
+	socks, err := t.SocksAddr()
+	if err != nil {
+		return session.Options{}, err
+	}
+	httpProxy, err := t.HTTPProxyAddr()
+	if err != nil {
+		return session.Options{}, err
+	}
+	var sources *proxy.Sources
+	if len(t.AllowFrom) > 0 {
+		if sources, err = proxy.ParseSources(t.AllowFrom); err != nil {
+			return session.Options{}, err
+		}
+	}
+	return session.Options{
+		Runtime:      rt,
+		Target:       t.Target,
+		ReversePorts: reversePorts,
+		Destinations: dests,
+		UnixSockets:  sockets,
+		ReverseScan:  reverseScan,
+		Include:      t.Include,
+		Exclude:      t.Exclude,
+		Pins:         pins,
+		Processes:    t.Processes,
+		ExcludeProcs: t.ExcludeProcesses,
+		Bind:         t.Bind,
+		Debug:        *dbg,
+		ScanMin:      scanMin,
+		ScanMax:      scanMax,
+		Probe:        t.Probe,
+		Debounce:     debounce,
+		Socks:        socks,
+		HTTPProxy:    httpProxy,
+		Allow:        t.Allow,
+		Encrypt:      t.Encrypted(),
+		Sources:      sources,
+	}, nil
+}
+
+// runConfig: apf config validate [file], apf config trust [file]
+func runConfig(args []string) {
+	if len(args) == 0 || (args[0] != "validate" && args[0] != "trust") || len(args) > 2 {
+		fmt.Fprintln(os.Stderr, `Usage:
+    * apf config validate: validate the discovered configuration files
+    * apf config validate {file}: validate the configuration file
+    * apf config trust: allow the hooks in the discovered project file
+    * apf config trust {file}: allow the hooks in the project file`)
+		os.Exit(1)
+	}
+	if args[0] == "trust" {
+		runTrust(args[1:])
+		return
+	}
+
+	var cfg *config.Config
+	var err error
+	if len(args) == 2 {
+		cfg, err = config.Load(args[1])
+	} else {
+		cwd, _ := os.Getwd()
+		cfg, err = config.Discover(cwd)
+	}
+	if err == nil {
+		err = cfg.Validate()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid configuration: %s\n", err)
+		os.Exit(1)
+	}
+	if len(cfg.Files) == 0 {
+		fmt.Println("No configuration file found")
+		return
+	}
+	for _, f := range cfg.Files {
+		fmt.Printf("%s: OK\n", f)
+	}
+}
+
+// runTrust records the project file as trusted, its hooks are run until it's changed.
+func runTrust(args []string) {
+	path := ""
+	if len(args) > 0 {
+		path = args[0]
+	} else {
+		cwd, _ := os.Getwd()
+		found, ok := config.FindProjectFile(cwd)
+		if !ok {
+			fmt.Fprintln(os.Stderr, "No project configuration file found")
+			os.Exit(1)
+		}
+		path = found
+	}
+	cfg, err := config.Load(path)
+	if err == nil {
+		err = cfg.Validate()
+	}
+	if err == nil {
+		err = config.Trust(path)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to trust %s: %s\n", path, err)
+		os.Exit(1)
+	}
+	fmt.Printf("%s: trusted\n", path)
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/ruoshan/autoportforward/control"
+)
+
+func ctlUsage() {
+	fmt.Fprintln(os.Stderr, `Usage:
+    * apf ctl {target} status
+    * apf ctl {target} reverse-add {port}[:{local port} | :{host}:{port}]
+    * apf ctl {target} reverse-rm {port}
+    * apf ctl {target} pin {remote port} {local port}
+    * apf ctl {target} unpin {remote port}
+    * apf ctl {target} exclude {remote port}
+    * apf ctl {target} include {remote port}
+    * apf ctl {target} shutdown
+{target} is the same argument as the one of the running apf, eg. {namespace}/{pod ID} for Kubernetes.`)
+}
+
+// runCtl talks to the control socket of a running apf. args are the arguments after "ctl".
+func runCtl(args []string) {
+	if len(args) < 2 {
+		ctlUsage()
+		os.Exit(1)
+	}
+	target, command, params := args[0], args[1], args[2:]
+	// The destination of the reverse port is given in the query
+	query := ""
+	if command == "reverse-add" && len(params) == 1 {
+		port, dest, err := parseReverseSpec(params[0])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			os.Exit(1)
+		}
+		params[0] = strconv.Itoa(int(port))
+		if dest != "" {
+			query = "?dest=" + url.QueryEscape(dest)
+		}
+	}
+	for _, p := range params {
+		if _, err := strconv.ParseUint(p, 10, 16); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid port: %s\n", p)
+			os.Exit(1)
+		}
+	}
+
+	type request struct {
+		method   string
+		resource string
+		nparams  int
+	}
+	requests := map[string]request{
+		"status":      {http.MethodGet, "status", 0},
+		"reverse-add": {http.MethodPost, "reverse", 1},
+		"reverse-rm":  {http.MethodDelete, "reverse", 1},
+		"pin":         {http.MethodPost, "pin", 2},
+		"unpin":       {http.MethodDelete, "pin", 1},
+		"exclude":     {http.MethodPost, "exclude", 1},
+		"include":     {http.MethodDelete, "exclude", 1},
+		"shutdown":    {http.MethodPost, "shutdown", 0},
+	}
+	req, ok := requests[command]
+	if !ok || req.nparams != len(params) {
+		ctlUsage()
+		os.Exit(1)
+	}
+
+	path := "/" + strings.Join(append([]string{req.resource}, params...), "/") + query
+	client := control.NewClient(control.SocketPath(target))
+	if command == "shutdown" {
+		if err := client.Request(req.method, path, nil, nil); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	st := control.Status{}
+	if err := client.Request(req.method, path, nil, &st); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		os.Exit(1)
+	}
+	if *output == "json" {
+		json.NewEncoder(os.Stdout).Encode(st)
+		return
+	}
+	printStatus(st)
+}
+
+func printStatus(st control.Status) {
+	fmt.Printf("Target: %s\n", st.Target)
+	for _, p := range st.Ports {
+		arrow := "==>"
+		if p.Direction == "reverse" {
+			arrow = "<=="
+		}
+		extra := ""
+		if p.Process != nil {
+			cmd := p.Process.Command
+			if cmd == "" {
+				cmd = p.Process.Name
+			}
+			extra = fmt.Sprintf(" (%s, pid %d, uid %d)", cmd, p.Process.PID, p.Process.UID)
+		}
+		if p.Service != "" {
+			extra += fmt.Sprintf(" [%s]", p.Service)
+		}
+		if p.Paused {
+			extra += " (paused)"
+		}
+		fmt.Printf("  %d %s %d%s\n", p.Local, arrow, p.Remote, extra)
+	}
+	if len(st.Reverse) > 0 {
+		fmt.Printf("Reverse ports: %v\n", st.Reverse)
+	}
+	for port, dest := range st.Dests {
+		fmt.Printf("Reverse destination: %s <== %d\n", dest, port)
+	}
+	for path, local := range st.Sockets {
+		fmt.Printf("Reverse unix socket: %s <== %s\n", local, path)
+	}
+	for rport, lport := range st.Pinned {
+		fmt.Printf("Pinned: %d ==> %d\n", lport, rport)
+	}
+	if len(st.Excluded) > 0 {
+		fmt.Printf("Excluded: %v\n", st.Excluded)
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/ruoshan/autoportforward/config"
+	"github.com/ruoshan/autoportforward/control"
+	"github.com/ruoshan/autoportforward/daemon"
+	"github.com/ruoshan/autoportforward/logger"
+)
+
+func daemonClient() *control.Client {
+	return control.NewClient(daemon.SocketPath())
+}
+
+func exitOnError(err error) {
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+const frontTokenEnv = "APF_FRONT_TOKEN"
+
+// runDaemon starts the daemon in the background, unless -f is given.
+func runDaemon(args []string) {
+	fs := flag.NewFlagSet("daemon", flag.ExitOnError)
+	foreground := fs.Bool("f", false, "run in the foreground")
+	frontAddr := fs.String("front", "", "the address of the front proxy routing by the hostnames to the attached targets, eg. 127.0.0.1:8000")
+	token := fs.String("front-token", "", "the token required by the front proxy, or $"+frontTokenEnv)
+	fs.Parse(args)
+	if *token == "" {
+		*token = os.Getenv(frontTokenEnv)
+	}
+
+	logPath := filepath.Join(daemon.StateDir(), "apf.log")
+	if !*foreground {
+		if err := daemonClient().Request(http.MethodGet, "/sessions", nil, nil); err == nil {
+			fmt.Fprintln(os.Stderr, "The daemon is already running")
+			os.Exit(1)
+		}
+		exe, err := os.Executable()
+		exitOnError(err)
+		daemonArgs := []string{"daemon", "-f"}
+		if *frontAddr != "" {
+			daemonArgs = append(daemonArgs, "-front", *frontAddr)
+		}
+		if *dbg {
+			daemonArgs = append([]string{"-d"}, daemonArgs...)
+		}
+		cmd := exec.Command(exe, daemonArgs...)
+		// The token is passed in the environment, not to be seen in the arguments by ps
+		cmd.Env = append(os.Environ(), frontTokenEnv+"="+*token)
+		exitOnError(detach(cmd))
+		exitOnError(cmd.Start())
+		fmt.Printf("Daemon started (pid %d), logging to %s\n", cmd.Process.Pid, logPath)
+		return
+	}
+
+	l, err := logger.GetRotatingLogger(logPath)
+	exitOnError(err)
+	log = l
+
+	d := daemon.NewDaemon(filepath.Join(daemon.StateDir(), "daemon.json"), *dbg, log)
+	svr := daemon.NewServer(daemon.SocketPath(), d, log)
+	exitOnError(svr.Listen())
+	if err := d.Restore(); err != nil {
+		log.Printf("Failed to restore the attachments: %s", err)
+	}
+	if *frontAddr != "" {
+		fp, err := startFront(*frontAddr, *token, d.Sessions)
+		if err != nil {
+			log.Printf("Failed to start the front proxy: %s", err)
+		} else {
+			defer fp.Close()
+		}
+	}
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-c
+		log.Println("Daemon stops")
+		svr.Close()
+	}()
+	log.Println("Daemon starts")
+	svr.Serve()
+	d.Shutdown()
+}
+
+func runAttach(args []string) {
+	// Allow the flags after the subcommand, eg. apf attach -k default/redis
+	flag.CommandLine.Parse(args)
+	if flag.NArg() > 1 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	t, err := resolveTarget(flag.Args())
+	exitOnError(err)
+	if t.Target == "" {
+		flag.Usage()
+		os.Exit(1)
+	}
+	pins, err := config.ParsePins(t.Pins)
+	exitOnError(err)
+	scanMin, scanMax, err := t.ScanIntervals()
+	exitOnError(err)
+	debounce, err := t.DebounceDuration()
+	exitOnError(err)
+	socks, err := t.SocksAddr()
+	exitOnError(err)
+	httpProxy, err := t.HTTPProxyAddr()
+	exitOnError(err)
+	reversePorts, dests, sockets, err := config.ParseReverse(t.Reverse)
+	exitOnError(err)
+	att := daemon.Attachment{
+		Target:  t.Target,
+		Runtime: t.Runtime,
+		Reverse: reversePorts,
+		Include: t.Include,
+		Exclude: t.Exclude,
+		Pins:    pins,
+		Bind:    t.Bind,
+
+		Processes:        t.Processes,
+		ExcludeProcesses: t.ExcludeProcesses,
+
+		ScanMin: scanMin,
+		ScanMax: scanMax,
+
+		Probe:    t.Probe,
+		Debounce: debounce,
+
+		Socks:     socks,
+		HTTPProxy: httpProxy,
+		Allow:     t.Allow,
+		Encrypt:   t.Encrypted(),
+		AllowFrom: t.AllowFrom,
+
+		ReverseScan:  t.ReverseScan,
+		Destinations: dests,
+		UnixSockets:  sockets,
+	}
+	err = daemonClient().Request(http.MethodPost, "/attach", att, nil)
+	exitOnError(err)
+}
+
+func runDetach(args []string) {
+	if len(args) != 1 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	q := url.Values{}
+	q.Set("target", args[0])
+	err := daemonClient().Request(http.MethodPost, "/detach?"+q.Encode(), nil, nil)
+	exitOnError(err)
+}
+
+func runLs(args []string) {
+	sessions := make([]daemon.SessionInfo, 0)
+	err := daemonClient().Request(http.MethodGet, "/sessions", nil, &sessions)
+	exitOnError(err)
+	if *output == "json" {
+		json.NewEncoder(os.Stdout).Encode(sessions)
+		return
+	}
+	fmt.Printf("%-30s %-11s %-11s %s\n", "TARGET", "RUNTIME", "STATE", "PORTS")
+	for _, s := range sessions {
+		ports := make([]string, 0, len(s.Ports))
+		for _, p := range s.Ports {
+			if p.Direction == "reverse" {
+				ports = append(ports, fmt.Sprintf("%d <== %d", p.Local, p.Remote))
+			} else {
+				ports = append(ports, fmt.Sprintf("%d ==> %d", p.Local, p.Remote))
+			}
+		}
+		state := s.State
+		if s.Error != "" {
+			state = fmt.Sprintf("%s (%s)", s.State, s.Error)
+		}
+		fmt.Printf("%-30s %-11s %-11s %s\n", s.Target, s.Runtime, state, strings.Join(ports, ", "))
+	}
+}
@@ -0,0 +1,12 @@
+package main
+
+import (
+	"errors"
+	"os/exec"
+)
+
+// detach isn't supported on Windows, the daemon is run in the foreground with -f instead, eg. by a
+// scheduled task.
+func detach(cmd *exec.Cmd) error {
+	return errors.New("the daemon can't be started in the background on Windows, run `apf daemon -f`")
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"github.com/ruoshan/autoportforward/front"
+	"github.com/ruoshan/autoportforward/session"
+)
+
+// startFront starts the front proxy routing by the hostnames to the ports of the sessions.
+// The token is required by the front proxy if not empty.
+func startFront(addr, token string, sessions func() []*session.Session) (*front.Proxy, error) {
+	p := front.NewProxy(addr, func() []front.Target {
+		targets := make([]front.Target, 0)
+		for _, s := range sessions() {
+			targets = append(targets, s)
+		}
+		return targets
+	}, log)
+	p.SetToken(token)
+	if err := p.Listen(); err != nil {
+		return nil, err
+	}
+	go p.Serve()
+	return p, nil
+}
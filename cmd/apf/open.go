@@ -0,0 +1,70 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ruoshan/autoportforward/browser"
+	"github.com/ruoshan/autoportforward/session"
+)
+
+// opener launches the browser for the forwarded ports when they first appear: the ports given by
+// -open-port, or the ports speaking HTTP if -open is given. The ports not classified yet are probed
+// with a HEAD request.
+type opener struct {
+	s      *session.Session
+	all    bool
+	ports  map[uint16]bool // target ports
+	mu     sync.Mutex
+	opened map[uint16]bool
+	probed map[uint16]bool
+}
+
+func newOpener(s *session.Session, all bool, ports []uint16) *opener {
+	o := &opener{
+		s:      s,
+		all:    all,
+		ports:  make(map[uint16]bool),
+		opened: make(map[uint16]bool),
+		probed: make(map[uint16]bool),
+	}
+	for _, p := range ports {
+		o.ports[p] = true
+	}
+	return o
+}
+
+// DumpPorts is meant to be used as the dump callback
+func (o *opener) DumpPorts(localPortMap, peerPortMap map[uint16]uint16) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for targetPort := range localPortMap {
+		if o.opened[targetPort] {
+			continue
+		}
+		url := ""
+		if o.ports[targetPort] {
+			url = o.s.LocalURL(targetPort)
+		} else if o.all {
+			url = o.s.URL(targetPort)
+			if url == "" && !o.probed[targetPort] {
+				o.probed[targetPort] = true
+				go o.probe(targetPort)
+			}
+		}
+		if url == "" {
+			continue
+		}
+		o.opened[targetPort] = true
+		if err := browser.Open(url); err != nil {
+			log.Printf("Failed to open browser: %s", err)
+		}
+	}
+}
+
+// probe classifies the port, the port is dumped again if it turns out to speak HTTP
+func (o *opener) probe(targetPort uint16) {
+	if _, err := o.s.ProxyListener().ProbeHTTP(targetPort, 3*time.Second); err != nil {
+		log.Printf("Failed to probe port %d: %s", targetPort, err)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/ruoshan/autoportforward/config"
+	"github.com/ruoshan/autoportforward/session"
+)
+
+// parseReverseSpec parses a reverse forwarding of a port: {port}, {port}:{local port} or {port}:{host}:{port}
+func parseReverseSpec(spec string) (port uint16, dest string, err error) {
+	ports, dests, _, err := config.ParseReverse([]config.ReverseSpec{config.ReverseSpec(spec)})
+	if err != nil {
+		return 0, "", err
+	}
+	if len(ports) == 0 {
+		return 0, "", fmt.Errorf("not a port: %s (the unix sockets can be added in the terminal of apf)", spec)
+	}
+	return ports[0], dests[ports[0]], nil
+}
+
+// readCommands changes the reverse ports of the session by the commands read from r (stdin), one per line:
+//   - reverse-add {port}[:{local port} | :{host}:{port}] or reverse-add unix:{local path}:{path}
+//   - reverse-rm {port} or reverse-rm {path}
+func readCommands(r io.Reader, s *session.Session) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		var err error
+		switch {
+		case fields[0] == "reverse-add" && len(fields) == 2:
+			err = addReverse(s, fields[1])
+		case fields[0] == "reverse-rm" && len(fields) == 2 && strings.HasPrefix(fields[1], "/"):
+			err = s.RemoveUnixSocket(fields[1])
+		case fields[0] == "reverse-rm" && len(fields) == 2:
+			var port uint64
+			if port, err = strconv.ParseUint(fields[1], 10, 16); err == nil {
+				err = s.RemoveReversePort(uint16(port))
+			}
+		default:
+			err = fmt.Errorf("unknown command: %s (reverse-add {spec of -r}, reverse-rm {port / path})", scanner.Text())
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		}
+	}
+}
+
+func addReverse(s *session.Session, spec string) error {
+	ports, dests, sockets, err := config.ParseReverse([]config.ReverseSpec{config.ReverseSpec(spec)})
+	if err != nil {
+		return err
+	}
+	for path, local := range sockets {
+		if err := s.AddUnixSocket(path, local); err != nil {
+			return err
+		}
+	}
+	for _, port := range ports {
+		if err := s.AddReversePort(port, dests[port]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reloadOnHUP replaces the reverse ports of the session with the ones of the re-read configuration files
+// on SIGHUP, the -r option still overrides the files.
+func reloadOnHUP(s *session.Session) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	go func() {
+		for range c {
+			log.Println("Received HUP signal, reloading the reverse ports")
+			t, err := resolveTarget(flag.Args())
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to reload the configuration: %s\n", err)
+				continue
+			}
+			ports, dests, sockets, err := config.ParseReverse(t.Reverse)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to reload the configuration: %s\n", err)
+				continue
+			}
+			s.SetReversePorts(ports, dests, sockets)
+		}
+	}()
+}
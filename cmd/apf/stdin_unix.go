@@ -0,0 +1,47 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+	"golang.org/x/term"
+)
+
+// commandInput returns stdin to read the commands from, false if stdin isn't a terminal in the foreground
+// (eg. `apf ... &`, </dev/null or run by systemd), so that apf isn't stopped by SIGTTIN.
+func commandInput() (io.Reader, bool) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return nil, false
+	}
+	pgrp, err := unix.IoctlGetInt(fd, unix.TIOCGPGRP)
+	if err != nil || pgrp != unix.Getpgrp() {
+		return nil, false
+	}
+	// Once moved to the background (Ctrl-Z and bg), the reads fail with EIO instead of stopping apf
+	signal.Ignore(syscall.SIGTTIN)
+	return foregroundReader{os.Stdin}, true
+}
+
+// foregroundReader waits for the process to be in the foreground again when the read fails with EIO.
+type foregroundReader struct {
+	f *os.File
+}
+
+func (r foregroundReader) Read(b []byte) (int, error) {
+	for {
+		n, err := r.f.Read(b)
+		if !errors.Is(err, syscall.EIO) {
+			return n, err
+		}
+		time.Sleep(time.Second)
+	}
+}
@@ -0,0 +1,16 @@
+package main
+
+import (
+	"io"
+	"os"
+
+	"golang.org/x/term"
+)
+
+// commandInput returns stdin to read the commands from, false if stdin isn't a terminal.
+func commandInput() (io.Reader, bool) {
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		return nil, false
+	}
+	return os.Stdin, true
+}
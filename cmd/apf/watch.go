@@ -0,0 +1,50 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/ruoshan/autoportforward/bootstrap"
+	"github.com/ruoshan/autoportforward/daemon"
+	"github.com/ruoshan/autoportforward/watch"
+)
+
+// runWatch attaches to the containers (or pods) with the label as they start, until interrupted.
+func runWatch(args []string) {
+	fs := flag.NewFlagSet("watch", flag.ExitOnError)
+	var label string
+	fs.StringVar(&label, "label", "apf.enable=true", "attach to the containers with the label")
+	fs.StringVar(&label, "l", "apf.enable=true", "shorthand of -label, the label selector of the pods for Kubernetes")
+	namespace := fs.String("n", "default", "the namespace of the pods for Kubernetes")
+	fs.Parse(args)
+
+	rt := runtimeFromFlags()
+	d := daemon.NewDaemon("", *dbg, log)
+	// Serve the daemon API so that `apf ls` lists the attached containers, unless the daemon is running
+	svr := daemon.NewServer(daemon.SocketPath(), d, log)
+	if err := svr.Listen(); err != nil {
+		log.Printf("Failed to serve the daemon API: %s", err)
+	} else {
+		go svr.Serve()
+		defer svr.Close()
+	}
+
+	if rt == bootstrap.KUBERNETES {
+		fmt.Printf("Watching pods in namespace %s with selector %s\n", *namespace, label)
+		w := watch.NewPodWatcher(*namespace, label, d, log)
+		d.SetDumpCallback(w.DumpPorts)
+		go w.Run()
+	} else {
+		fmt.Printf("Watching %s containers with label %s\n", rt, label)
+		go watch.NewContainerWatcher(rt.String(), label, d, log).Run()
+	}
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	<-c
+	log.Println("Stop watching")
+	d.Shutdown()
+}
@@ -0,0 +1,700 @@
+// Package config loads the per-project configuration file (.apf.yaml or .apf.toml), which is
+// discovered by walking up from the working directory, and the user configuration file
+// (~/.config/apf/config.yaml). The project file takes precedence over the user file. The settings of a
+// project file exposing the host (eg. the hooks) are ignored until the file is trusted, see Trust.
+//
+// Example:
+//
+//	runtime: docker
+//	target: redis          # the default target if none is given on the command line
+//	include: [6379]
+//	pins: ["6379:16379"]   # {remote port}:{local port}
+//	bind: 127.0.0.1
+//	hooks:
+//	  on_port_added: notify-send "apf" "$APF_LOCAL_PORT ==> $APF_REMOTE_PORT"
+//	targets:               # named targets, eg. `apf web`
+//	  web:
+//	    runtime: kubernetes
+//	    target: dev/web-0
+//	    reverse: [9090]
+package config
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+
+	"github.com/ruoshan/autoportforward/bootstrap"
+	"github.com/ruoshan/autoportforward/portscan"
+	"github.com/ruoshan/autoportforward/proxy"
+)
+
+// The names of the project configuration files, in the order of precedence
+var ProjectFiles = []string{".apf.yaml", ".apf.yml", ".apf.toml"}
+
+// Hooks are shell commands run on the events, with the details in the environment variables:
+// APF_EVENT, APF_TARGET, APF_DIRECTION, APF_LOCAL_PORT and APF_REMOTE_PORT.
+type Hooks struct {
+	OnStart       string `yaml:"on_start" toml:"on_start"`
+	OnStop        string `yaml:"on_stop" toml:"on_stop"`
+	OnPortAdded   string `yaml:"on_port_added" toml:"on_port_added"`
+	OnPortRemoved string `yaml:"on_port_removed" toml:"on_port_removed"`
+}
+
+type Target struct {
+	Runtime string        `yaml:"runtime" toml:"runtime"` // docker, kubernetes or podman
+	Target  string        `yaml:"target" toml:"target"`   // container ID / name, or {namespace}/{pod ID}
+	Include []uint16      `yaml:"include" toml:"include"`
+	Exclude []uint16      `yaml:"exclude" toml:"exclude"`
+	Pins    []string      `yaml:"pins" toml:"pins"`       // {remote port}:{local port}
+	Reverse []ReverseSpec `yaml:"reverse" toml:"reverse"` // {port}, {port}:{local port}, {port}:{host}:{port} or unix:{local path}:{path}
+	Bind    string        `yaml:"bind" toml:"bind"`       // the address of the local listeners
+	Hooks   Hooks         `yaml:"hooks" toml:"hooks"`
+
+	// Forward the local listeners in the port ranges back to the container as they appear, eg. 3000-3999
+	ReverseScan []string `yaml:"reverse_scan" toml:"reverse_scan"`
+
+	// Filter the ports by the names of their owning processes in the container, eg. node
+	Processes        []string `yaml:"processes" toml:"processes"`
+	ExcludeProcesses []string `yaml:"exclude_processes" toml:"exclude_processes"`
+
+	// The min / max interval of the port scanning in the container, eg. 250ms
+	ScanMin string `yaml:"scan_min" toml:"scan_min"`
+	ScanMax string `yaml:"scan_max" toml:"scan_max"`
+
+	// Only forward the ports that pass the probe (tcp, http[:{path}] or exec:{command}), and have been
+	// listened for the debounce duration, eg. 2s
+	Probe    string `yaml:"probe" toml:"probe"`
+	Debounce string `yaml:"debounce" toml:"debounce"`
+
+	// Open the browser for the ports speaking HTTP, or the given ports, when they first appear
+	Open      *bool    `yaml:"open" toml:"open"`
+	OpenPorts []uint16 `yaml:"open_ports" toml:"open_ports"`
+
+	// The address of the front proxy routing by the hostnames, eg. 127.0.0.1:8000, and the token required
+	// by the front proxy, optional
+	Front      string `yaml:"front" toml:"front"`
+	FrontToken string `yaml:"front_token" toml:"front_token"`
+
+	// The source addresses allowed to connect to the local listeners: {CIDR} for all the ports, or
+	// {remote port}={CIDR}, eg. 6379=192.168.1.0/24
+	AllowFrom []string `yaml:"allow_from" toml:"allow_from"`
+
+	// The address of the SOCKS5 server / HTTP proxy dialing from the container, eg. 127.0.0.1:1080, a port
+	// is on 127.0.0.1. The destinations can be restricted by the allowlist of CIDRs and domains.
+	Socks     string   `yaml:"socks" toml:"socks"`
+	HTTPProxy string   `yaml:"http_proxy" toml:"http_proxy"`
+	Allow     []string `yaml:"allow" toml:"allow"`
+
+	// Encrypt the tunnel to the agent with an ephemeral key of the session
+	Encrypt *bool `yaml:"encrypt" toml:"encrypt"`
+}
+
+// OpenAll tells whether to open the browser for all the ports speaking HTTP.
+func (t Target) OpenAll() bool {
+	return t.Open != nil && *t.Open
+}
+
+// Encrypted tells whether to encrypt the tunnel to the agent.
+func (t Target) Encrypted() bool {
+	return t.Encrypt != nil && *t.Encrypt
+}
+
+type Config struct {
+	Target  `yaml:",inline"`
+	Targets map[string]Target `yaml:"targets" toml:"targets"`
+	Files   []string          `yaml:"-" toml:"-"` // the loaded files
+
+	Untrusted []Untrusted `yaml:"-" toml:"-"` // the settings ignored in the untrusted project files
+}
+
+// Untrusted is a project file that isn't trusted, see Trust.
+type Untrusted struct {
+	File     string
+	Settings []string // the ignored settings, eg. hooks, bind: 0.0.0.0
+}
+
+// Load reads the configuration file, the format is determined by the extension.
+func Load(path string) (*Config, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &Config{}
+	switch filepath.Ext(path) {
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(bytes.NewReader(b))
+		dec.KnownFields(true)
+		// An empty file is fine
+		if err := dec.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+	case ".toml":
+		md, err := toml.Decode(string(b), cfg)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+		if undecoded := md.Undecoded(); len(undecoded) > 0 {
+			return nil, fmt.Errorf("%s: unknown field %s", path, undecoded[0])
+		}
+	default:
+		return nil, fmt.Errorf("%s: unknown config format", path)
+	}
+	cfg.Files = []string{path}
+	return cfg, nil
+}
+
+// UserFile returns the path of the user configuration file: $XDG_CONFIG_HOME/apf/config.yaml,
+// or ~/.config/apf/config.yaml if XDG_CONFIG_HOME is not set (on macOS as well).
+func UserFile() string {
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if dir == "" {
+		home, _ := os.UserHomeDir()
+		dir = filepath.Join(home, ".config")
+	}
+	return filepath.Join(dir, "apf", "config.yaml")
+}
+
+// FindProjectFile walks up from the dir to find the project configuration file
+func FindProjectFile(dir string) (string, bool) {
+	for {
+		for _, name := range ProjectFiles {
+			path := filepath.Join(dir, name)
+			if _, err := os.Stat(path); err == nil {
+				return path, true
+			}
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", false
+		}
+		dir = parent
+	}
+}
+
+// Discover loads the user configuration file and the project configuration file found from the dir,
+// a missing file is not an error. The settings of the project file exposing the host are dropped unless
+// it's trusted, as the file may come with a cloned repository, see restrict.
+func Discover(dir string) (*Config, error) {
+	cfg := &Config{}
+	paths := []string{UserFile()}
+	if path, ok := FindProjectFile(dir); ok {
+		paths = append(paths, path)
+	}
+	for i, path := range paths {
+		c, err := Load(path)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if i > 0 {
+			if restricted, ignored := c.restrict(); len(ignored) > 0 && !Trusted(path) {
+				c = restricted
+				cfg.Untrusted = append(cfg.Untrusted, Untrusted{File: path, Settings: ignored})
+			}
+		}
+		cfg.merge(c)
+	}
+	return cfg, nil
+}
+
+// restrict returns the config without the settings exposing the host, and the dropped settings.
+func (c *Config) restrict() (*Config, []string) {
+	restricted := *c
+	t, ignored := c.Target.restrict()
+	restricted.Target = t
+	restricted.Targets = make(map[string]Target, len(c.Targets))
+	names := make([]string, 0, len(c.Targets))
+	for name := range c.Targets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		t, dropped := c.Targets[name].restrict()
+		restricted.Targets[name] = t
+		for _, setting := range dropped {
+			ignored = append(ignored, fmt.Sprintf("targets.%s.%s", name, setting))
+		}
+	}
+	return &restricted, ignored
+}
+
+// restrict drops the settings that run commands on the host, let the container reach the host beyond
+// the local ports (the unix sockets, the other hosts and the scanned ports), or open the listeners to
+// the network.
+func (t Target) restrict() (Target, []string) {
+	ignored := make([]string, 0)
+	if t.Hooks != (Hooks{}) {
+		t.Hooks = Hooks{}
+		ignored = append(ignored, "hooks")
+	}
+	if t.Reverse != nil {
+		reverse := make([]ReverseSpec, 0, len(t.Reverse))
+		for _, spec := range t.Reverse {
+			if localReverse(spec) {
+				reverse = append(reverse, spec)
+			} else {
+				ignored = append(ignored, fmt.Sprintf("reverse: %s", spec))
+			}
+		}
+		if len(reverse) == 0 && len(t.Reverse) > 0 {
+			// Not to override the reverse ports of the user file with none
+			reverse = nil
+		}
+		t.Reverse = reverse
+	}
+	if t.ReverseScan != nil {
+		t.ReverseScan = nil
+		ignored = append(ignored, "reverse_scan")
+	}
+	if t.Bind != "" && !loopback(t.Bind) {
+		ignored = append(ignored, fmt.Sprintf("bind: %s", t.Bind))
+		t.Bind = ""
+	}
+	return t, ignored
+}
+
+// localReverse tells whether the reverse spec only forwards to a local port: {port} or {port}:{local port}
+func localReverse(spec ReverseSpec) bool {
+	parts := strings.Split(string(spec), ":")
+	if len(parts) > 2 {
+		return false
+	}
+	for _, part := range parts {
+		if _, err := strconv.ParseUint(part, 10, 16); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+func loopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// TrustFile returns the path of the file recording the trusted project files, next to the user
+// configuration file.
+func TrustFile() string {
+	return filepath.Join(filepath.Dir(UserFile()), "trusted")
+}
+
+// fileHash returns the absolute path and the SHA-256 of the content of the file.
+func fileHash(path string) (abs, hash string, err error) {
+	if abs, err = filepath.Abs(path); err != nil {
+		return "", "", err
+	}
+	b, err := os.ReadFile(abs)
+	if err != nil {
+		return "", "", err
+	}
+	sum := sha256.Sum256(b)
+	return abs, hex.EncodeToString(sum[:]), nil
+}
+
+// readTrusted returns the trusted files: absolute path => SHA-256, each line of the file is
+// "{SHA-256} {absolute path}".
+func readTrusted() map[string]string {
+	trusted := make(map[string]string)
+	f, err := os.Open(TrustFile())
+	if err != nil {
+		return trusted
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if parts := strings.SplitN(scanner.Text(), " ", 2); len(parts) == 2 {
+			trusted[parts[1]] = parts[0]
+		}
+	}
+	return trusted
+}
+
+// Trusted tells whether the project file is trusted with its current content.
+func Trusted(path string) bool {
+	abs, hash, err := fileHash(path)
+	return err == nil && readTrusted()[abs] == hash
+}
+
+// Trust records the current content of the project file as trusted, so that its settings exposing the
+// host (eg. the hooks) are applied, see Discover. The file has to be trusted again once it's changed.
+func Trust(path string) error {
+	abs, hash, err := fileHash(path)
+	if err != nil {
+		return err
+	}
+	trusted := readTrusted()
+	trusted[abs] = hash
+	paths := make([]string, 0, len(trusted))
+	for p := range trusted {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	buf := &bytes.Buffer{}
+	for _, p := range paths {
+		fmt.Fprintf(buf, "%s %s\n", trusted[p], p)
+	}
+	if err := os.MkdirAll(filepath.Dir(TrustFile()), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(TrustFile(), buf.Bytes(), 0600)
+}
+
+// merge overrides the fields with the ones set in other
+func (c *Config) merge(other *Config) {
+	c.Target = c.Target.merge(other.Target)
+	for name, t := range other.Targets {
+		if c.Targets == nil {
+			c.Targets = make(map[string]Target)
+		}
+		c.Targets[name] = c.Targets[name].merge(t)
+	}
+	c.Files = append(c.Files, other.Files...)
+	c.Untrusted = append(c.Untrusted, other.Untrusted...)
+}
+
+func (t Target) merge(other Target) Target {
+	if other.Runtime != "" {
+		t.Runtime = other.Runtime
+	}
+	if other.Target != "" {
+		t.Target = other.Target
+	}
+	if other.Include != nil {
+		t.Include = other.Include
+	}
+	if other.Exclude != nil {
+		t.Exclude = other.Exclude
+	}
+	if other.Pins != nil {
+		t.Pins = other.Pins
+	}
+	if other.Reverse != nil {
+		t.Reverse = other.Reverse
+	}
+	if other.ReverseScan != nil {
+		t.ReverseScan = other.ReverseScan
+	}
+	if other.Bind != "" {
+		t.Bind = other.Bind
+	}
+	if other.Processes != nil {
+		t.Processes = other.Processes
+	}
+	if other.ExcludeProcesses != nil {
+		t.ExcludeProcesses = other.ExcludeProcesses
+	}
+	if other.ScanMin != "" {
+		t.ScanMin = other.ScanMin
+	}
+	if other.ScanMax != "" {
+		t.ScanMax = other.ScanMax
+	}
+	if other.Probe != "" {
+		t.Probe = other.Probe
+	}
+	if other.Debounce != "" {
+		t.Debounce = other.Debounce
+	}
+	if other.Open != nil {
+		t.Open = other.Open
+	}
+	if other.Encrypt != nil {
+		t.Encrypt = other.Encrypt
+	}
+	if other.OpenPorts != nil {
+		t.OpenPorts = other.OpenPorts
+	}
+	if other.Front != "" {
+		t.Front = other.Front
+	}
+	if other.FrontToken != "" {
+		t.FrontToken = other.FrontToken
+	}
+	if other.AllowFrom != nil {
+		t.AllowFrom = other.AllowFrom
+	}
+	if other.Socks != "" {
+		t.Socks = other.Socks
+	}
+	if other.HTTPProxy != "" {
+		t.HTTPProxy = other.HTTPProxy
+	}
+	if other.Allow != nil {
+		t.Allow = other.Allow
+	}
+	if other.Hooks.OnStart != "" {
+		t.Hooks.OnStart = other.Hooks.OnStart
+	}
+	if other.Hooks.OnStop != "" {
+		t.Hooks.OnStop = other.Hooks.OnStop
+	}
+	if other.Hooks.OnPortAdded != "" {
+		t.Hooks.OnPortAdded = other.Hooks.OnPortAdded
+	}
+	if other.Hooks.OnPortRemoved != "" {
+		t.Hooks.OnPortRemoved = other.Hooks.OnPortRemoved
+	}
+	return t
+}
+
+// Resolve returns the target of the name: the named target merged onto the defaults, or the
+// defaults with the name as the container ID if there isn't such a named target. An empty name
+// resolves to the default target.
+func (c *Config) Resolve(name string) Target {
+	if t, ok := c.Targets[name]; ok {
+		resolved := c.Target.merge(t)
+		if t.Target == "" {
+			resolved.Target = name
+		}
+		return resolved
+	}
+	t := c.Target
+	if name != "" {
+		t.Target = name
+	}
+	return t
+}
+
+// ReverseSpec is a reverse forwarding of the port in the container: {port}, {port}:{local port} or
+// {port}:{host}:{port}, eg. 5432:db.internal:5432, the destination is dialed on the local side. Or of
+// the local unix socket to the path in the container: unix:{local path}:{path}, eg.
+// unix:$SSH_AUTH_SOCK:/tmp/ssh-agent.sock, the environment variables of the local path are expanded.
+type ReverseSpec string
+
+// UnmarshalTOML accepts both the port numbers and the strings
+func (r *ReverseSpec) UnmarshalTOML(v interface{}) error {
+	switch v := v.(type) {
+	case int64:
+		*r = ReverseSpec(strconv.FormatInt(v, 10))
+	case string:
+		*r = ReverseSpec(v)
+	default:
+		return fmt.Errorf("invalid reverse forwarding: %v", v)
+	}
+	return nil
+}
+
+// ReverseSpecs converts the strings, eg. of the command line, to the specs
+func ReverseSpecs(specs []string) []ReverseSpec {
+	rs := make([]ReverseSpec, 0, len(specs))
+	for _, s := range specs {
+		rs = append(rs, ReverseSpec(s))
+	}
+	return rs
+}
+
+// ParseReverse parses the reverse forwardings to the ports in the container, the destinations of the
+// ports that are not forwarded to the same local port, and the unix sockets (the path in the container =>
+// the local path).
+func ParseReverse(specs []ReverseSpec) (ports []uint16, dests map[uint16]string, sockets map[string]string, err error) {
+	ports = make([]uint16, 0, len(specs))
+	dests = make(map[uint16]string)
+	sockets = make(map[string]string)
+	for _, spec := range specs {
+		splits := strings.SplitN(string(spec), ":", 2)
+		if splits[0] == "unix" && len(splits) == 2 {
+			paths := strings.SplitN(splits[1], ":", 2)
+			if len(paths) != 2 || paths[0] == "" || !strings.HasPrefix(paths[1], "/") {
+				return nil, nil, nil, fmt.Errorf("invalid reverse forwarding: %s", spec)
+			}
+			local := os.ExpandEnv(paths[0])
+			if local == "" {
+				return nil, nil, nil, fmt.Errorf("invalid reverse forwarding: %s (empty local path)", spec)
+			}
+			sockets[paths[1]] = local
+			continue
+		}
+		port, err := strconv.ParseUint(splits[0], 10, 16)
+		if err != nil || port == 0 {
+			return nil, nil, nil, fmt.Errorf("invalid reverse forwarding: %s", spec)
+		}
+		ports = append(ports, uint16(port))
+		if len(splits) == 1 {
+			continue
+		}
+		dest := splits[1]
+		if lport, err := strconv.ParseUint(dest, 10, 16); err == nil && lport != 0 {
+			dest = net.JoinHostPort("127.0.0.1", dest)
+		}
+		host, dport, err := net.SplitHostPort(dest)
+		if err != nil || host == "" {
+			return nil, nil, nil, fmt.Errorf("invalid reverse forwarding: %s", spec)
+		}
+		if p, err := strconv.ParseUint(dport, 10, 16); err != nil || p == 0 {
+			return nil, nil, nil, fmt.Errorf("invalid reverse forwarding: %s", spec)
+		}
+		dests[uint16(port)] = dest
+	}
+	return ports, dests, sockets, nil
+}
+
+// ParsePins parses the pinned mappings of {remote port}:{local port}
+func ParsePins(pins []string) (map[uint16]uint16, error) {
+	m := make(map[uint16]uint16)
+	for _, pin := range pins {
+		splits := strings.SplitN(pin, ":", 2)
+		if len(splits) != 2 {
+			return nil, fmt.Errorf("invalid pinned mapping: %s", pin)
+		}
+		rport, err1 := strconv.ParseUint(splits[0], 10, 16)
+		lport, err2 := strconv.ParseUint(splits[1], 10, 16)
+		if err1 != nil || err2 != nil || rport == 0 || lport == 0 {
+			return nil, fmt.Errorf("invalid pinned mapping: %s", pin)
+		}
+		m[uint16(rport)] = uint16(lport)
+	}
+	return m, nil
+}
+
+// ScanIntervals parses the scan intervals, zero if not set
+func (t Target) ScanIntervals() (min, max time.Duration, err error) {
+	for _, d := range []struct {
+		s string
+		v *time.Duration
+	}{{t.ScanMin, &min}, {t.ScanMax, &max}} {
+		if d.s == "" {
+			continue
+		}
+		if *d.v, err = time.ParseDuration(d.s); err != nil || *d.v <= 0 {
+			return 0, 0, fmt.Errorf("invalid scan interval: %s", d.s)
+		}
+	}
+	if min > 0 && max > 0 && max < min {
+		return 0, 0, fmt.Errorf("scan_max (%s) is less than scan_min (%s)", max, min)
+	}
+	return min, max, nil
+}
+
+// DebounceDuration parses the debounce, zero if not set
+func (t Target) DebounceDuration() (time.Duration, error) {
+	if t.Debounce == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(t.Debounce)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid debounce: %s", t.Debounce)
+	}
+	return d, nil
+}
+
+// SocksAddr returns the address of the SOCKS5 server, empty if not set
+func (t Target) SocksAddr() (string, error) {
+	return listenAddr("SOCKS5", t.Socks)
+}
+
+// HTTPProxyAddr returns the address of the HTTP proxy, empty if not set
+func (t Target) HTTPProxyAddr() (string, error) {
+	return listenAddr("HTTP proxy", t.HTTPProxy)
+}
+
+// listenAddr parses the local address, a port is on 127.0.0.1
+func listenAddr(name, addr string) (string, error) {
+	if addr == "" {
+		return "", nil
+	}
+	if port, err := strconv.ParseUint(addr, 10, 16); err == nil && port != 0 {
+		return net.JoinHostPort("127.0.0.1", addr), nil
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return "", fmt.Errorf("invalid %s address: %s", name, addr)
+	}
+	return addr, nil
+}
+
+func (t Target) Validate() error {
+	if t.Runtime != "" {
+		if _, err := bootstrap.ParseRTType(t.Runtime); err != nil {
+			return err
+		}
+	}
+	if t.Target != "" && t.Runtime == bootstrap.KUBERNETES.String() && !strings.Contains(t.Target, "/") {
+		return fmt.Errorf("invalid kubernetes pod id format ({namespace}/{pod_name}): %s", t.Target)
+	}
+	if _, err := ParsePins(t.Pins); err != nil {
+		return err
+	}
+	if _, _, err := t.ScanIntervals(); err != nil {
+		return err
+	}
+	if t.Probe != "" {
+		if _, err := portscan.ParseProber(t.Probe); err != nil {
+			return err
+		}
+	}
+	if _, err := t.DebounceDuration(); err != nil {
+		return err
+	}
+	if t.Bind != "" && net.ParseIP(t.Bind) == nil {
+		return fmt.Errorf("invalid bind address: %s", t.Bind)
+	}
+	if t.Front != "" {
+		if _, _, err := net.SplitHostPort(t.Front); err != nil {
+			return fmt.Errorf("invalid front proxy address: %s", t.Front)
+		}
+	}
+	if _, err := portscan.ParsePortRanges(t.ReverseScan); err != nil {
+		return err
+	}
+	if _, err := t.SocksAddr(); err != nil {
+		return err
+	}
+	if _, err := t.HTTPProxyAddr(); err != nil {
+		return err
+	}
+	if _, err := proxy.ParseAllowlist(t.Allow); err != nil {
+		return err
+	}
+	if _, err := proxy.ParseSources(t.AllowFrom); err != nil {
+		return err
+	}
+	for _, names := range [][]string{t.Processes, t.ExcludeProcesses} {
+		for _, name := range names {
+			if strings.TrimSpace(name) == "" {
+				return errors.New("invalid process name: empty")
+			}
+		}
+	}
+	if _, _, _, err := ParseReverse(t.Reverse); err != nil {
+		return err
+	}
+	for _, ports := range [][]uint16{t.Include, t.Exclude, t.OpenPorts} {
+		for _, p := range ports {
+			if p == 0 {
+				return errors.New("invalid port: 0")
+			}
+		}
+	}
+	return nil
+}
+
+func (c *Config) Validate() error {
+	if err := c.Target.Validate(); err != nil {
+		return err
+	}
+	for name := range c.Targets {
+		if err := c.Resolve(name).Validate(); err != nil {
+			return fmt.Errorf("target %s: %s", name, err)
+		}
+	}
+	return nil
+}
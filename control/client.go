@@ -0,0 +1,82 @@
+package control
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+type Client struct {
+	http *http.Client
+}
+
+func NewClient(path string) *Client {
+	return &Client{
+		http: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					// Not to talk to a socket planted by another user
+					if err := checkSocketDir(filepath.Dir(path)); err != nil {
+						return nil, err
+					}
+					return (&net.Dialer{}).DialContext(ctx, "unix", path)
+				},
+			},
+		},
+	}
+}
+
+// Do sends the request to the control server and decodes the JSON response into v (if not nil).
+func (c *Client) Do(method string, v interface{}, segments ...interface{}) error {
+	parts := make([]string, 0, len(segments))
+	for _, seg := range segments {
+		parts = append(parts, fmt.Sprint(seg))
+	}
+	return c.Request(method, "/"+strings.Join(parts, "/"), nil, v)
+}
+
+// Request sends the request of the path (may include the query) with body encoded as JSON (if
+// not nil) to the server and decodes the JSON response into v (if not nil).
+func (c *Client) Request(method, path string, body, v interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, "http://apf"+path, reader)
+	if err != nil {
+		return err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		e := ErrorResp{}
+		if err := json.NewDecoder(resp.Body).Decode(&e); err != nil || e.Error == "" {
+			return errors.New(resp.Status)
+		}
+		return errors.New(e.Error)
+	}
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func (c *Client) Status() (Status, error) {
+	st := Status{}
+	err := c.Do(http.MethodGet, &st, "status")
+	return st, err
+}
@@ -0,0 +1,72 @@
+// Package control serves a small JSON/HTTP API over a unix socket, so that a running apf can be
+// inspected and changed without restarting it. Endpoints:
+//   - GET    /status              : list the forwarded ports and the forwarding rules
+//   - POST   /reverse/{port}      : add a reverse port, ?dest={host}:{port} to forward it to the destination
+//   - DELETE /reverse/{port}      : remove a reverse port
+//   - POST   /pin/{rport}/{lport} : always forward the remote port from the local port
+//   - DELETE /pin/{rport}         : unpin the remote port
+//   - POST   /exclude/{rport}     : stop forwarding the remote port
+//   - DELETE /exclude/{rport}     : forward the remote port again
+//   - POST   /shutdown            : shutdown apf
+package control
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+type Process struct {
+	PID     uint32 `json:"pid"`
+	UID     uint32 `json:"uid"`
+	Name    string `json:"name"`
+	Command string `json:"command,omitempty"`
+}
+
+type Port struct {
+	Direction string   `json:"direction"` // "forward" or "reverse"
+	Local     uint16   `json:"local"`
+	Remote    uint16   `json:"remote"`
+	Paused    bool     `json:"paused,omitempty"`
+	Process   *Process `json:"process,omitempty"` // the owning process of the remote port (forward only)
+	Service   string   `json:"service,omitempty"` // the service sniffed from the connections, eg. "tls example.com"
+}
+
+type Status struct {
+	Target   string            `json:"target"`
+	Ports    []Port            `json:"ports"`
+	Reverse  []uint16          `json:"reverse"`  // the requested reverse ports
+	Dests    map[uint16]string `json:"dests"`    // reverse port => the destination dialed locally
+	Sockets  map[string]string `json:"sockets"`  // the path in the container => the local unix socket
+	Pinned   map[uint16]uint16 `json:"pinned"`   // remote port => local port
+	Excluded []uint16          `json:"excluded"` // remote ports
+}
+
+// Backend is implemented by the running session
+type Backend interface {
+	Status() Status
+	AddReversePort(port uint16, dest string) error
+	RemoveReversePort(port uint16) error
+	Pin(rport, lport uint16) error
+	Unpin(rport uint16) error
+	Exclude(rport uint16) error
+	Unexclude(rport uint16) error
+	Shutdown()
+}
+
+// SocketDir returns the directory of the control sockets: $XDG_RUNTIME_DIR/apf, or a per-user
+// directory in the temp dir if XDG_RUNTIME_DIR is not set. The directory must be owned by the user
+// with the mode 0700 to be used, see ListenUnix.
+func SocketDir() string {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "apf")
+	}
+	return filepath.Join(os.TempDir(), fmt.Sprintf("apf-%d", os.Getuid()))
+}
+
+// SocketPath returns the path of the control socket of the target (container ID / name or {namespace}/{pod})
+func SocketPath(target string) string {
+	name := strings.NewReplacer("/", "_", ":", "_").Replace(target)
+	return filepath.Join(SocketDir(), name+".sock")
+}
@@ -0,0 +1,141 @@
+package control
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+type fakeBackend struct {
+	st       Status
+	shutdown chan struct{}
+}
+
+func (f *fakeBackend) Status() Status {
+	return f.st
+}
+
+func (f *fakeBackend) AddReversePort(port uint16, dest string) error {
+	f.st.Reverse = append(f.st.Reverse, port)
+	if dest != "" {
+		f.st.Dests[port] = dest
+	}
+	return nil
+}
+
+func (f *fakeBackend) RemoveReversePort(port uint16) error {
+	f.st.Reverse = nil
+	return nil
+}
+
+func (f *fakeBackend) Pin(rport, lport uint16) error {
+	f.st.Pinned[rport] = lport
+	return nil
+}
+
+func (f *fakeBackend) Unpin(rport uint16) error {
+	delete(f.st.Pinned, rport)
+	return nil
+}
+
+func (f *fakeBackend) Exclude(rport uint16) error {
+	f.st.Excluded = append(f.st.Excluded, rport)
+	return nil
+}
+
+func (f *fakeBackend) Unexclude(rport uint16) error {
+	f.st.Excluded = nil
+	return nil
+}
+
+func (f *fakeBackend) Shutdown() {
+	close(f.shutdown)
+}
+
+func TestControl(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "apf", "test.sock")
+	backend := &fakeBackend{
+		st:       Status{Target: "redis", Pinned: map[uint16]uint16{}, Dests: map[uint16]string{}},
+		shutdown: make(chan struct{}),
+	}
+	svr := NewServer(path, backend, log.Default())
+	if err := svr.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	go svr.Serve()
+	defer svr.Close()
+
+	// Only one server per socket
+	if err := NewServer(path, backend, log.Default()).Listen(); err == nil {
+		t.Fatal("expected the socket to be in use")
+	}
+
+	cli := NewClient(path)
+	st := Status{}
+	if err := cli.Do(http.MethodPost, &st, "reverse", 8080); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(st.Reverse, []uint16{8080}) {
+		t.Fatalf("unexpected reverse ports: %v", st.Reverse)
+	}
+	if err := cli.Request(http.MethodPost, "/reverse/5432?dest=db.internal%3A5432", nil, &st); err != nil {
+		t.Fatal(err)
+	}
+	if st.Dests[5432] != "db.internal:5432" {
+		t.Fatalf("unexpected destinations: %v", st.Dests)
+	}
+	if err := cli.Do(http.MethodPost, &st, "pin", 80, 8000); err != nil {
+		t.Fatal(err)
+	}
+	if st.Pinned[80] != 8000 {
+		t.Fatalf("unexpected pinned ports: %v", st.Pinned)
+	}
+	if err := cli.Do(http.MethodPost, &st, "pin", 80); err == nil {
+		t.Fatal("expected error for missing local port")
+	}
+	if err := cli.Do(http.MethodPost, &st, "exclude", "abc"); err == nil {
+		t.Fatal("expected error for invalid port")
+	}
+	if st, err := cli.Status(); err != nil || st.Target != "redis" {
+		t.Fatalf("unexpected status: %v, %v", st, err)
+	}
+	if err := cli.Do(http.MethodPost, nil, "shutdown"); err != nil {
+		t.Fatal(err)
+	}
+	<-backend.shutdown
+}
+
+func TestSocketPath(t *testing.T) {
+	t.Setenv("XDG_RUNTIME_DIR", "/run/user/1000")
+	if got := SocketPath("default/redis"); got != "/run/user/1000/apf/default_redis.sock" {
+		t.Errorf("SocketPath() = %s", got)
+	}
+}
+
+func TestListenUnixDir(t *testing.T) {
+	dir := t.TempDir()
+	open := filepath.Join(dir, "open")
+	os.Mkdir(open, 0700)
+	os.Chmod(open, 0777)
+	link := filepath.Join(dir, "link")
+	os.Mkdir(filepath.Join(dir, "private"), 0700)
+	os.Symlink(filepath.Join(dir, "private"), link)
+
+	for _, d := range []string{open, link} {
+		if l, err := ListenUnix(filepath.Join(d, "redis.sock")); err == nil {
+			l.Close()
+			t.Errorf("expected %s to be refused", d)
+		}
+	}
+	l, err := ListenUnix(filepath.Join(dir, "apf", "redis.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	if err := NewClient(filepath.Join(open, "redis.sock")).Do(http.MethodGet, nil, "status"); err == nil {
+		t.Error("expected the client to refuse the directory")
+	}
+}
@@ -0,0 +1,139 @@
+package control
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+type Server struct {
+	path     string
+	backend  Backend
+	logger   *log.Logger
+	listener net.Listener
+	http     *http.Server
+}
+
+func NewServer(path string, backend Backend, logger *log.Logger) *Server {
+	s := &Server{
+		path:    path,
+		backend: backend,
+		logger:  logger,
+	}
+	s.http = &http.Server{Handler: s}
+	return s
+}
+
+// ListenUnix creates the unix socket of the path. It fails if another process is serving on the
+// same socket, a stale socket file is removed. The directory is created if needed, and refused if it
+// may be controlled by another user, eg. a symlink or not of the mode 0700.
+func ListenUnix(path string) (net.Listener, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	if err := checkSocketDir(filepath.Dir(path)); err != nil {
+		return nil, err
+	}
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return nil, errors.New("socket is in use: " + path)
+	}
+	os.Remove(path)
+	return net.Listen("unix", path)
+}
+
+func (s *Server) Listen() error {
+	l, err := ListenUnix(s.path)
+	if err != nil {
+		return err
+	}
+	s.listener = l
+	return nil
+}
+
+func (s *Server) Serve() {
+	s.logger.Printf("Serving control API on %s", s.path)
+	s.http.Serve(s.listener)
+}
+
+func (s *Server) Close() {
+	s.http.Close()
+	os.Remove(s.path)
+}
+
+// ErrorResp is the body of the failed responses
+type ErrorResp struct {
+	Error string `json:"error"`
+}
+
+// WriteJSON writes the response with v encoded as JSON
+func WriteJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func parsePorts(segments []string) ([]uint16, error) {
+	ports := make([]uint16, 0, len(segments))
+	for _, seg := range segments {
+		i, err := strconv.ParseUint(seg, 10, 16)
+		if err != nil || i == 0 {
+			return nil, errors.New("invalid port: " + seg)
+		}
+		ports = append(ports, uint16(i))
+	}
+	return ports, nil
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	segments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	resource := segments[0]
+	ports, err := parsePorts(segments[1:])
+	if err != nil {
+		WriteJSON(w, http.StatusBadRequest, ErrorResp{err.Error()})
+		return
+	}
+	s.logger.Printf("Control request: %s %s", r.Method, r.URL.Path)
+
+	type route struct {
+		method   string
+		resource string
+		nports   int
+	}
+	switch (route{r.Method, resource, len(ports)}) {
+	case route{http.MethodGet, "status", 0}:
+		WriteJSON(w, http.StatusOK, s.backend.Status())
+		return
+	case route{http.MethodPost, "reverse", 1}:
+		err = s.backend.AddReversePort(ports[0], r.URL.Query().Get("dest"))
+	case route{http.MethodDelete, "reverse", 1}:
+		err = s.backend.RemoveReversePort(ports[0])
+	case route{http.MethodPost, "pin", 2}:
+		err = s.backend.Pin(ports[0], ports[1])
+	case route{http.MethodDelete, "pin", 1}:
+		err = s.backend.Unpin(ports[0])
+	case route{http.MethodPost, "exclude", 1}:
+		err = s.backend.Exclude(ports[0])
+	case route{http.MethodDelete, "exclude", 1}:
+		err = s.backend.Unexclude(ports[0])
+	case route{http.MethodPost, "shutdown", 0}:
+		WriteJSON(w, http.StatusOK, struct{}{})
+		// Shutdown after the response is written
+		go s.backend.Shutdown()
+		return
+	default:
+		WriteJSON(w, http.StatusNotFound, ErrorResp{"unknown request: " + r.Method + " " + r.URL.Path})
+		return
+	}
+	if err != nil {
+		WriteJSON(w, http.StatusUnprocessableEntity, ErrorResp{err.Error()})
+		return
+	}
+	WriteJSON(w, http.StatusOK, s.backend.Status())
+}
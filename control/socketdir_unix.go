@@ -0,0 +1,29 @@
+//go:build !windows
+// +build !windows
+
+package control
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// checkSocketDir refuses the directory of the sockets unless it's a real directory owned by the user with
+// the mode 0700, as the fallback directory in the temp dir may be created by another user in advance.
+func checkSocketDir(dir string) error {
+	fi, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok && int(st.Uid) != os.Getuid() {
+		return fmt.Errorf("%s is owned by another user (%d)", dir, st.Uid)
+	}
+	if mode := fi.Mode().Perm(); mode != 0700 {
+		return fmt.Errorf("%s has the mode %#o, want 0700", dir, mode)
+	}
+	return nil
+}
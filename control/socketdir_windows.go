@@ -0,0 +1,19 @@
+package control
+
+import (
+	"fmt"
+	"os"
+)
+
+// checkSocketDir refuses the directory of the sockets unless it's a real directory, the ownership is
+// left to the ACLs on Windows.
+func checkSocketDir(dir string) error {
+	fi, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	return nil
+}
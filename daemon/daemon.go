@@ -0,0 +1,434 @@
+// Package daemon runs many sessions in the background. The desired attachments are persisted to
+// disk so that they are restored after the daemon restarts, and a session is re-established when
+// the connection to the container is lost (eg. the container is restarted).
+package daemon
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ruoshan/autoportforward/bootstrap"
+	"github.com/ruoshan/autoportforward/control"
+	"github.com/ruoshan/autoportforward/portscan"
+	"github.com/ruoshan/autoportforward/proxy"
+	"github.com/ruoshan/autoportforward/session"
+)
+
+// Session states
+const (
+	Connecting = "connecting"
+	Attached   = "attached"
+	Retrying   = "retrying"
+)
+
+const maxBackoff = 1 * time.Minute
+
+type Attachment struct {
+	Target  string            `json:"target"`
+	Runtime string            `json:"runtime"`
+	Reverse []uint16          `json:"reverse,omitempty"`
+	Include []uint16          `json:"include,omitempty"`
+	Exclude []uint16          `json:"exclude,omitempty"`
+	Pins    map[uint16]uint16 `json:"pins,omitempty"` // remote port => local port
+	Bind    string            `json:"bind,omitempty"`
+
+	PinFallback bool `json:"pin_fallback,omitempty"` // allocate another local port if the pinned one is in use
+
+	Processes        []string `json:"processes,omitempty"`
+	ExcludeProcesses []string `json:"exclude_processes,omitempty"`
+
+	ScanMin time.Duration `json:"scan_min,omitempty"`
+	ScanMax time.Duration `json:"scan_max,omitempty"`
+
+	Probe    string        `json:"probe,omitempty"`
+	Debounce time.Duration `json:"debounce,omitempty"`
+
+	Socks     string   `json:"socks,omitempty"` // the address of the SOCKS5 server
+	HTTPProxy string   `json:"http_proxy,omitempty"`
+	Allow     []string `json:"allow,omitempty"`
+	Encrypt   bool     `json:"encrypt,omitempty"`    // encrypt the tunnel to the agent
+	AllowFrom []string `json:"allow_from,omitempty"` // the source addresses allowed to the local listeners
+
+	ReverseScan  []string          `json:"reverse_scan,omitempty"` // the port ranges of the local listeners forwarded back
+	Destinations map[uint16]string `json:"destinations,omitempty"` // reverse port => the destination dialed locally
+	UnixSockets  map[string]string `json:"unix_sockets,omitempty"` // the path in the container => the local unix socket
+}
+
+type SessionInfo struct {
+	Attachment
+	State string         `json:"state"`
+	Error string         `json:"error,omitempty"`
+	Ports []control.Port `json:"ports,omitempty"`
+}
+
+// StateDir returns $XDG_STATE_HOME/apf, or ~/.local/state/apf if XDG_STATE_HOME is not set.
+func StateDir() string {
+	if dir := os.Getenv("XDG_STATE_HOME"); dir != "" {
+		return filepath.Join(dir, "apf")
+	}
+	home, _ := os.UserHomeDir()
+	return filepath.Join(home, ".local", "state", "apf")
+}
+
+func SocketPath() string {
+	return filepath.Join(control.SocketDir(), "daemon.sock")
+}
+
+type Daemon struct {
+	statePath string
+	logger    *log.Logger
+	debug     bool
+	dumpCb    func(target string, localPortMap, peerPortMap map[uint16]uint16)
+	mu        sync.Mutex
+	sessions  map[string]*supervisor // target => supervisor
+}
+
+// NewDaemon creates a daemon that persists the attachments to statePath, an empty statePath disables
+// the persistence.
+func NewDaemon(statePath string, debug bool, logger *log.Logger) *Daemon {
+	return &Daemon{
+		statePath: statePath,
+		logger:    logger,
+		debug:     debug,
+		sessions:  make(map[string]*supervisor),
+	}
+}
+
+// SetDumpCallback sets the callback that is invoked when the forwarded ports of a session change.
+// It must be called before attaching.
+func (d *Daemon) SetDumpCallback(dumpCallback func(target string, localPortMap, peerPortMap map[uint16]uint16)) {
+	d.dumpCb = dumpCallback
+}
+
+// Restore attaches to the targets persisted in the state file.
+func (d *Daemon) Restore() error {
+	if d.statePath == "" {
+		return nil
+	}
+	b, err := os.ReadFile(d.statePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	atts := make([]Attachment, 0)
+	if err := json.Unmarshal(b, &atts); err != nil {
+		return err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, att := range atts {
+		if err := d.attach(att); err != nil {
+			d.logger.Printf("Failed to restore %s: %s", att.Target, err)
+		}
+	}
+	return nil
+}
+
+func (d *Daemon) save() {
+	if d.statePath == "" {
+		return
+	}
+	atts := make([]Attachment, 0, len(d.sessions))
+	for _, sv := range d.sessions {
+		atts = append(atts, sv.attachment())
+	}
+	sort.Slice(atts, func(i, j int) bool { return atts[i].Target < atts[j].Target })
+	b, _ := json.MarshalIndent(atts, "", "  ")
+	if err := os.MkdirAll(filepath.Dir(d.statePath), 0700); err != nil {
+		d.logger.Printf("Failed to save state: %s", err)
+		return
+	}
+	// Write to a temp file first so that a crash won't leave a truncated state file
+	tmp := d.statePath + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		d.logger.Printf("Failed to save state: %s", err)
+		return
+	}
+	os.Rename(tmp, d.statePath)
+}
+
+func (d *Daemon) Attach(att Attachment) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := d.attach(att); err != nil {
+		return err
+	}
+	d.save()
+	return nil
+}
+
+func (d *Daemon) attach(att Attachment) error {
+	rt, err := bootstrap.ParseRTType(att.Runtime)
+	if err != nil {
+		return err
+	}
+	if _, ok := d.sessions[att.Target]; ok {
+		return errors.New("already attached: " + att.Target)
+	}
+	reverseScan, err := portscan.ParsePortRanges(att.ReverseScan)
+	if err != nil {
+		return err
+	}
+	var sources *proxy.Sources
+	if len(att.AllowFrom) > 0 {
+		if sources, err = proxy.ParseSources(att.AllowFrom); err != nil {
+			return err
+		}
+	}
+	sv := &supervisor{
+		att: att,
+		opts: session.Options{
+			Runtime:      rt,
+			Target:       att.Target,
+			ReversePorts: att.Reverse,
+			ReverseScan:  reverseScan,
+			Destinations: att.Destinations,
+			UnixSockets:  att.UnixSockets,
+			Include:      att.Include,
+			Exclude:      att.Exclude,
+			Pins:         att.Pins,
+			PinFallback:  att.PinFallback,
+			Processes:    att.Processes,
+			ExcludeProcs: att.ExcludeProcesses,
+			Bind:         att.Bind,
+			Debug:        d.debug,
+			ScanMin:      att.ScanMin,
+			ScanMax:      att.ScanMax,
+			Probe:        att.Probe,
+			Debounce:     att.Debounce,
+			Socks:        att.Socks,
+			HTTPProxy:    att.HTTPProxy,
+			Allow:        att.Allow,
+			Encrypt:      att.Encrypt,
+			Sources:      sources,
+		},
+		logger: d.logger,
+		dumpCb: d.dumpCb,
+		saveCb: func() {
+			d.mu.Lock()
+			defer d.mu.Unlock()
+			d.save()
+		},
+		state:    Connecting,
+		detached: make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	d.sessions[att.Target] = sv
+	go sv.run()
+	return nil
+}
+
+func (d *Daemon) Detach(target string) error {
+	d.mu.Lock()
+	sv, ok := d.sessions[target]
+	if !ok {
+		d.mu.Unlock()
+		return errors.New("not attached: " + target)
+	}
+	delete(d.sessions, target)
+	d.save()
+	d.mu.Unlock()
+
+	sv.detach()
+	<-sv.done
+	return nil
+}
+
+func (d *Daemon) List() []SessionInfo {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	lst := make([]SessionInfo, 0, len(d.sessions))
+	for _, sv := range d.sessions {
+		lst = append(lst, sv.info())
+	}
+	sort.Slice(lst, func(i, j int) bool { return lst[i].Target < lst[j].Target })
+	return lst
+}
+
+// Sessions returns the established sessions, ordered by the targets.
+func (d *Daemon) Sessions() []*session.Session {
+	d.mu.Lock()
+	svs := make([]*supervisor, 0, len(d.sessions))
+	for _, sv := range d.sessions {
+		svs = append(svs, sv)
+	}
+	d.mu.Unlock()
+	sort.Slice(svs, func(i, j int) bool { return svs[i].att.Target < svs[j].att.Target })
+	sessions := make([]*session.Session, 0, len(svs))
+	for _, sv := range svs {
+		sv.mu.Lock()
+		if sv.session != nil {
+			sessions = append(sessions, sv.session)
+		}
+		sv.mu.Unlock()
+	}
+	return sessions
+}
+
+// Shutdown stops all the sessions, the attachments are kept in the state file.
+func (d *Daemon) Shutdown() {
+	d.mu.Lock()
+	svs := make([]*supervisor, 0, len(d.sessions))
+	for _, sv := range d.sessions {
+		svs = append(svs, sv)
+	}
+	d.mu.Unlock()
+	for _, sv := range svs {
+		sv.detach()
+		<-sv.done
+	}
+}
+
+// supervisor keeps the session of the attachment alive until detached.
+type supervisor struct {
+	att      Attachment
+	opts     session.Options
+	logger   *log.Logger
+	dumpCb   func(target string, localPortMap, peerPortMap map[uint16]uint16)
+	saveCb   func()
+	mu       sync.Mutex
+	state    string
+	err      error
+	session  *session.Session
+	detached chan struct{}
+	once     sync.Once
+	done     chan struct{}
+}
+
+func (sv *supervisor) setState(state string, s *session.Session, err error) {
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
+	sv.state = state
+	sv.session = s
+	sv.err = err
+}
+
+// attached records the established session, it returns false if the supervisor has been detached.
+func (sv *supervisor) attached(s *session.Session) bool {
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
+	if sv.isDetached() {
+		return false
+	}
+	sv.state = Attached
+	sv.session = s
+	sv.err = nil
+	return true
+}
+
+func (sv *supervisor) isDetached() bool {
+	select {
+	case <-sv.detached:
+		return true
+	default:
+		return false
+	}
+}
+
+func (sv *supervisor) run() {
+	defer close(sv.done)
+	backoff := 1 * time.Second
+	for {
+		sv.setState(Connecting, nil, nil)
+		s, err := session.New(sv.opts, sv.logger)
+		if err != nil {
+			sv.logger.Printf("Failed to attach %s: %s", sv.att.Target, err)
+			sv.setState(Retrying, nil, err)
+		} else {
+			if sv.dumpCb != nil {
+				target := sv.att.Target
+				s.SetDumpCallback(func(localPortMap, peerPortMap map[uint16]uint16) {
+					sv.dumpCb(target, localPortMap, peerPortMap)
+				})
+			}
+			// The changes made by `apf ctl` are saved right away, not to be lost if the daemon is killed
+			s.SetChangeCallback(func() { sv.keep(s) })
+			if !sv.attached(s) {
+				// Detached while connecting, release the listeners of the session
+				s.Shutdown()
+				s.Wait()
+				return
+			}
+			backoff = 1 * time.Second
+			sv.logger.Printf("Attached %s", sv.att.Target)
+			s.Run()
+			s.Wait()
+			sv.logger.Printf("Session of %s is over", sv.att.Target)
+			sv.keep(s)
+			sv.setState(Retrying, nil, errors.New("connection lost"))
+		}
+
+		select {
+		case <-sv.detached:
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// keep records the changes made to the session at runtime (eg. by `apf ctl`) into the attachment and
+// saves it, so that they survive the reconnection and the restart of the daemon.
+func (sv *supervisor) keep(s *session.Session) {
+	st := s.Status()
+	sv.mu.Lock()
+	sv.att.Reverse = st.Reverse
+	sv.att.Destinations = st.Dests
+	sv.att.UnixSockets = st.Sockets
+	sv.att.Pins = st.Pinned
+	sv.att.Exclude = st.Excluded
+	sv.opts.ReversePorts = st.Reverse
+	sv.opts.Destinations = st.Dests
+	sv.opts.UnixSockets = st.Sockets
+	sv.opts.Pins = st.Pinned
+	sv.opts.Exclude = st.Excluded
+	sv.mu.Unlock()
+	if sv.saveCb != nil {
+		sv.saveCb()
+	}
+}
+
+func (sv *supervisor) attachment() Attachment {
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
+	return sv.att
+}
+
+func (sv *supervisor) detach() {
+	sv.mu.Lock()
+	sv.once.Do(func() {
+		close(sv.detached)
+	})
+	s := sv.session
+	sv.mu.Unlock()
+	if s != nil {
+		s.Shutdown()
+	}
+}
+
+func (sv *supervisor) info() SessionInfo {
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
+	info := SessionInfo{
+		Attachment: sv.att,
+		State:      sv.state,
+	}
+	if sv.err != nil {
+		info.Error = sv.err.Error()
+	}
+	if sv.session != nil {
+		info.Ports = sv.session.Status().Ports
+	}
+	return info
+}
@@ -0,0 +1,45 @@
+package daemon
+
+import (
+	"io"
+	"log"
+	"path/filepath"
+	"testing"
+)
+
+func TestDaemon_state(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+	statePath := filepath.Join(t.TempDir(), "daemon.json")
+	d := NewDaemon(statePath, false, logger)
+	defer d.Shutdown()
+
+	if err := d.Attach(Attachment{Target: "redis", Runtime: "containerd"}); err == nil {
+		t.Fatal("expected error for unknown runtime")
+	}
+	if err := d.Attach(Attachment{Target: "redis", Runtime: "docker", Reverse: []uint16{8080}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Attach(Attachment{Target: "redis", Runtime: "docker"}); err == nil {
+		t.Fatal("expected error for duplicated target")
+	}
+	if err := d.Attach(Attachment{Target: "default/web", Runtime: "kubernetes"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Detach("redis"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Detach("redis"); err == nil {
+		t.Fatal("expected error for detached target")
+	}
+
+	// The remaining attachment is restored by a new daemon
+	d2 := NewDaemon(statePath, false, logger)
+	defer d2.Shutdown()
+	if err := d2.Restore(); err != nil {
+		t.Fatal(err)
+	}
+	lst := d2.List()
+	if len(lst) != 1 || lst[0].Target != "default/web" || lst[0].Runtime != "kubernetes" {
+		t.Fatalf("unexpected sessions: %+v", lst)
+	}
+}
@@ -0,0 +1,81 @@
+package daemon
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"os"
+
+	"github.com/ruoshan/autoportforward/control"
+)
+
+// Server serves the daemon API over a unix socket:
+//   - GET  /sessions       : list the sessions
+//   - POST /attach         : attach to the target, the body is the Attachment in JSON
+//   - POST /detach?target= : detach from the target
+type Server struct {
+	path     string
+	daemon   *Daemon
+	logger   *log.Logger
+	listener net.Listener
+	http     *http.Server
+}
+
+func NewServer(path string, daemon *Daemon, logger *log.Logger) *Server {
+	s := &Server{
+		path:   path,
+		daemon: daemon,
+		logger: logger,
+	}
+	s.http = &http.Server{Handler: s}
+	return s
+}
+
+func (s *Server) Listen() error {
+	l, err := control.ListenUnix(s.path)
+	if err != nil {
+		return err
+	}
+	s.listener = l
+	return nil
+}
+
+func (s *Server) Serve() {
+	s.logger.Printf("Serving daemon API on %s", s.path)
+	s.http.Serve(s.listener)
+}
+
+func (s *Server) Close() {
+	s.http.Close()
+	os.Remove(s.path)
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.logger.Printf("Daemon request: %s %s", r.Method, r.URL)
+	q := r.URL.Query()
+	target := q.Get("target")
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/sessions":
+		control.WriteJSON(w, http.StatusOK, s.daemon.List())
+	case r.Method == http.MethodPost && r.URL.Path == "/attach":
+		att := Attachment{}
+		if err := json.NewDecoder(r.Body).Decode(&att); err != nil || att.Target == "" {
+			control.WriteJSON(w, http.StatusBadRequest, control.ErrorResp{Error: "invalid attachment"})
+			return
+		}
+		if err := s.daemon.Attach(att); err != nil {
+			control.WriteJSON(w, http.StatusUnprocessableEntity, control.ErrorResp{Error: err.Error()})
+			return
+		}
+		control.WriteJSON(w, http.StatusOK, s.daemon.List())
+	case r.Method == http.MethodPost && r.URL.Path == "/detach" && target != "":
+		if err := s.daemon.Detach(target); err != nil {
+			control.WriteJSON(w, http.StatusUnprocessableEntity, control.ErrorResp{Error: err.Error()})
+			return
+		}
+		control.WriteJSON(w, http.StatusOK, s.daemon.List())
+	default:
+		control.WriteJSON(w, http.StatusNotFound, control.ErrorResp{Error: "unknown request: " + r.Method + " " + r.URL.Path})
+	}
+}
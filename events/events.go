@@ -0,0 +1,188 @@
+// Package events emits the forwarding state as newline-delimited JSON events, so that wrappers
+// and editors can consume it without scraping the human readable output.
+package events
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/ruoshan/autoportforward/proxy"
+	"github.com/ruoshan/autoportforward/sniff"
+)
+
+const (
+	SessionStarted  = "session_started"
+	SessionStopped  = "session_stopped"
+	PortAdded       = "port_added"
+	PortRemoved     = "port_removed"
+	ConnOpened      = "conn_opened"
+	ConnClosed      = "conn_closed"
+	ServiceDetected = "service_detected"
+	Error           = "error"
+)
+
+// Direction of the forwarding
+const (
+	Forward = "forward" // local listener ==> remote port
+	Reverse = "reverse" // local port <== remote listener
+)
+
+type Event struct {
+	Event      string    `json:"event"`
+	Time       time.Time `json:"time"`
+	Target     string    `json:"target,omitempty"`
+	Direction  string    `json:"direction,omitempty"`
+	LocalPort  uint16    `json:"local_port,omitempty"`
+	RemotePort uint16    `json:"remote_port,omitempty"`
+	Addr       string    `json:"addr,omitempty"`
+	BytesIn    uint64    `json:"bytes_in,omitempty"`
+	BytesOut   uint64    `json:"bytes_out,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	Service    string    `json:"service,omitempty"`        // eg. http, tls, postgresql
+	Detail     string    `json:"service_detail,omitempty"` // eg. the SNI of TLS
+}
+
+type mapping struct {
+	local, remote uint16
+}
+
+type Emitter struct {
+	mu     sync.Mutex
+	sinks  []func(ev Event)
+	target string
+	ports  map[string]map[uint16]mapping // direction => target port => mapping
+}
+
+// NewEmitter creates an emitter that writes the events as JSON lines to w
+func NewEmitter(w io.Writer, target string) *Emitter {
+	return NewEmitterFunc(target, JSONSink(w))
+}
+
+// NewEmitterFunc creates an emitter that passes the events to the sinks
+func NewEmitterFunc(target string, sinks ...func(ev Event)) *Emitter {
+	return &Emitter{
+		sinks:  sinks,
+		target: target,
+		ports: map[string]map[uint16]mapping{
+			Forward: {},
+			Reverse: {},
+		},
+	}
+}
+
+// Emit writes the event as one JSON line, the time and target are filled in if missing.
+func (e *Emitter) Emit(ev Event) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.emit(ev)
+}
+
+func (e *Emitter) emit(ev Event) {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	if ev.Target == "" {
+		ev.Target = e.target
+	}
+	for _, sink := range e.sinks {
+		sink(ev)
+	}
+}
+
+// JSONSink writes the events as JSON lines to w
+func JSONSink(w io.Writer) func(ev Event) {
+	enc := json.NewEncoder(w)
+	return func(ev Event) {
+		enc.Encode(ev)
+	}
+}
+
+func (e *Emitter) SessionStarted() {
+	e.Emit(Event{Event: SessionStarted})
+}
+
+func (e *Emitter) SessionStopped() {
+	e.Emit(Event{Event: SessionStopped})
+}
+
+func (e *Emitter) Error(err error) {
+	e.Emit(Event{Event: Error, Error: err.Error()})
+}
+
+// DumpPorts is meant to be used as the manager's dump callback, it diffs the port maps against the
+// previous dump and emits port_added / port_removed events accordingly.
+func (e *Emitter) DumpPorts(localPortMap, peerPortMap map[uint16]uint16) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	current := map[string]map[uint16]mapping{
+		Forward: {},
+		Reverse: {},
+	}
+	for targetPort, listenPort := range localPortMap {
+		current[Forward][targetPort] = mapping{local: listenPort, remote: targetPort}
+	}
+	for targetPort, listenPort := range peerPortMap {
+		current[Reverse][targetPort] = mapping{local: targetPort, remote: listenPort}
+	}
+
+	for _, dir := range []string{Forward, Reverse} {
+		for p, old := range e.ports[dir] {
+			if m, ok := current[dir][p]; !ok || m != old {
+				e.emit(Event{Event: PortRemoved, Direction: dir, LocalPort: old.local, RemotePort: old.remote})
+			}
+		}
+		for p, m := range current[dir] {
+			if old, ok := e.ports[dir][p]; !ok || m != old {
+				e.emit(Event{Event: PortAdded, Direction: dir, LocalPort: m.local, RemotePort: m.remote})
+			}
+		}
+	}
+	e.ports = current
+}
+
+// Service is meant to be used as the callback of the proxy.Services, it emits a service_detected event.
+func (e *Emitter) Service(d proxy.Direction, port uint16, svc sniff.Service) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	dir := Forward
+	if d == proxy.Reverse {
+		dir = Reverse
+	}
+	m, ok := e.ports[dir][port]
+	if !ok {
+		m = mapping{local: port, remote: port}
+	}
+	e.emit(Event{Event: ServiceDetected, Direction: dir, LocalPort: m.local, RemotePort: m.remote, Service: svc.Name, Detail: svc.Detail})
+}
+
+// Conn is meant to be used as the connection callback of the proxies.
+func (e *Emitter) Conn(ev proxy.ConnEvent) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	dir := Forward
+	if ev.Dir == proxy.Reverse {
+		dir = Reverse
+	}
+	m, ok := e.ports[dir][ev.Port]
+	if !ok {
+		m = mapping{local: ev.Port, remote: ev.Port}
+	}
+	out := Event{Direction: dir, LocalPort: m.local, RemotePort: m.remote, Addr: ev.Addr}
+	switch {
+	case ev.Err != nil:
+		out.Event = Error
+		out.Error = ev.Err.Error()
+	case ev.Opened:
+		out.Event = ConnOpened
+	default:
+		out.Event = ConnClosed
+		out.BytesIn = ev.BytesIn
+		out.BytesOut = ev.BytesOut
+	}
+	e.emit(out)
+}
@@ -0,0 +1,101 @@
+package events
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/ruoshan/autoportforward/proxy"
+	"github.com/ruoshan/autoportforward/sniff"
+)
+
+func decode(t *testing.T, buf *bytes.Buffer) []Event {
+	evs := make([]Event, 0)
+	dec := json.NewDecoder(buf)
+	for dec.More() {
+		ev := Event{}
+		if err := dec.Decode(&ev); err != nil {
+			t.Fatal(err)
+		}
+		evs = append(evs, ev)
+	}
+	return evs
+}
+
+func names(evs []Event) []string {
+	lst := make([]string, 0, len(evs))
+	for _, ev := range evs {
+		lst = append(lst, ev.Event)
+	}
+	return lst
+}
+
+func TestEmitter_DumpPorts(t *testing.T) {
+	buf := &bytes.Buffer{}
+	e := NewEmitter(buf, "redis")
+
+	e.DumpPorts(map[uint16]uint16{6379: 6379}, map[uint16]uint16{8080: 8080})
+	evs := decode(t, buf)
+	if !reflect.DeepEqual(names(evs), []string{PortAdded, PortAdded}) {
+		t.Fatalf("unexpected events: %v", evs)
+	}
+	if evs[0].Target != "redis" || evs[0].Direction != Forward || evs[0].LocalPort != 6379 {
+		t.Fatalf("unexpected event: %+v", evs[0])
+	}
+
+	// Dumping the same maps again emits nothing
+	e.DumpPorts(map[uint16]uint16{6379: 6379}, map[uint16]uint16{8080: 8080})
+	if evs := decode(t, buf); len(evs) != 0 {
+		t.Fatalf("unexpected events: %v", evs)
+	}
+
+	e.DumpPorts(map[uint16]uint16{}, map[uint16]uint16{8080: 8080})
+	evs = decode(t, buf)
+	if !reflect.DeepEqual(names(evs), []string{PortRemoved}) || evs[0].RemotePort != 6379 {
+		t.Fatalf("unexpected events: %v", evs)
+	}
+}
+
+func TestEmitter_Conn(t *testing.T) {
+	buf := &bytes.Buffer{}
+	e := NewEmitter(buf, "redis")
+	e.DumpPorts(map[uint16]uint16{80: 5080}, nil)
+	decode(t, buf)
+
+	e.Conn(proxy.ConnEvent{Dir: proxy.Forward, Port: 80, Opened: true})
+	e.Conn(proxy.ConnEvent{Dir: proxy.Forward, Port: 80, BytesIn: 10, BytesOut: 20})
+	e.Conn(proxy.ConnEvent{Dir: proxy.Reverse, Port: 9090, Err: errors.New("connection refused")})
+	evs := decode(t, buf)
+	if !reflect.DeepEqual(names(evs), []string{ConnOpened, ConnClosed, Error}) {
+		t.Fatalf("unexpected events: %v", evs)
+	}
+	if evs[0].LocalPort != 5080 || evs[0].RemotePort != 80 {
+		t.Fatalf("unexpected event: %+v", evs[0])
+	}
+	if evs[1].BytesIn != 10 || evs[1].BytesOut != 20 {
+		t.Fatalf("unexpected event: %+v", evs[1])
+	}
+	if evs[2].Error != "connection refused" || evs[2].Direction != Reverse {
+		t.Fatalf("unexpected event: %+v", evs[2])
+	}
+}
+
+func TestEmitter_Service(t *testing.T) {
+	buf := &bytes.Buffer{}
+	e := NewEmitter(buf, "web")
+	e.DumpPorts(map[uint16]uint16{443: 5443}, map[uint16]uint16{})
+	decode(t, buf)
+
+	e.Service(proxy.Forward, 443, sniff.Service{Name: sniff.TLS, Detail: "example.com"})
+	evs := decode(t, buf)
+	want := Event{Event: ServiceDetected, Target: "web", Direction: Forward, LocalPort: 5443, RemotePort: 443, Service: "tls", Detail: "example.com"}
+	if len(evs) != 1 {
+		t.Fatalf("unexpected events: %v", evs)
+	}
+	evs[0].Time = want.Time
+	if evs[0] != want {
+		t.Fatalf("unexpected event: %+v", evs[0])
+	}
+}
@@ -0,0 +1,403 @@
+// Package front is the front proxy: a single local port that routes the HTTP requests by the Host header,
+// and the TLS connections by the SNI, to the forwarded ports of the targets. The connections are passed
+// to the targets as they are (TLS is not terminated), so the services don't need to know about the proxy.
+//
+// The hostnames:
+//   - {target}-{port}.localhost: the port of the target
+//   - {name}.{target}.apf.localhost: the port of the target by the port number, the process name or the service name
+//   - {target}.apf.localhost: the only port, or the HTTP port, of the target
+//
+// The target names are lowercased with the characters other than [a-z0-9-] replaced by "-", eg.
+// default/web-0 => default-web-0.
+//
+// With a token (SetToken), the HTTP connections are only routed if the first request carries the token in
+// the X-Apf-Token header, the apf_token cookie or the apf_token query parameter (which is redirected to
+// set the cookie). The TLS connections are rejected then, their requests can't be read. The token is
+// removed from the request before it's passed to the target.
+package front
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ruoshan/autoportforward/sniff"
+)
+
+// The time to read the request header or the ClientHello
+const routeTimeout = 10 * time.Second
+
+type Port struct {
+	Port    uint16 // the port in the target
+	Process string // the name of the owning process, optional
+	Service string // the service name, eg. http, optional
+}
+
+// Target is the forwarding session of a container
+type Target interface {
+	Target() string
+	Ports() []Port
+	ServeConn(conn net.Conn, port uint16)
+}
+
+const (
+	TokenHeader = "X-Apf-Token"
+	TokenParam  = "apf_token" // the cookie and the query parameter
+)
+
+type Proxy struct {
+	addr     string
+	targets  func() []Target
+	token    string
+	logger   *log.Logger
+	listener net.Listener
+}
+
+// NewProxy creates the front proxy listening on addr, eg. 127.0.0.1:8000, the targets are looked up on
+// every connection.
+func NewProxy(addr string, targets func() []Target, logger *log.Logger) *Proxy {
+	return &Proxy{
+		addr:    addr,
+		targets: targets,
+		logger:  logger,
+	}
+}
+
+// SetToken requires the HTTP requests to carry the token, no token is required if empty.
+func (p *Proxy) SetToken(token string) {
+	p.token = token
+}
+
+func (p *Proxy) Listen() error {
+	l, err := net.Listen("tcp", p.addr)
+	if err != nil {
+		return err
+	}
+	p.listener = l
+	return nil
+}
+
+// Addr returns the listening address, it's only valid after Listen.
+func (p *Proxy) Addr() net.Addr {
+	return p.listener.Addr()
+}
+
+func (p *Proxy) Serve() {
+	p.logger.Printf("Serving front proxy on %s", p.listener.Addr())
+	for {
+		conn, err := p.listener.Accept()
+		if err != nil {
+			return
+		}
+		go p.handle(conn)
+	}
+}
+
+func (p *Proxy) Close() error {
+	return p.listener.Close()
+}
+
+func (p *Proxy) handle(conn net.Conn) {
+	// Read the host through a tee, so that the bytes can be replayed to the target
+	buf := &bytes.Buffer{}
+	r := bufio.NewReader(io.TeeReader(conn, buf))
+	conn.SetReadDeadline(time.Now().Add(routeTimeout))
+	host, req, err := readHost(r)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		p.logger.Printf("Front proxy: failed to read the host: %s", err)
+		conn.Close()
+		return
+	}
+	if p.token != "" && !p.authorize(conn, req) {
+		conn.Close()
+		return
+	}
+
+	targets := p.targets()
+	t, port, ok := Resolve(targets, host)
+	if !ok {
+		p.logger.Printf("Front proxy: no route for host: %s", host)
+		if req != nil {
+			notFound(conn, host, targets)
+		}
+		conn.Close()
+		return
+	}
+	p.logger.Printf("Front proxy: %s => %s:%d", host, t.Target(), port)
+	var replay io.Reader = buf
+	if p.token != "" {
+		replay = bytes.NewReader(stripToken(buf.Bytes(), req.Header.Get("Upgrade") != ""))
+	}
+	t.ServeConn(&replayConn{Conn: conn, r: io.MultiReader(replay, conn)}, port)
+}
+
+// stripToken removes the token header and cookie from the request header in b, the bytes after the
+// header are kept. The connection is closed after the response (unless upgraded), so that the following
+// requests of the client come through a new connection and get their token removed as well.
+func stripToken(b []byte, upgrade bool) []byte {
+	end := bytes.Index(b, []byte("\r\n\r\n"))
+	n := 4
+	if i := bytes.Index(b, []byte("\n\n")); i >= 0 && (end < 0 || i < end) {
+		end, n = i, 2
+	}
+	if end < 0 {
+		return b
+	}
+	lines := strings.Split(string(b[:end]), "\n")
+	out := &bytes.Buffer{}
+	for i, line := range lines {
+		line = strings.TrimSuffix(line, "\r")
+		name, value := line, ""
+		if j := strings.Index(line, ":"); j >= 0 {
+			name, value = line[:j], line[j+1:]
+		}
+		switch {
+		case i == 0:
+		case strings.EqualFold(name, TokenHeader):
+			continue
+		case strings.EqualFold(name, "Cookie"):
+			cookies := make([]string, 0)
+			for _, c := range strings.Split(value, ";") {
+				if c = strings.TrimSpace(c); c != "" && !strings.HasPrefix(c, TokenParam+"=") {
+					cookies = append(cookies, c)
+				}
+			}
+			if len(cookies) == 0 {
+				continue
+			}
+			line = name + ": " + strings.Join(cookies, "; ")
+		case strings.EqualFold(name, "Connection") && !upgrade:
+			continue
+		}
+		out.WriteString(line + "\r\n")
+	}
+	if !upgrade {
+		out.WriteString("Connection: close\r\n")
+	}
+	out.WriteString("\r\n")
+	out.Write(b[end+n:])
+	return out.Bytes()
+}
+
+// authorize checks the token of the request, the rejected requests are responded. The query parameter
+// is redirected to the URL without it, setting the cookie.
+func (p *Proxy) authorize(conn net.Conn, req *http.Request) bool {
+	addr := conn.RemoteAddr().String()
+	if req == nil {
+		p.logger.Printf("Front proxy: rejected TLS connection from %s, the token can't be checked", addr)
+		return false
+	}
+	if validToken(req.Header.Get(TokenHeader), p.token) {
+		return true
+	}
+	if c, err := req.Cookie(TokenParam); err == nil && validToken(c.Value, p.token) {
+		return true
+	}
+	q := req.URL.Query()
+	if validToken(q.Get(TokenParam), p.token) {
+		q.Del(TokenParam)
+		u := *req.URL
+		u.RawQuery = q.Encode()
+		// Not redirected to another host, eg. //example.com
+		location := "/" + strings.TrimLeft(u.RequestURI(), "/")
+		cookie := &http.Cookie{Name: TokenParam, Value: p.token, Path: "/", HttpOnly: true, SameSite: http.SameSiteStrictMode}
+		fmt.Fprintf(conn, "HTTP/1.1 302 Found\r\nLocation: %s\r\nSet-Cookie: %s\r\nContent-Length: 0\r\nConnection: close\r\n\r\n", location, cookie)
+		return false
+	}
+	p.logger.Printf("Front proxy: rejected request from %s to %s without the token", addr, req.Host)
+	body := fmt.Sprintf("The token is required: the %s header, or ?%s={token}\n", TokenHeader, TokenParam)
+	fmt.Fprintf(conn, "HTTP/1.1 401 Unauthorized\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s", len(body), body)
+	return false
+}
+
+func validToken(got, token string) bool {
+	return got != "" && subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1
+}
+
+// readHost reads the SNI of the TLS ClientHello, or the Host of the HTTP request (req is nil for TLS).
+func readHost(r *bufio.Reader) (host string, req *http.Request, err error) {
+	b, err := r.Peek(5)
+	if err != nil {
+		return "", nil, err
+	}
+	if b[0] == 0x16 {
+		// TLS record: type (1), version (2), length (2)
+		n := 5 + (int(b[3])<<8 | int(b[4]))
+		if n > r.Size() {
+			r = bufio.NewReaderSize(r, n)
+		}
+		record, err := r.Peek(n)
+		if err != nil {
+			return "", nil, err
+		}
+		return sniff.TLSServerName(record), nil, nil
+	}
+	req, err = http.ReadRequest(r)
+	if err != nil {
+		return "", nil, err
+	}
+	return req.Host, req, nil
+}
+
+func notFound(conn net.Conn, host string, targets []Target) {
+	body := &strings.Builder{}
+	fmt.Fprintf(body, "No route for host: %s\n\nRoutes:\n", host)
+	for _, route := range Routes(targets) {
+		fmt.Fprintf(body, "  %s\n", route)
+	}
+	fmt.Fprintf(conn, "HTTP/1.1 404 Not Found\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s", body.Len(), body)
+}
+
+// replayConn replays the bytes read for routing before the rest of the connection
+type replayConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *replayConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// Name returns the name of the target used in the hostnames
+func Name(target string) string {
+	b := []byte(strings.ToLower(target))
+	for i, c := range b {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-') {
+			b[i] = '-'
+		}
+	}
+	return string(b)
+}
+
+// Resolve finds the target and its port of the host, the port of the host (if any) is ignored.
+func Resolve(targets []Target, host string) (Target, uint16, bool) {
+	host = strings.ToLower(host)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(host, ".")
+
+	if rest := strings.TrimSuffix(host, ".apf.localhost"); rest != host {
+		labels := strings.Split(rest, ".")
+		switch len(labels) {
+		case 1:
+			if t := find(targets, labels[0]); t != nil {
+				if port, ok := defaultPort(t.Ports()); ok {
+					return t, port, true
+				}
+			}
+		case 2:
+			if t := find(targets, labels[1]); t != nil {
+				if port, ok := namedPort(t.Ports(), labels[0]); ok {
+					return t, port, true
+				}
+			}
+		}
+		return nil, 0, false
+	}
+
+	if rest := strings.TrimSuffix(host, ".localhost"); rest != host && !strings.Contains(rest, ".") {
+		i := strings.LastIndex(rest, "-")
+		if i <= 0 {
+			return nil, 0, false
+		}
+		port, err := strconv.ParseUint(rest[i+1:], 10, 16)
+		if err != nil {
+			return nil, 0, false
+		}
+		if t := find(targets, rest[:i]); t != nil && hasPort(t.Ports(), uint16(port)) {
+			return t, uint16(port), true
+		}
+	}
+	return nil, 0, false
+}
+
+func find(targets []Target, name string) Target {
+	for _, t := range targets {
+		if Name(t.Target()) == name {
+			return t
+		}
+	}
+	return nil
+}
+
+func hasPort(ports []Port, port uint16) bool {
+	for _, p := range ports {
+		if p.Port == port {
+			return true
+		}
+	}
+	return false
+}
+
+// defaultPort returns the only port, or the lowest HTTP port.
+func defaultPort(ports []Port) (uint16, bool) {
+	if len(ports) == 1 {
+		return ports[0].Port, true
+	}
+	sortPorts(ports)
+	for _, p := range ports {
+		if p.Service == sniff.HTTP {
+			return p.Port, true
+		}
+	}
+	return 0, false
+}
+
+// namedPort returns the port of the number, or the lowest port of the process or the service.
+func namedPort(ports []Port, name string) (uint16, bool) {
+	if port, err := strconv.ParseUint(name, 10, 16); err == nil {
+		return uint16(port), hasPort(ports, uint16(port))
+	}
+	sortPorts(ports)
+	for _, p := range ports {
+		if p.Process != "" && Name(p.Process) == name {
+			return p.Port, true
+		}
+	}
+	for _, p := range ports {
+		if p.Service != "" && Name(p.Service) == name {
+			return p.Port, true
+		}
+	}
+	return 0, false
+}
+
+func sortPorts(ports []Port) {
+	sort.Slice(ports, func(i, j int) bool { return ports[i].Port < ports[j].Port })
+}
+
+// Routes returns the hostnames of the ports of the targets, eg. "redis-stack-6379.localhost (redis-server)".
+func Routes(targets []Target) []string {
+	routes := make([]string, 0)
+	for _, t := range targets {
+		name := Name(t.Target())
+		ports := t.Ports()
+		sortPorts(ports)
+		for _, p := range ports {
+			labels := make([]string, 0, 2)
+			if p.Process != "" {
+				labels = append(labels, p.Process)
+			}
+			if p.Service != "" {
+				labels = append(labels, p.Service)
+			}
+			route := fmt.Sprintf("%s-%d.localhost", name, p.Port)
+			if len(labels) > 0 {
+				route += fmt.Sprintf(" (%s)", strings.Join(labels, ", "))
+			}
+			routes = append(routes, route)
+		}
+	}
+	return routes
+}
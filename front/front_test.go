@@ -0,0 +1,222 @@
+package front
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+type fakeTarget struct {
+	name  string
+	ports []Port
+	conns chan []byte
+}
+
+func (f *fakeTarget) Target() string {
+	return f.name
+}
+
+func (f *fakeTarget) Ports() []Port {
+	return append([]Port{}, f.ports...)
+}
+
+func (f *fakeTarget) ServeConn(conn net.Conn, port uint16) {
+	defer conn.Close()
+	conn.Write([]byte{byte(port >> 8), byte(port)})
+	b, _ := io.ReadAll(conn)
+	f.conns <- b
+}
+
+func TestResolve(t *testing.T) {
+	redis := &fakeTarget{name: "redis-stack", ports: []Port{
+		{Port: 8001, Process: "redis-stack-server", Service: "http"},
+		{Port: 6379, Process: "redis-server", Service: "redis"},
+	}}
+	web := &fakeTarget{name: "default/Web_0", ports: []Port{{Port: 3000, Process: "node"}}}
+	targets := []Target{redis, web}
+
+	cases := []struct {
+		host   string
+		target Target
+		port   uint16
+	}{
+		{"redis-stack-6379.localhost", redis, 6379},
+		{"redis-stack-8001.localhost:8000", redis, 8001},
+		{"REDIS-STACK-6379.LOCALHOST.", redis, 6379},
+		{"redis-stack-1234.localhost", nil, 0},
+		{"redis-stack.localhost", nil, 0},
+		{"default-web-0-3000.localhost", web, 3000},
+		{"redis-stack.apf.localhost", redis, 8001},
+		{"default-web-0.apf.localhost", web, 3000},
+		{"6379.redis-stack.apf.localhost", redis, 6379},
+		{"redis-server.redis-stack.apf.localhost", redis, 6379},
+		{"redis.redis-stack.apf.localhost", redis, 6379},
+		{"http.redis-stack.apf.localhost", redis, 8001},
+		{"node.default-web-0.apf.localhost", web, 3000},
+		{"python.default-web-0.apf.localhost", nil, 0},
+		{"unknown.apf.localhost", nil, 0},
+		{"a.b.redis-stack.apf.localhost", nil, 0},
+		{"example.com", nil, 0},
+	}
+	for _, c := range cases {
+		target, port, ok := Resolve(targets, c.host)
+		if ok != (c.target != nil) || target != c.target || port != c.port {
+			t.Errorf("Resolve(%q) = %v, %d, %v", c.host, target, port, ok)
+		}
+	}
+}
+
+func TestRoutes(t *testing.T) {
+	targets := []Target{&fakeTarget{name: "web", ports: []Port{{Port: 8080, Service: "http"}, {Port: 22}}}}
+	routes := Routes(targets)
+	expected := []string{"web-22.localhost", "web-8080.localhost (http)"}
+	if strings.Join(routes, ",") != strings.Join(expected, ",") {
+		t.Errorf("Routes() = %v, expected %v", routes, expected)
+	}
+}
+
+func TestProxy(t *testing.T) {
+	web := &fakeTarget{name: "web", ports: []Port{{Port: 8080}}, conns: make(chan []byte, 1)}
+	p := NewProxy("127.0.0.1:0", func() []Target { return []Target{web} }, log.New(io.Discard, "", 0))
+	if err := p.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	go p.Serve()
+
+	// The request is replayed to the target
+	req := "GET / HTTP/1.1\r\nHost: web-8080.localhost\r\n\r\nbody"
+	conn, err := net.Dial("tcp", p.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte(req))
+	conn.(*net.TCPConn).CloseWrite()
+	resp, _ := io.ReadAll(conn)
+	conn.Close()
+	if !bytes.Equal(resp, []byte{0x1f, 0x90}) {
+		t.Errorf("Expected the port 8080, got: %v", resp)
+	}
+	select {
+	case b := <-web.conns:
+		if string(b) != req {
+			t.Errorf("Expected the request to be replayed, got: %q", b)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("The connection is not served by the target")
+	}
+
+	// The TLS connection is routed by the SNI
+	conn, err = net.Dial("tcp", p.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The handshake fails as the fake target doesn't speak TLS
+	conn.SetDeadline(time.Now().Add(200 * time.Millisecond))
+	tls.Client(conn, &tls.Config{ServerName: "web-8080.localhost"}).Handshake()
+	conn.Close()
+	select {
+	case b := <-web.conns:
+		if len(b) == 0 || b[0] != 0x16 || !bytes.Contains(b, []byte("web-8080.localhost")) {
+			t.Errorf("Expected the ClientHello to be replayed, got: %q", b)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("The TLS connection is not served by the target")
+	}
+
+	// The unknown host gets the routes
+	conn, err = net.Dial("tcp", p.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: db.localhost\r\n\r\n"))
+	resp, _ = io.ReadAll(conn)
+	conn.Close()
+	if !bytes.HasPrefix(resp, []byte("HTTP/1.1 404")) || !bytes.Contains(resp, []byte("web-8080.localhost")) {
+		t.Errorf("Expected 404 with the routes, got: %q", resp)
+	}
+}
+
+func TestProxyToken(t *testing.T) {
+	web := &fakeTarget{name: "web", ports: []Port{{Port: 8080}}, conns: make(chan []byte, 1)}
+	p := NewProxy("127.0.0.1:0", func() []Target { return []Target{web} }, log.New(io.Discard, "", 0))
+	p.SetToken("secret")
+	if err := p.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	go p.Serve()
+
+	tests := []struct {
+		name   string
+		req    string
+		routed bool
+		resp   string
+	}{
+		{"No token", "GET / HTTP/1.1\r\nHost: web-8080.localhost\r\n\r\n", false, "HTTP/1.1 401"},
+		{"Wrong token", "GET / HTTP/1.1\r\nHost: web-8080.localhost\r\nX-Apf-Token: wrong\r\n\r\n", false, "HTTP/1.1 401"},
+		{"Header", "GET / HTTP/1.1\r\nHost: web-8080.localhost\r\nX-Apf-Token: secret\r\n\r\n", true, ""},
+		{"Cookie", "GET / HTTP/1.1\r\nHost: web-8080.localhost\r\nCookie: apf_token=secret\r\n\r\n", true, ""},
+		{"Cookies", "GET / HTTP/1.1\r\nHost: web-8080.localhost\r\nCookie: a=1; apf_token=secret; b=2\r\n\r\nbody", true, ""},
+		{"Query", "GET //example.com/?apf_token=secret&a=1 HTTP/1.1\r\nHost: web-8080.localhost\r\n\r\n", false, "HTTP/1.1 302 Found\r\nLocation: /example.com/?a=1\r\nSet-Cookie: apf_token=secret;"},
+		{"TLS", "\x16\x03\x01\x00\x01\x01", false, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := net.Dial("tcp", p.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn.Write([]byte(tt.req))
+			conn.(*net.TCPConn).CloseWrite()
+			resp, _ := io.ReadAll(conn)
+			conn.Close()
+			if tt.routed {
+				if !bytes.Equal(resp, []byte{0x1f, 0x90}) {
+					t.Errorf("Expected the port 8080, got: %q", resp)
+				}
+				// The target doesn't see the token
+				if b := <-web.conns; bytes.Contains(b, []byte("secret")) || bytes.Contains(b, []byte(TokenHeader)) {
+					t.Errorf("Expected the token to be removed, got: %q", b)
+				}
+				return
+			}
+			if !bytes.HasPrefix(resp, []byte(tt.resp)) {
+				t.Errorf("Expected %q, got: %q", tt.resp, resp)
+			}
+		})
+	}
+}
+
+func TestStripToken(t *testing.T) {
+	for _, tt := range []struct {
+		req     string
+		upgrade bool
+		want    string
+	}{
+		{
+			"GET / HTTP/1.1\r\nHost: web\r\nX-Apf-Token: secret\r\nConnection: keep-alive\r\n\r\n",
+			false,
+			"GET / HTTP/1.1\r\nHost: web\r\nConnection: close\r\n\r\n",
+		},
+		{
+			"POST / HTTP/1.1\r\nHost: web\r\ncookie: a=1; apf_token=secret;b=2\r\nContent-Length: 4\r\n\r\nbody",
+			false,
+			"POST / HTTP/1.1\r\nHost: web\r\ncookie: a=1; b=2\r\nContent-Length: 4\r\nConnection: close\r\n\r\nbody",
+		},
+		{
+			"GET /ws HTTP/1.1\nHost: web\nCookie: apf_token=secret\nConnection: Upgrade\nUpgrade: websocket\n\n",
+			true,
+			"GET /ws HTTP/1.1\r\nHost: web\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n",
+		},
+	} {
+		if got := string(stripToken([]byte(tt.req), tt.upgrade)); got != tt.want {
+			t.Errorf("stripToken(%q) =\n%q, want\n%q", tt.req, got, tt.want)
+		}
+	}
+}
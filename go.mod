@@ -2,4 +2,10 @@ module github.com/ruoshan/autoportforward
 
 go 1.17
 
-require github.com/hashicorp/yamux v0.0.0-20211028200310-0bc27b27de87
+require (
+	github.com/BurntSushi/toml v1.2.1
+	github.com/hashicorp/yamux v0.0.0-20211028200310-0bc27b27de87
+	golang.org/x/sys v0.0.0-20210615035016-665e8c7367d1
+	golang.org/x/term v0.1.0
+	gopkg.in/yaml.v3 v3.0.1
+)
@@ -0,0 +1,73 @@
+// Package hooks runs the shell commands configured for the events, see config.Hooks.
+package hooks
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+
+	"github.com/ruoshan/autoportforward/config"
+	"github.com/ruoshan/autoportforward/events"
+)
+
+type Runner struct {
+	hooks  config.Hooks
+	logger *log.Logger
+}
+
+func NewRunner(hooks config.Hooks, logger *log.Logger) *Runner {
+	return &Runner{
+		hooks:  hooks,
+		logger: logger,
+	}
+}
+
+func (r *Runner) command(ev events.Event) string {
+	switch ev.Event {
+	case events.SessionStarted:
+		return r.hooks.OnStart
+	case events.SessionStopped:
+		return r.hooks.OnStop
+	case events.PortAdded:
+		return r.hooks.OnPortAdded
+	case events.PortRemoved:
+		return r.hooks.OnPortRemoved
+	default:
+		return ""
+	}
+}
+
+// Handle is meant to be used as a sink of the events.Emitter. The hooks are run in the background,
+// except the on_stop hook, which is waited as apf is about to exit.
+func (r *Runner) Handle(ev events.Event) {
+	command := r.command(ev)
+	if command == "" {
+		return
+	}
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Env = append(os.Environ(),
+		"APF_EVENT="+ev.Event,
+		"APF_TARGET="+ev.Target,
+		"APF_DIRECTION="+ev.Direction,
+		fmt.Sprintf("APF_LOCAL_PORT=%d", ev.LocalPort),
+		fmt.Sprintf("APF_REMOTE_PORT=%d", ev.RemotePort),
+	)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	r.logger.Printf("Running %s hook: %s", ev.Event, command)
+	if err := cmd.Start(); err != nil {
+		r.logger.Printf("Failed to run hook: %s", err)
+		return
+	}
+	wait := func() {
+		if err := cmd.Wait(); err != nil {
+			r.logger.Printf("Hook %s failed: %s", ev.Event, err)
+		}
+	}
+	if ev.Event == events.SessionStopped {
+		wait()
+	} else {
+		go wait()
+	}
+}
@@ -0,0 +1,99 @@
+package logger
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	maxLogSize    = 10 << 20 // 10MB
+	maxLogBackups = 3
+)
+
+// RotatingWriter writes to the file of the path, once the file grows over maxSize bytes, it's
+// renamed to path.1 (path.1 to path.2, and so on), at most `backups` old files are kept.
+type RotatingWriter struct {
+	mu      sync.Mutex
+	path    string
+	maxSize int64
+	backups int
+	file    *os.File
+	size    int64
+}
+
+func NewRotatingWriter(path string, maxSize int64, backups int) (*RotatingWriter, error) {
+	w := &RotatingWriter{
+		path:    path,
+		maxSize: maxSize,
+		backups: backups,
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *RotatingWriter) open() error {
+	// The log may have the targets and the command lines of the processes
+	f, err := os.OpenFile(w.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	// The log created by an older version is made private as well
+	f.Chmod(0600)
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	w.file = f
+	w.size = info.Size()
+	return nil
+}
+
+func (w *RotatingWriter) rotate() error {
+	w.file.Close()
+	for i := w.backups - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", w.path, i), fmt.Sprintf("%s.%d", w.path, i+1))
+	}
+	if w.backups > 0 {
+		os.Rename(w.path, w.path+".1")
+	} else {
+		os.Remove(w.path)
+	}
+	return w.open()
+}
+
+func (w *RotatingWriter) Write(b []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.size+int64(len(b)) > w.maxSize && w.size > 0 {
+		if err := w.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := w.file.Write(b)
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *RotatingWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.file.Close()
+}
+
+// GetRotatingLogger returns a logger writing to the path, which is rotated every 10MB.
+func GetRotatingLogger(path string) (*log.Logger, error) {
+	w, err := NewRotatingWriter(path, maxLogSize, maxLogBackups)
+	if err != nil {
+		return nil, err
+	}
+	return log.New(w, "", log.LstdFlags|log.Lshortfile), nil
+}
@@ -0,0 +1,276 @@
+package manager
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/ruoshan/autoportforward/portscan"
+)
+
+// Every message over the wire is a frame:
+//
+//	version (1 byte) | type (1 byte) | request ID (4 bytes) | payload length (4 bytes) | payload
+//
+// The responses carry the request IDs of their requests. The integers are big endian, the strings and
+// the lists in the payloads are prefixed by their 2-byte lengths.
+const (
+	Version     = 1
+	headerLen   = 10
+	MaxFrameLen = 1 << 20 // the max payload length
+)
+
+// The frame types
+const (
+	// Req
+	PING byte = 0x01
+	FWD  byte = 0x02 // payload: [{rport, destination, path}]
+	DEL  byte = 0x03 // payload: [rport]
+	INF  byte = 0x04 // payload: [{port, pid, uid, name, command}]
+
+	// Resp
+	LSN byte = 0x81 // payload: [listening port], one for each port of the FWD
+	ACK byte = 0x82
+	ERR byte = 0x83 // payload: the error message
+)
+
+var (
+	ErrVersion       = errors.New("unsupported protocol version")
+	ErrFrameTooLarge = errors.New("frame is too large")
+	ErrMalformed     = errors.New("malformed payload")
+)
+
+type frame struct {
+	typ     byte
+	id      uint32
+	payload []byte
+}
+
+func (f frame) String() string {
+	return fmt.Sprintf("%s#%d", typeName(f.typ), f.id)
+}
+
+func typeName(typ byte) string {
+	switch typ {
+	case PING:
+		return "png"
+	case FWD:
+		return "fwd"
+	case DEL:
+		return "del"
+	case INF:
+		return "inf"
+	case LSN:
+		return "lsn"
+	case ACK:
+		return "ack"
+	case ERR:
+		return "err"
+	}
+	return fmt.Sprintf("0x%02x", typ)
+}
+
+func writeFrame(w io.Writer, f frame) error {
+	if len(f.payload) > MaxFrameLen {
+		return ErrFrameTooLarge
+	}
+	buf := make([]byte, headerLen, headerLen+len(f.payload))
+	buf[0] = Version
+	buf[1] = f.typ
+	binary.BigEndian.PutUint32(buf[2:], f.id)
+	binary.BigEndian.PutUint32(buf[6:], uint32(len(f.payload)))
+	buf = append(buf, f.payload...)
+	_, err := w.Write(buf)
+	return err
+}
+
+// readFrame reads a whole frame. The frame of another version is still read, so that the stream stays in
+// sync, it's returned with ErrVersion.
+func readFrame(r io.Reader) (frame, error) {
+	hdr := make([]byte, headerLen)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return frame{}, err
+	}
+	f := frame{typ: hdr[1], id: binary.BigEndian.Uint32(hdr[2:])}
+	size := binary.BigEndian.Uint32(hdr[6:])
+	if size > MaxFrameLen {
+		return f, ErrFrameTooLarge
+	}
+	f.payload = make([]byte, size)
+	if _, err := io.ReadFull(r, f.payload); err != nil {
+		return f, err
+	}
+	if hdr[0] != Version {
+		return f, ErrVersion
+	}
+	return f, nil
+}
+
+// fwdEntry is a port offered by the FWD
+type fwdEntry struct {
+	port uint16
+	peerTarget
+}
+
+type encoder struct {
+	bytes.Buffer
+}
+
+func (e *encoder) uint16(v uint16) {
+	binary.Write(e, binary.BigEndian, v)
+}
+
+func (e *encoder) uint32(v uint32) {
+	binary.Write(e, binary.BigEndian, v)
+}
+
+// count writes the length of a list, the lists are truncated to 0xffff entries
+func (e *encoder) count(n int) int {
+	if n > math.MaxUint16 {
+		n = math.MaxUint16
+	}
+	e.uint16(uint16(n))
+	return n
+}
+
+func (e *encoder) string(s string) {
+	if len(s) > math.MaxUint16 {
+		s = s[:math.MaxUint16]
+	}
+	e.uint16(uint16(len(s)))
+	e.WriteString(s)
+}
+
+// decoder decodes a payload, the first error is kept and the rest of the decoding is no-op.
+type decoder struct {
+	buf []byte
+	err error
+}
+
+func (d *decoder) next(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if len(d.buf) < n {
+		d.err = ErrMalformed
+		return nil
+	}
+	b := d.buf[:n]
+	d.buf = d.buf[n:]
+	return b
+}
+
+func (d *decoder) uint16() uint16 {
+	if b := d.next(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (d *decoder) uint32() uint32 {
+	if b := d.next(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+// count reads the length of a list whose entries take at least size bytes each.
+func (d *decoder) count(size int) int {
+	n := int(d.uint16())
+	if d.err == nil && len(d.buf) < n*size {
+		d.err = ErrMalformed
+		return 0
+	}
+	return n
+}
+
+func (d *decoder) string() string {
+	return string(d.next(int(d.uint16())))
+}
+
+// finish returns the error of the decoding, the trailing bytes are malformed too.
+func (d *decoder) finish() error {
+	if d.err == nil && len(d.buf) > 0 {
+		d.err = ErrMalformed
+	}
+	return d.err
+}
+
+func encodePorts(ports []uint16) []byte {
+	e := &encoder{}
+	n := e.count(len(ports))
+	for _, p := range ports[:n] {
+		e.uint16(p)
+	}
+	return e.Bytes()
+}
+
+func decodePorts(payload []byte) ([]uint16, error) {
+	d := &decoder{buf: payload}
+	ports := make([]uint16, d.count(2))
+	for i := range ports {
+		ports[i] = d.uint16()
+	}
+	return ports, d.finish()
+}
+
+func encodeFwd(entries []fwdEntry) []byte {
+	e := &encoder{}
+	n := e.count(len(entries))
+	for _, ent := range entries[:n] {
+		e.uint16(ent.port)
+		e.string(ent.dest)
+		e.string(ent.path)
+	}
+	return e.Bytes()
+}
+
+func decodeFwd(payload []byte) ([]fwdEntry, error) {
+	d := &decoder{buf: payload}
+	entries := make([]fwdEntry, d.count(6))
+	for i := range entries {
+		entries[i].port = d.uint16()
+		entries[i].dest = d.string()
+		entries[i].path = d.string()
+	}
+	return entries, d.finish()
+}
+
+func encodeProcesses(procs map[uint16]portscan.Process) []byte {
+	e := &encoder{}
+	n := e.count(len(procs))
+	for port, p := range procs {
+		if n == 0 {
+			break
+		}
+		n--
+		e.uint16(port)
+		e.uint32(p.PID)
+		e.uint32(p.UID)
+		e.string(p.Name)
+		e.string(p.Command)
+	}
+	return e.Bytes()
+}
+
+func decodeProcesses(payload []byte) (map[uint16]portscan.Process, error) {
+	d := &decoder{buf: payload}
+	n := d.count(14)
+	procs := make(map[uint16]portscan.Process, n)
+	for i := 0; i < n; i++ {
+		port := d.uint16()
+		p := portscan.Process{}
+		p.PID = d.uint32()
+		p.UID = d.uint32()
+		p.Name = d.string()
+		p.Command = d.string()
+		procs[port] = p
+	}
+	if err := d.finish(); err != nil {
+		return nil, err
+	}
+	return procs, nil
+}
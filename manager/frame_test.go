@@ -0,0 +1,131 @@
+package manager
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+
+	"github.com/ruoshan/autoportforward/portscan"
+)
+
+func TestFrame(t *testing.T) {
+	buf := &bytes.Buffer{}
+	frames := []frame{
+		{typ: PING, id: 1, payload: []byte{}},
+		{typ: FWD, id: 2, payload: encodeFwd([]fwdEntry{{port: 8080}})},
+		{typ: ERR, id: 0xffffffff, payload: []byte("unknown request type 0x7f")},
+	}
+	for _, f := range frames {
+		if err := writeFrame(buf, f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, want := range frames {
+		f, err := readFrame(buf)
+		if err != nil || !reflect.DeepEqual(f, want) {
+			t.Fatalf("readFrame() = %v, %v, want %v", f, err, want)
+		}
+	}
+	if err := writeFrame(buf, frame{typ: INF, payload: make([]byte, MaxFrameLen+1)}); err != ErrFrameTooLarge {
+		t.Fatalf("expected ErrFrameTooLarge, got %v", err)
+	}
+}
+
+func TestReadFrameErrors(t *testing.T) {
+	header := func(version, typ byte, id, size uint32) []byte {
+		hdr := []byte{version, typ, 0, 0, 0, 0, 0, 0, 0, 0}
+		binary.BigEndian.PutUint32(hdr[2:], id)
+		binary.BigEndian.PutUint32(hdr[6:], size)
+		return hdr
+	}
+	for _, tt := range []struct {
+		name string
+		data []byte
+		err  error
+	}{
+		{"too large", header(Version, FWD, 1, MaxFrameLen+1), ErrFrameTooLarge},
+		{"other version", append(header(Version+1, FWD, 1, 2), 0, 0), ErrVersion},
+		{"truncated header", []byte{Version, PING, 0}, nil},
+		{"truncated payload", append(header(Version, DEL, 1, 4), 0, 1), nil},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := readFrame(bytes.NewReader(tt.data))
+			if err == nil || (tt.err != nil && err != tt.err) {
+				t.Fatalf("readFrame() = %v, want %v", err, tt.err)
+			}
+		})
+	}
+
+	// The frame of another version is skipped as a whole
+	buf := bytes.NewBuffer(append(header(Version+1, FWD, 1, 2), 0, 0))
+	writeFrame(buf, frame{typ: PING, id: 2, payload: []byte{}})
+	if f, err := readFrame(buf); err != ErrVersion || f.id != 1 {
+		t.Fatalf("readFrame() = %v, %v, want ErrVersion", f, err)
+	}
+	if f, err := readFrame(buf); err != nil || f.typ != PING || f.id != 2 {
+		t.Fatalf("readFrame() = %v, %v, want the PING", f, err)
+	}
+}
+
+func TestCodec(t *testing.T) {
+	ports := []uint16{80, 443, 65535}
+	if got, err := decodePorts(encodePorts(ports)); err != nil || !reflect.DeepEqual(got, ports) {
+		t.Fatalf("decodePorts() = %v, %v, want %v", got, err, ports)
+	}
+
+	entries := []fwdEntry{
+		{port: 9090},
+		{port: 5432, peerTarget: peerTarget{dest: "db.internal:5432"}},
+		{port: 65535, peerTarget: peerTarget{dest: "unix:/tmp/agent.1", path: "/tmp/ssh-agent.sock"}},
+	}
+	if got, err := decodeFwd(encodeFwd(entries)); err != nil || !reflect.DeepEqual(got, entries) {
+		t.Fatalf("decodeFwd() = %v, %v, want %v", got, err, entries)
+	}
+
+	procs := map[uint16]portscan.Process{
+		8080: {PID: 42, UID: 1000, Name: "node", Command: "node server.js"},
+		22:   {PID: 1, Name: "sshd"},
+	}
+	if got, err := decodeProcesses(encodeProcesses(procs)); err != nil || !reflect.DeepEqual(got, procs) {
+		t.Fatalf("decodeProcesses() = %v, %v, want %v", got, err, procs)
+	}
+}
+
+func TestDecodeMalformed(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		payload []byte
+		decode  func([]byte) error
+	}{
+		{"ports empty", nil, decodePortsErr},
+		{"ports short", []byte{0, 2, 0, 80}, decodePortsErr},
+		{"ports trailing", []byte{0, 1, 0, 80, 0}, decodePortsErr},
+		{"ports huge count", []byte{0xff, 0xff}, decodePortsErr},
+		{"fwd short string", []byte{0, 1, 0, 80, 0, 9, 'd', 'b', 0, 0}, decodeFwdErr},
+		{"fwd missing path", []byte{0, 1, 0, 80, 0, 0}, decodeFwdErr},
+		{"processes short", []byte{0, 1, 0, 80, 0, 0, 0, 1}, decodeProcessesErr},
+		{"processes huge count", []byte{0xff, 0xff, 0, 0}, decodeProcessesErr},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.decode(tt.payload); err != ErrMalformed {
+				t.Fatalf("expected ErrMalformed, got %v", err)
+			}
+		})
+	}
+}
+
+func decodePortsErr(b []byte) error {
+	_, err := decodePorts(b)
+	return err
+}
+
+func decodeFwdErr(b []byte) error {
+	_, err := decodeFwd(b)
+	return err
+}
+
+func decodeProcessesErr(b []byte) error {
+	_, err := decodeProcesses(b)
+	return err
+}
@@ -0,0 +1,69 @@
+//go:build go1.18
+// +build go1.18
+
+package manager
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/ruoshan/autoportforward/portscan"
+)
+
+// The fuzz tests, eg. go test -fuzz FuzzDecodeFwd ./manager
+
+func FuzzReadFrame(f *testing.F) {
+	buf := &bytes.Buffer{}
+	writeFrame(buf, frame{typ: DEL, id: 7, payload: encodePorts([]uint16{80})})
+	f.Add(buf.Bytes())
+	f.Add([]byte{Version, PING, 0, 0, 0, 1, 0xff, 0xff, 0xff, 0xff})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fr, err := readFrame(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+		out := &bytes.Buffer{}
+		if err := writeFrame(out, fr); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out.Bytes(), data[:out.Len()]) {
+			t.Fatalf("frame %v is not encoded back to %x", fr, data)
+		}
+	})
+}
+
+func FuzzDecodePorts(f *testing.F) {
+	f.Add(encodePorts([]uint16{80, 443}))
+	f.Fuzz(func(t *testing.T, payload []byte) {
+		ports, err := decodePorts(payload)
+		if err == nil && !bytes.Equal(encodePorts(ports), payload) {
+			t.Fatalf("ports %v are not encoded back to %x", ports, payload)
+		}
+	})
+}
+
+func FuzzDecodeFwd(f *testing.F) {
+	f.Add(encodeFwd([]fwdEntry{{port: 5432, peerTarget: peerTarget{dest: "db.internal:5432", path: "/tmp/db.sock"}}}))
+	f.Fuzz(func(t *testing.T, payload []byte) {
+		entries, err := decodeFwd(payload)
+		if err == nil && !bytes.Equal(encodeFwd(entries), payload) {
+			t.Fatalf("entries %v are not encoded back to %x", entries, payload)
+		}
+	})
+}
+
+func FuzzDecodeProcesses(f *testing.F) {
+	f.Add(encodeProcesses(map[uint16]portscan.Process{8080: {PID: 42, Name: "node", Command: "node server.js"}}))
+	f.Fuzz(func(t *testing.T, payload []byte) {
+		procs, err := decodeProcesses(payload)
+		if err != nil {
+			return
+		}
+		// The duplicate ports are collapsed, the decoding of the encoding is stable though
+		got, err := decodeProcesses(encodeProcesses(procs))
+		if err != nil || !reflect.DeepEqual(got, procs) {
+			t.Fatalf("decodeProcesses() = %v, %v, want %v", got, err, procs)
+		}
+	})
+}
@@ -1,13 +1,23 @@
 // Manager uses two dedicated bidirectional streams for communication between local and remote agent.
-// Here are the commands:
-//  - PING: expected PONG response
-//  - FWD {rport}: create a new listener on the receiving side
+// Each side sends the requests on its sending stream, and responds to the requests of the peer on its
+// receiving stream, see frame.go for the frames. Here are the requests:
+//  - PING: expected ACK response
+//  - FWD {rport, destination, path}: create a new listener on the receiving side, the connections are forwarded
+//    to the destination dialed by the sending side, eg. db.internal:5432 (the rport on 127.0.0.1 if empty).
+//    The listener is the unix socket of the path instead of the rport if the path is not empty. Expected LSN
+//    response with the listening port of each rport
 //  - DEL {rport}: delete the listener on the receiving side
+//  - INF {port, pid, uid, name, command}: the owning processes of the ports offered by the sending side
+//
+// The malformed or unknown requests get the ERR response, the malformed responses shut the manager down.
+//
+// The requests are pipelined: they're sent without waiting for the responses of the previous ones, and
+// matched with their responses by the request IDs. The peer handles the requests in order, except that
+// the PINGs are answered right away, so that a slow FWD doesn't delay the health check.
 package manager
 
 import (
-	"bytes"
-	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -15,47 +25,75 @@ import (
 	"strings"
 	"sync"
 	"time"
-)
 
-// All commands are three-letter string over the wire
-const CMD_LEN = 3
+	"github.com/ruoshan/autoportforward/portscan"
+)
 
-// Req
+// The time to wait for the responses, the peer is considered dead if the PING times out
 const (
-	PING = "png"
-	FWD  = "fwd"
-	DEL  = "del"
+	pingTimeout = 5 * time.Second
+	respTimeout = 30 * time.Second
 )
 
-// Resp
-const (
-	LSN = "lsn"
-	ACK = "ack"
+// The requests of the peer queued for handling
+const maxQueuedRequests = 64
+
+var (
+	ErrShutdown = errors.New("manager is shut down")
+	ErrTimeout  = errors.New("timeout waiting for the response")
 )
 
+// request is waiting for its response
+type request struct {
+	frame
+	resp chan frame
+}
+
 type Manager struct {
 	receiver     io.ReadWriteCloser
 	sender       io.ReadWriteCloser
-	cmdCh        chan string
-	lsnCh        chan []uint16
+	reqCh        chan frame // the requests of the peer to be handled in order
+	recvMu       sync.Mutex // serializes the responses written to the receiver
+	sendMu       sync.Mutex // serializes the requests written to the sender
+	pendingMu    sync.Mutex
+	pending      map[uint32]*request // request ID => the request waiting for the response
+	nextID       uint32
 	shutdownCh   chan struct{}
 	shutdownHook func()
 	once         sync.Once
 	wg           *sync.WaitGroup
 	logger       *log.Logger
+	portMu       sync.Mutex        // guards the localPortMap, peerPortMap and forwarded
+	updateMu     sync.Mutex        // serializes the UpdatePeerPorts
+	dumpMu       sync.Mutex        // serializes the dumpCallback
 	localPortMap map[uint16]uint16 // target port => local listener port
 	peerPortMap  map[uint16]uint16 // peer's listening ports: target port => peer listener port
 	fwdCallback  func(port uint16) (finalPort uint16, err error)
 	delCallback  func(port uint16) error
 	dumpCallback func(localPortMap, peerPortMap map[uint16]uint16)
+	procCallback func(procs map[uint16]portscan.Process)
+	procMu       sync.Mutex
+	procs        map[uint16]portscan.Process // the owning processes of the ports offered by the peer
+	destCallback func(port uint16, dest string)
+	destMu       sync.Mutex
+	destinations map[uint16]string // the destinations of the ports offered to the peer
+	paths        map[uint16]string // the unix socket paths listened by the peer instead of the ports
+	pathCallback func(port uint16, path string)
+	forwarded    map[uint16]peerTarget // how the peer's listening ports were forwarded
+}
+
+// peerTarget is the destination and the path of a port offered to the peer
+type peerTarget struct {
+	dest string
+	path string
 }
 
 func NewManager(receiver io.ReadWriteCloser, sender io.ReadWriteCloser, logger *log.Logger, shutdownHook func()) *Manager {
 	return &Manager{
 		receiver:     receiver,
 		sender:       sender,
-		cmdCh:        make(chan string),
-		lsnCh:        make(chan []uint16),
+		reqCh:        make(chan frame, maxQueuedRequests),
+		pending:      make(map[uint32]*request),
 		shutdownCh:   make(chan struct{}),
 		shutdownHook: shutdownHook,
 		once:         sync.Once{},
@@ -66,13 +104,18 @@ func NewManager(receiver io.ReadWriteCloser, sender io.ReadWriteCloser, logger *
 		fwdCallback:  nil,
 		delCallback:  nil,
 		dumpCallback: nil,
+		procs:        make(map[uint16]portscan.Process),
+		destinations: make(map[uint16]string),
+		paths:        make(map[uint16]string),
+		forwarded:    make(map[uint16]peerTarget),
 	}
 }
 
 func (m *Manager) Run() {
-	m.wg.Add(2) // Only wait for the two loops
+	m.wg.Add(3) // Only wait for the loops
 	go m.receivingLoop()
-	go m.sendingLoop()
+	go m.handlingLoop()
+	go m.responseLoop()
 	go m.healthcheck()
 }
 
@@ -81,162 +124,438 @@ func (m *Manager) receivingLoop() {
 		m.logger.Println("Stop receiving")
 		m.wg.Done()
 	}()
-	buf := make([]byte, CMD_LEN)
 	for {
-		_, err := io.ReadFull(m.receiver, buf)
-		if err != nil {
-			m.logger.Println("Read EOF")
+		req, err := readFrame(m.receiver)
+		switch {
+		case err == ErrVersion:
+			m.respond(req, errFrame(err))
+			continue
+		case err != nil:
+			m.logger.Printf("Failed to read the request: %s", err)
 			m.Shutdown()
 			return
-		}
-		switch string(buf) {
-		case PING:
-			// noop
-		case FWD:
-			ports := m.decodeSlice(m.receiver)
-			lports := m.fwdPorts(ports)
-			m.receiver.Write([]byte(LSN))
-			m.receiver.Write(m.encodeSlice(lports))
-			m.DumpPorts()
+		case req.typ == PING:
+			m.respond(req, frame{typ: ACK})
 			continue
-		case DEL:
-			ports := m.decodeSlice(m.receiver)
-			m.delPorts(ports)
-			m.DumpPorts()
-		default:
-			panic(fmt.Sprintf("Unknown manager command: %v", buf))
 		}
-		m.receiver.Write([]byte(ACK))
+		select {
+		case m.reqCh <- req:
+		case <-m.shutdownCh:
+			return
+		}
+	}
+}
+
+// handlingLoop handles the requests of the peer in order
+func (m *Manager) handlingLoop() {
+	defer m.wg.Done()
+	for {
+		select {
+		case <-m.shutdownCh:
+			return
+		case req := <-m.reqCh:
+			m.respond(req, m.handle(req))
+		}
+	}
+}
+
+func (m *Manager) respond(req, resp frame) {
+	resp.id = req.id
+	if resp.typ == ERR {
+		m.logger.Printf("Failed to handle %s: %s", req, resp.payload)
+	}
+	m.recvMu.Lock()
+	err := writeFrame(m.receiver, resp)
+	m.recvMu.Unlock()
+	if err != nil {
+		m.logger.Printf("Failed to write the response of %s: %s", req, err)
+		m.Shutdown()
+	}
+}
+
+// handle handles the request of the peer and returns the response
+func (m *Manager) handle(req frame) frame {
+	switch req.typ {
+	case PING:
+		// noop
+	case FWD:
+		entries, err := decodeFwd(req.payload)
+		if err != nil {
+			return errFrame(err)
+		}
+		ports := make([]uint16, 0, len(entries))
+		for _, e := range entries {
+			if m.destCallback != nil {
+				m.destCallback(e.port, e.dest)
+			}
+			if m.pathCallback != nil {
+				m.pathCallback(e.port, e.path)
+			}
+			ports = append(ports, e.port)
+		}
+		lports := m.fwdPorts(ports)
+		m.DumpPorts()
+		return frame{typ: LSN, payload: encodePorts(lports)}
+	case DEL:
+		ports, err := decodePorts(req.payload)
+		if err != nil {
+			return errFrame(err)
+		}
+		m.delPorts(ports)
+		m.DumpPorts()
+	case INF:
+		procs, err := decodeProcesses(req.payload)
+		if err != nil {
+			return errFrame(err)
+		}
+		m.setProcesses(procs)
+	default:
+		return errFrame(fmt.Errorf("unknown request type %s", typeName(req.typ)))
 	}
+	return frame{typ: ACK}
+}
+
+func errFrame(err error) frame {
+	return frame{typ: ERR, payload: []byte(err.Error())}
 }
 
 func (m *Manager) fwdPorts(ports []uint16) (lports []uint16) {
-	lports = make([]uint16, 0, 10)
+	m.portMu.Lock()
+	defer m.portMu.Unlock()
+	lports = make([]uint16, 0, len(ports))
 	for _, p := range ports {
-		if _, ok := m.localPortMap[p]; ok {
-			continue
-		}
-		m.localPortMap[p] = 0
-		if m.fwdCallback != nil {
-			lport, _ := m.fwdCallback(p)
-			m.localPortMap[p] = lport
+		// The ports that are already forwarded keep their listeners
+		if _, ok := m.localPortMap[p]; !ok {
+			m.localPortMap[p] = m.fwdPort(p)
 		}
 		lports = append(lports, m.localPortMap[p])
 	}
 	return lports
 }
 
+// fwdPort returns 0 if the port is not forwarded (eg. excluded), the port is still kept in
+// the localPortMap so that it can be forwarded later by RefreshPorts.
+func (m *Manager) fwdPort(port uint16) uint16 {
+	if m.fwdCallback == nil {
+		return 0
+	}
+	lport, err := m.fwdCallback(port)
+	if err != nil {
+		m.logger.Printf("Failed to forward port %d: %s", port, err)
+		return 0
+	}
+	return lport
+}
+
 func (m *Manager) delPorts(ports []uint16) {
+	m.portMu.Lock()
+	defer m.portMu.Unlock()
 	for _, p := range ports {
+		lport, ok := m.localPortMap[p]
 		delete(m.localPortMap, p)
-		if m.delCallback != nil {
+		if ok && lport != 0 && m.delCallback != nil {
 			m.delCallback(p)
 		}
 	}
 }
 
-func (m *Manager) sendingLoop() {
+// RefreshPorts re-creates the local listeners of the given ports offered by the peer, so that
+// the changes of the forwarding rules (eg. pinned or excluded ports) take effect.
+func (m *Manager) RefreshPorts(ports []uint16) {
+	m.portMu.Lock()
+	changed := false
+	for _, p := range ports {
+		lport, ok := m.localPortMap[p]
+		if !ok {
+			continue
+		}
+		if lport != 0 && m.delCallback != nil {
+			m.delCallback(p)
+		}
+		m.localPortMap[p] = m.fwdPort(p)
+		changed = true
+	}
+	m.portMu.Unlock()
+	if changed {
+		m.DumpPorts()
+	}
+}
+
+// responseLoop delivers the responses to the requests waiting for them
+func (m *Manager) responseLoop() {
 	defer func() {
 		m.logger.Println("Stop sending")
 		m.wg.Done()
 	}()
-	buf := make([]byte, CMD_LEN)
 	for {
-		select {
-		case <-m.shutdownCh:
+		resp, err := readFrame(m.sender)
+		if err != nil {
+			m.logger.Printf("Failed to read the response: %s", err)
+			m.Shutdown()
 			return
-		case cmd := <-m.cmdCh:
-			m.sender.Write([]byte(cmd))
-			timer := time.AfterFunc(5*time.Second, func() {
-				m.logger.Println("Timeout!")
-				m.Shutdown()
-			})
-			_, err := io.ReadFull(m.sender, buf)
-			timer.Stop()
-			if err != nil {
-				m.logger.Println("Error resp")
-				m.Shutdown()
-				return
-			}
-			switch string(buf) {
-			case LSN:
-				m.lsnCh <- m.decodeSlice(m.sender)
-			case ACK:
-				// OK
-			default:
-				m.logger.Println("Unexpected resp")
+		}
+		if resp.typ != LSN && resp.typ != ACK && resp.typ != ERR {
+			m.logger.Printf("Unexpected response %s", resp)
+			m.Shutdown()
+			return
+		}
+		m.pendingMu.Lock()
+		req, ok := m.pending[resp.id]
+		delete(m.pending, resp.id)
+		issued := resp.id != 0 && resp.id <= m.nextID
+		m.pendingMu.Unlock()
+		if !ok {
+			if !issued {
+				m.logger.Printf("Unexpected response %s to no request", resp)
 				m.Shutdown()
 				return
 			}
+			// The request has timed out
+			m.logger.Printf("Late response %s", resp)
+			continue
+		}
+		req.resp <- resp
+	}
+}
+
+// start sends the request without waiting for the response.
+func (m *Manager) start(typ byte, payload []byte) (*request, error) {
+	m.pendingMu.Lock()
+	m.nextID++
+	req := &request{frame: frame{typ: typ, id: m.nextID, payload: payload}, resp: make(chan frame, 1)}
+	m.pending[req.id] = req
+	m.pendingMu.Unlock()
+
+	m.sendMu.Lock()
+	err := writeFrame(m.sender, req.frame)
+	m.sendMu.Unlock()
+	if err != nil {
+		m.forget(req)
+		select {
+		case <-m.shutdownCh:
+			return nil, ErrShutdown
+		default:
 		}
+		m.logger.Printf("Failed to write %s: %s", req, err)
+		m.Shutdown()
+		return nil, err
 	}
+	return req, nil
+}
+
+func (m *Manager) forget(req *request) {
+	m.pendingMu.Lock()
+	delete(m.pending, req.id)
+	m.pendingMu.Unlock()
+}
+
+// wait waits for the response of the request, the ERR response is returned as the error.
+func (m *Manager) wait(req *request, timeout time.Duration) (frame, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case resp := <-req.resp:
+		if resp.typ == ERR {
+			return resp, fmt.Errorf("peer failed to handle %s: %s", req, resp.payload)
+		}
+		return resp, nil
+	case <-timer.C:
+		m.forget(req)
+		return frame{}, fmt.Errorf("%w of %s", ErrTimeout, req)
+	case <-m.shutdownCh:
+		return frame{}, ErrShutdown
+	}
+}
+
+// call sends the request and waits for its response.
+func (m *Manager) call(typ byte, payload []byte, timeout time.Duration) (frame, error) {
+	req, err := m.start(typ, payload)
+	if err != nil {
+		return frame{}, err
+	}
+	return m.wait(req, timeout)
+}
+
+// send sends the request, the failure is only logged. The requests are still sent in order.
+func (m *Manager) send(typ byte, payload []byte) {
+	req, err := m.start(typ, payload)
+	if err != nil {
+		return
+	}
+	go func() {
+		if _, err := m.wait(req, respTimeout); err != nil && err != ErrShutdown {
+			m.logger.Println(err)
+		}
+	}()
 }
 
 // yamux has its own healthcheck implemented, this is kinda redundant.
 func (m *Manager) healthcheck() {
 	tick := time.NewTicker(5 * time.Second)
-	for range tick.C {
-		m.cmdCh <- PING
+	defer tick.Stop()
+	for {
+		select {
+		case <-m.shutdownCh:
+			return
+		case <-tick.C:
+		}
+		if _, err := m.call(PING, nil, pingTimeout); errors.Is(err, ErrTimeout) {
+			m.logger.Println("Peer is not responding")
+			m.Shutdown()
+			return
+		}
 	}
 }
 
-func (m *Manager) encodeSlice(s []uint16) []byte {
-	hdr := make([]byte, 2)
-	binary.BigEndian.PutUint16(hdr, uint16(len(s)))
-	buf := &bytes.Buffer{}
-	buf.Write(hdr)
-	binary.Write(buf, binary.BigEndian, s)
-	return buf.Bytes()
+// SetPeerDestinations sets the destinations of the ports to be offered to the peer, they are sent along
+// with the ports in UpdatePeerPorts. The ports without destination are forwarded to the same local port.
+func (m *Manager) SetPeerDestinations(dests map[uint16]string) {
+	m.destMu.Lock()
+	defer m.destMu.Unlock()
+	m.destinations = make(map[uint16]string)
+	for port, dest := range dests {
+		m.destinations[port] = dest
+	}
 }
 
-func (m *Manager) decodeSlice(r io.Reader) []uint16 {
-	hdr := make([]byte, 2)
-	_, err := io.ReadFull(r, hdr)
-	if err != nil {
-		return nil
+// PeerDestination returns the destination of the port offered to the peer, empty if it's the same local port.
+func (m *Manager) PeerDestination(port uint16) string {
+	m.destMu.Lock()
+	defer m.destMu.Unlock()
+	return m.destinations[port]
+}
+
+// SetPeerPaths sets the unix socket paths to be listened by the peer instead of the ports, they are sent
+// along with the ports in UpdatePeerPorts. The ports are only the IDs of the sockets then.
+func (m *Manager) SetPeerPaths(paths map[uint16]string) {
+	m.destMu.Lock()
+	defer m.destMu.Unlock()
+	m.paths = make(map[uint16]string)
+	for port, path := range paths {
+		m.paths[port] = path
+	}
+}
+
+// PeerPath returns the unix socket path listened by the peer for the port, empty if it's the port.
+func (m *Manager) PeerPath(port uint16) string {
+	m.destMu.Lock()
+	defer m.destMu.Unlock()
+	return m.paths[port]
+}
+
+func (m *Manager) peerTarget(port uint16) peerTarget {
+	m.destMu.Lock()
+	defer m.destMu.Unlock()
+	return peerTarget{dest: m.destinations[port], path: m.paths[port]}
+}
+
+// SetPathCallback sets the callback that is invoked with the unix socket path of each port offered by the
+// peer, before the port is forwarded.
+func (m *Manager) SetPathCallback(pathCallback func(port uint16, path string)) {
+	m.pathCallback = pathCallback
+}
+
+// SetDestinationCallback sets the callback that is invoked with the destination of each port offered by
+// the peer, before the port is forwarded.
+func (m *Manager) SetDestinationCallback(destCallback func(port uint16, dest string)) {
+	m.destCallback = destCallback
+}
+
+// UpdatePeerProcesses tells the peer the owning processes of the ports, it should be called before
+// UpdatePeerPorts so that the peer knows the processes when forwarding the ports.
+func (m *Manager) UpdatePeerProcesses(procs map[uint16]portscan.Process) {
+	m.send(INF, encodeProcesses(procs))
+}
+
+func (m *Manager) setProcesses(procs map[uint16]portscan.Process) {
+	m.procMu.Lock()
+	m.procs = procs
+	m.procMu.Unlock()
+	if m.procCallback != nil {
+		m.procCallback(procs)
+	}
+}
+
+// Processes returns a copy of the owning processes of the ports offered by the peer.
+func (m *Manager) Processes() map[uint16]portscan.Process {
+	m.procMu.Lock()
+	defer m.procMu.Unlock()
+	procs := make(map[uint16]portscan.Process)
+	for port, p := range m.procs {
+		procs[port] = p
 	}
-	size := binary.BigEndian.Uint16(hdr)
-	ports := make([]uint16, size)
-	binary.Read(r, binary.BigEndian, ports)
-	return ports
+	return procs
+}
+
+// SetProcessCallback sets the callback that is invoked when the peer updates the owning processes.
+func (m *Manager) SetProcessCallback(procCallback func(procs map[uint16]portscan.Process)) {
+	m.procCallback = procCallback
 }
 
 // UpdatePeerPorts takes a full list of ports that're going to be listened on the peer side.
-// This will also command the peer to remove oudated ports from listening.
+// This will also command the peer to remove oudated ports from listening, and to re-create the
+// listeners of the ports whose destinations (or paths) are changed by SetPeerDestinations (SetPeerPaths).
 func (m *Manager) UpdatePeerPorts(ports []uint16) {
+	m.updateMu.Lock()
+	defer m.updateMu.Unlock()
+
+	m.portMu.Lock()
 	fwdList := make([]uint16, 0, 10)
 	delList := make([]uint16, 0, 10)
 	newPortMap := make(map[uint16]uint16)
 	for _, p := range ports {
-		if _, ok := m.peerPortMap[p]; !ok {
+		lport, ok := m.peerPortMap[p]
+		if ok && m.forwarded[p] != m.peerTarget(p) {
+			// changed destination, the port is deleted and forwarded again
+			delList = append(delList, p)
+			ok = false
+		}
+		if !ok {
 			// new ports to fwd
 			fwdList = append(fwdList, p)
 			newPortMap[p] = 0 // the peer's listening port is not determined until the FWD cmd is confirmed
 		} else {
-			newPortMap[p] = m.peerPortMap[p]
+			newPortMap[p] = lport
 		}
 	}
 	for p := range m.peerPortMap {
 		if _, ok := newPortMap[p]; !ok {
 			// old ports to del
 			delList = append(delList, p)
+			delete(m.forwarded, p)
 		}
 	}
 	m.peerPortMap = newPortMap
+	m.portMu.Unlock()
+
+	// DEL goes first, the peer keeps the listeners of the ports that are still listened
+	if len(delList) > 0 {
+		m.send(DEL, encodePorts(delList))
+	}
 
 	if len(fwdList) > 0 {
-		m.cmdCh <- FWD + string(m.encodeSlice(fwdList))
-		peerListenPorts := <-m.lsnCh
-		if len(fwdList) != len(peerListenPorts) {
-			panic("Expected FWD length equal to LSN")
+		entries := make([]fwdEntry, 0, len(fwdList))
+		for _, p := range fwdList {
+			entries = append(entries, fwdEntry{port: p, peerTarget: m.peerTarget(p)})
 		}
-		for i, p := range fwdList {
-			m.peerPortMap[p] = peerListenPorts[i]
+		// The lock is not held while waiting for the peer
+		peerListenPorts, err := m.forward(entries)
+		if err != nil {
+			m.logger.Printf("Failed to forward the ports to the peer: %s", err)
 		}
-	}
-
-	if len(delList) > 0 {
-		m.cmdCh <- DEL + string(m.encodeSlice(delList))
+		m.portMu.Lock()
+		if err != nil {
+			for _, e := range entries {
+				// Not forwarded, retried by the next update
+				delete(m.peerPortMap, e.port)
+			}
+		} else {
+			for i, e := range entries {
+				m.peerPortMap[e.port] = peerListenPorts[i]
+				m.forwarded[e.port] = e.peerTarget
+			}
+		}
+		m.portMu.Unlock()
 	}
 
 	if len(delList)+len(fwdList) > 0 {
@@ -244,14 +563,55 @@ func (m *Manager) UpdatePeerPorts(ports []uint16) {
 	}
 }
 
+// forward sends the FWD and returns the listening ports of the peer, one for each entry.
+func (m *Manager) forward(entries []fwdEntry) ([]uint16, error) {
+	resp, err := m.call(FWD, encodeFwd(entries), respTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if resp.typ != LSN {
+		return nil, fmt.Errorf("unexpected response %s to the FWD", resp)
+	}
+	lports, err := decodePorts(resp.payload)
+	if err != nil {
+		return nil, err
+	}
+	if len(lports) != len(entries) {
+		return nil, fmt.Errorf("expected %d listening ports, got %d", len(entries), len(lports))
+	}
+	return lports, nil
+}
+
 func (m *Manager) SetDumpCallback(dumpCallback func(local, peer map[uint16]uint16)) {
 	m.dumpCallback = dumpCallback
 }
 
+// DumpPorts invokes the dump callback with the snapshots of the port maps, the invocations are serialized.
 func (m *Manager) DumpPorts() {
+	m.dumpMu.Lock()
+	defer m.dumpMu.Unlock()
 	if m.dumpCallback != nil {
-		m.dumpCallback(m.localPortMap, m.peerPortMap)
+		m.dumpCallback(m.PortMaps())
+	}
+}
+
+// PortMaps returns copies of the forwarded ports, the ports that are not forwarded (yet) are omitted.
+func (m *Manager) PortMaps() (localPortMap, peerPortMap map[uint16]uint16) {
+	m.portMu.Lock()
+	defer m.portMu.Unlock()
+	localPortMap = make(map[uint16]uint16)
+	peerPortMap = make(map[uint16]uint16)
+	for targetPort, listenPort := range m.localPortMap {
+		if listenPort != 0 {
+			localPortMap[targetPort] = listenPort
+		}
+	}
+	for targetPort, listenPort := range m.peerPortMap {
+		if listenPort != 0 {
+			peerPortMap[targetPort] = listenPort
+		}
 	}
+	return localPortMap, peerPortMap
 }
 
 func (m *Manager) SetCallbacks(fwdCallback func(port uint16) (finalPort uint16, err error), delCallback func(port uint16) error) {
@@ -274,12 +634,28 @@ func (m *Manager) Wait() {
 }
 
 func DumpToStderr(localPortMap, peerPortMap map[uint16]uint16) {
+	DumpWithLabelsToStderr(localPortMap, peerPortMap, nil)
+}
+
+// DumpWithLabelsToStderr is like DumpToStderr, with the labels (eg. the URL, the owning process and the
+// service) of the target ports, eg. "8080 ==> 8080 http://localhost:8080 (node server.js, http)".
+// label may be nil.
+func DumpWithLabelsToStderr(localPortMap, peerPortMap map[uint16]uint16, label func(reverse bool, targetPort uint16) string) {
+	withLabel := func(s string, reverse bool, targetPort uint16) string {
+		if label == nil {
+			return s
+		}
+		if l := label(reverse, targetPort); l != "" {
+			return s + " " + l
+		}
+		return s
+	}
 	lst := make([]string, 0, 10)
 	for targetPort, listenPort := range localPortMap {
-		lst = append(lst, fmt.Sprintf("%d ==> %d", listenPort, targetPort))
+		lst = append(lst, withLabel(fmt.Sprintf("%d ==> %d", listenPort, targetPort), false, targetPort))
 	}
 	for targetPort, listenPort := range peerPortMap {
-		lst = append(lst, fmt.Sprintf("%d <== %d", targetPort, listenPort))
+		lst = append(lst, withLabel(fmt.Sprintf("%d <== %d", targetPort, listenPort), true, targetPort))
 	}
 	fmt.Fprintf(os.Stderr, "\r%s", strings.Repeat(" ", 100))
 	fmt.Fprintf(os.Stderr, "\rForwarding: [%s]", strings.Join(lst, ", "))
@@ -0,0 +1,331 @@
+package manager
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newPipedManagers returns two managers connected to each other
+func newPipedManagers(t *testing.T) (a, b *Manager) {
+	logger := log.New(io.Discard, "", 0)
+	aRecv, bSend := net.Pipe()
+	aSend, bRecv := net.Pipe()
+	a = NewManager(aRecv, aSend, logger, func() {})
+	b = NewManager(bRecv, bSend, logger, func() {})
+	t.Cleanup(func() {
+		a.Shutdown()
+		b.Shutdown()
+	})
+	return a, b
+}
+
+func TestUpdatePeerPorts(t *testing.T) {
+	a, b := newPipedManagers(t)
+	dests := make(map[uint16]string)
+	b.SetDestinationCallback(func(port uint16, dest string) {
+		dests[port] = dest
+	})
+	b.SetCallbacks(func(port uint16) (uint16, error) {
+		return port + 10000, nil
+	}, func(port uint16) error {
+		return nil
+	})
+	a.Run()
+	b.Run()
+
+	a.SetPeerDestinations(map[uint16]string{5432: "db.internal:5432"})
+	a.UpdatePeerPorts([]uint16{9090, 5432})
+	_, peer := a.PortMaps()
+	if want := map[uint16]uint16{9090: 19090, 5432: 15432}; !reflect.DeepEqual(peer, want) {
+		t.Fatalf("unexpected peer ports: %v, want %v", peer, want)
+	}
+	if dests[5432] != "db.internal:5432" || dests[9090] != "" {
+		t.Fatalf("unexpected destinations: %v", dests)
+	}
+}
+
+// fakePeer reads the requests of the manager and replies with the responses
+func fakePeer(conn net.Conn, reply func(req frame) frame) {
+	for {
+		req, err := readFrame(conn)
+		if err != nil {
+			return
+		}
+		resp := reply(req)
+		if resp.id == 0 {
+			resp.id = req.id
+		}
+		if err := writeFrame(conn, resp); err != nil {
+			return
+		}
+	}
+}
+
+func TestUpdatePeerPortsMalformedResponse(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		reply func(req frame) frame
+	}{
+		{"fewer listening ports", func(req frame) frame {
+			return frame{typ: LSN, payload: encodePorts([]uint16{19090})}
+		}},
+		{"malformed listening ports", func(req frame) frame {
+			return frame{typ: LSN, payload: []byte{0, 2, 0}}
+		}},
+		{"error", func(req frame) frame {
+			return errFrame(ErrMalformed)
+		}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			logger := log.New(io.Discard, "", 0)
+			recv, _ := net.Pipe()
+			send, peer := net.Pipe()
+			go fakePeer(peer, tt.reply)
+			m := NewManager(recv, send, logger, func() {})
+			defer m.Shutdown()
+			m.Run()
+
+			m.UpdatePeerPorts([]uint16{9090, 5432})
+			if _, peer := m.PortMaps(); len(peer) != 0 {
+				t.Fatalf("unexpected peer ports: %v", peer)
+			}
+		})
+	}
+}
+
+func TestUpdatePeerPortsUnexpectedResponse(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+	recv, _ := net.Pipe()
+	send, peer := net.Pipe()
+	go fakePeer(peer, func(req frame) frame {
+		return frame{typ: LSN, id: req.id + 1, payload: encodePorts([]uint16{19090})}
+	})
+	shutdown := make(chan struct{})
+	m := NewManager(recv, send, logger, func() { close(shutdown) })
+	m.Run()
+
+	m.UpdatePeerPorts([]uint16{9090})
+	select {
+	case <-shutdown:
+	case <-time.After(time.Second):
+		t.Fatal("expected the manager to shut down")
+	}
+}
+
+func TestReceivingMalformedRequests(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+	recv, peer := net.Pipe()
+	send, _ := net.Pipe()
+	m := NewManager(recv, send, logger, func() {})
+	defer m.Shutdown()
+	forwarded := 0
+	m.SetCallbacks(func(port uint16) (uint16, error) {
+		forwarded++
+		return port, nil
+	}, nil)
+	m.Run()
+
+	for _, tt := range []struct {
+		name string
+		req  frame
+		resp byte
+	}{
+		{"unknown type", frame{typ: 0x7f, id: 1}, ERR},
+		{"malformed fwd", frame{typ: FWD, id: 2, payload: []byte{0, 1, 0}}, ERR},
+		{"malformed del", frame{typ: DEL, id: 3, payload: []byte{0xff, 0xff}}, ERR},
+		{"malformed inf", frame{typ: INF, id: 4, payload: []byte{0, 1}}, ERR},
+		{"ping", frame{typ: PING, id: 5}, ACK},
+		{"fwd", frame{typ: FWD, id: 6, payload: encodeFwd([]fwdEntry{{port: 8080}, {port: 8080}})}, LSN},
+	} {
+		if err := writeFrame(peer, tt.req); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := readFrame(peer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.typ != tt.resp || resp.id != tt.req.id {
+			t.Fatalf("%s: unexpected response %v", tt.name, resp)
+		}
+		if resp.typ == LSN {
+			lports, err := decodePorts(resp.payload)
+			if err != nil || !reflect.DeepEqual(lports, []uint16{8080, 8080}) {
+				t.Fatalf("%s: unexpected listening ports %v, %v", tt.name, lports, err)
+			}
+		}
+	}
+	if forwarded != 1 {
+		t.Fatalf("expected the port to be forwarded once, got %d", forwarded)
+	}
+}
+
+func TestPingDuringSlowFwd(t *testing.T) {
+	a, b := newPipedManagers(t)
+	release := make(chan struct{})
+	b.SetCallbacks(func(port uint16) (uint16, error) {
+		<-release
+		return port, nil
+	}, nil)
+	a.Run()
+	b.Run()
+
+	done := make(chan struct{})
+	go func() {
+		a.UpdatePeerPorts([]uint16{9090})
+		close(done)
+	}()
+	for i := 0; i < 3; i++ {
+		if _, err := a.call(PING, nil, time.Second); err != nil {
+			t.Fatalf("PING is blocked by the FWD: %s", err)
+		}
+	}
+	close(release)
+	<-done
+	if _, peer := a.PortMaps(); peer[9090] != 9090 {
+		t.Fatalf("unexpected peer ports: %v", peer)
+	}
+}
+
+func TestPipelinedResponses(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+	recv, _ := net.Pipe()
+	send, peer := net.Pipe()
+	// Reply the two requests in the reverse order
+	go func() {
+		first, _ := readFrame(peer)
+		second, _ := readFrame(peer)
+		writeFrame(peer, frame{typ: LSN, id: second.id, payload: second.payload})
+		writeFrame(peer, frame{typ: LSN, id: first.id, payload: first.payload})
+	}()
+	m := NewManager(recv, send, logger, func() {})
+	defer m.Shutdown()
+	m.Run()
+
+	results := make(chan error, 2)
+	for _, port := range []uint16{80, 443} {
+		go func(port uint16) {
+			payload := encodePorts([]uint16{port})
+			resp, err := m.call(FWD, payload, time.Second)
+			if err == nil && !reflect.DeepEqual(resp.payload, payload) {
+				err = fmt.Errorf("unexpected response %v to the port %d", resp.payload, port)
+			}
+			results <- err
+		}(port)
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-results; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+	recv, _ := net.Pipe()
+	send, peer := net.Pipe()
+	lateFwd := make(chan frame, 1)
+	go fakePeer(peer, func(req frame) frame {
+		if req.typ == FWD {
+			// Answered after the next request
+			lateFwd <- req
+			req, _ = readFrame(peer)
+			writeFrame(peer, frame{typ: ACK, id: req.id})
+			return frame{typ: LSN, id: (<-lateFwd).id, payload: encodePorts([]uint16{19090})}
+		}
+		return frame{typ: ACK}
+	})
+	shutdown := make(chan struct{})
+	m := NewManager(recv, send, logger, func() { close(shutdown) })
+	defer m.Shutdown()
+	m.Run()
+
+	if _, err := m.call(FWD, encodePorts([]uint16{9090}), 50*time.Millisecond); !errors.Is(err, ErrTimeout) {
+		t.Fatalf("expected ErrTimeout, got %v", err)
+	}
+	// The late response is ignored
+	if _, err := m.call(PING, nil, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.call(PING, nil, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-shutdown:
+		t.Fatal("unexpected shutdown")
+	default:
+	}
+}
+
+func TestConcurrentUpdates(t *testing.T) {
+	a, b := newPipedManagers(t)
+	var mu sync.Mutex
+	listening := make(map[uint16]bool)
+	b.SetCallbacks(func(port uint16) (uint16, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if listening[port] {
+			t.Errorf("port %d is forwarded twice", port)
+		}
+		listening[port] = true
+		return port + 10000, nil
+	}, func(port uint16) error {
+		mu.Lock()
+		defer mu.Unlock()
+		delete(listening, port)
+		return nil
+	})
+	b.SetDumpCallback(func(local, peer map[uint16]uint16) {})
+	a.Run()
+	b.Run()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				ports := make([]uint16, 0, 10)
+				for p := uint16(0); p < 10; p++ {
+					if (int(p)+i+j)%3 != 0 {
+						ports = append(ports, 8000+p)
+					}
+				}
+				a.UpdatePeerPorts(ports)
+			}
+		}(i)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for j := 0; j < 200; j++ {
+			a.PortMaps()
+			b.PortMaps()
+			b.RefreshPorts([]uint16{8000, 8001})
+			b.DumpPorts()
+		}
+	}()
+	wg.Wait()
+
+	a.UpdatePeerPorts([]uint16{8000, 8005})
+	// Wait for the DEL, the requests other than the PINGs are handled in order
+	if _, err := a.call(INF, encodeProcesses(nil), time.Second); err != nil {
+		t.Fatal(err)
+	}
+	_, peer := a.PortMaps()
+	local, _ := b.PortMaps()
+	if want := map[uint16]uint16{8000: 18000, 8005: 18005}; !reflect.DeepEqual(peer, want) || !reflect.DeepEqual(local, want) {
+		t.Fatalf("unexpected port maps: %v, %v, want %v", peer, local, want)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if want := map[uint16]bool{8000: true, 8005: true}; !reflect.DeepEqual(listening, want) {
+		t.Fatalf("unexpected listening ports: %v, want %v", listening, want)
+	}
+}
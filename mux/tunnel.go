@@ -0,0 +1,216 @@
+package mux
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+const tokenLen = 32
+
+// The time to establish the tunnel, including starting the agent
+const handshakeTimeout = 30 * time.Second
+
+var ErrTunnelAuth = errors.New("tunnel authentication failed")
+
+// Tunnel is the ephemeral credentials of an encrypted tunnel (TLS 1.3) between the mux server and client,
+// generated per session by the server. The client is given the Secret, eg. on its command line: it verifies
+// the server by the fingerprint of the certificate, and authenticates itself by the token. The mux runs in
+// the tunnel, so that the stdio of the runtime commands (eg. over DOCKER_HOST=tcp://) can't be read or
+// tampered with.
+type Tunnel struct {
+	cert  tls.Certificate
+	token []byte
+}
+
+func NewTunnel() (*Tunnel, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "apf"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	token := make([]byte, tokenLen)
+	if _, err := rand.Read(token); err != nil {
+		return nil, err
+	}
+	return &Tunnel{
+		cert:  tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key},
+		token: token,
+	}, nil
+}
+
+// Secret returns the secret of the client: {fingerprint of the certificate}.{token} in hex
+func (t *Tunnel) Secret() string {
+	fp := sha256.Sum256(t.cert.Certificate[0])
+	return hex.EncodeToString(fp[:]) + "." + hex.EncodeToString(t.token)
+}
+
+// Server establishes the server side of the tunnel over the reader and writer, eg. the stdout and stdin
+// of the client process.
+func (t *Tunnel) Server(r io.ReadCloser, w io.WriteCloser) (net.Conn, error) {
+	conn := tls.Server(&pipeConn{r: r, w: w}, &tls.Config{
+		Certificates: []tls.Certificate{t.cert},
+		MinVersion:   tls.VersionTLS13,
+	})
+	timer := time.AfterFunc(handshakeTimeout, func() { conn.Close() })
+	defer timer.Stop()
+	if err := conn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	token := make([]byte, tokenLen)
+	if _, err := io.ReadFull(conn, token); err != nil || subtle.ConstantTimeCompare(token, t.token) != 1 {
+		conn.Close()
+		return nil, ErrTunnelAuth
+	}
+	return &tunnelConn{Conn: conn}, nil
+}
+
+// TunnelClient establishes the client side of the tunnel with the secret of the server over the reader
+// and writer, eg. the stdin and stdout.
+func TunnelClient(secret string, r io.ReadCloser, w io.WriteCloser) (net.Conn, error) {
+	splits := strings.SplitN(secret, ".", 2)
+	if len(splits) != 2 {
+		return nil, errors.New("invalid tunnel secret")
+	}
+	fp, err := hex.DecodeString(splits[0])
+	if err != nil || len(fp) != sha256.Size {
+		return nil, errors.New("invalid tunnel secret")
+	}
+	token, err := hex.DecodeString(splits[1])
+	if err != nil || len(token) != tokenLen {
+		return nil, errors.New("invalid tunnel secret")
+	}
+	conn := tls.Client(&pipeConn{r: r, w: w}, &tls.Config{
+		// The certificate is self-signed, it's verified by the fingerprint instead
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return ErrTunnelAuth
+			}
+			got := sha256.Sum256(rawCerts[0])
+			if subtle.ConstantTimeCompare(got[:], fp) != 1 {
+				return ErrTunnelAuth
+			}
+			return nil
+		},
+		MinVersion: tls.VersionTLS13,
+	})
+	timer := time.AfterFunc(handshakeTimeout, func() { conn.Close() })
+	defer timer.Stop()
+	if err := conn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if _, err := conn.Write(token); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &tunnelConn{Conn: conn}, nil
+}
+
+// NewSecureStdioMuxClient is NewStdioMuxClient in the tunnel of the secret
+func NewSecureStdioMuxClient(secret string) (*YAMux, error) {
+	conn, err := TunnelClient(secret, os.Stdin, os.Stdout)
+	if err != nil {
+		return nil, err
+	}
+	ym := NewYAMux(conn, conn, true)
+	if ym == nil {
+		conn.Close()
+		return nil, errors.New("failed to create mux client")
+	}
+	return ym, nil
+}
+
+// NewSecureCmdPipeMuxServer is NewCmdPipeMuxServer in the tunnel, the command is expected to run the
+// client with the secret of the tunnel.
+func NewSecureCmdPipeMuxServer(t *Tunnel, name string, args ...string) (*CmdPipeMuxServer, error) {
+	cmd := exec.Command(name, args...)
+	stdin, _ := cmd.StdinPipe()
+	stdout, _ := cmd.StdoutPipe()
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	conn, err := t.Server(stdout, stdin)
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return nil, fmt.Errorf("failed to establish the tunnel: %s", err)
+	}
+	ym := NewYAMux(conn, conn, false)
+	if ym == nil {
+		conn.Close()
+		cmd.Process.Kill()
+		cmd.Wait()
+		return nil, errors.New("failed to create mux server")
+	}
+	return &CmdPipeMuxServer{YAMux: ym, cmd: cmd}, nil
+}
+
+// tunnelConn is both the reader and writer of the YAMux, it's closed once.
+type tunnelConn struct {
+	net.Conn
+	once sync.Once
+	err  error
+}
+
+func (c *tunnelConn) Close() error {
+	c.once.Do(func() {
+		c.err = c.Conn.Close()
+	})
+	return c.err
+}
+
+// pipeConn makes the pipes a net.Conn for TLS, the deadlines are not supported.
+type pipeConn struct {
+	r io.ReadCloser
+	w io.WriteCloser
+}
+
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "pipe" }
+
+func (c *pipeConn) Read(b []byte) (int, error)  { return c.r.Read(b) }
+func (c *pipeConn) Write(b []byte) (int, error) { return c.w.Write(b) }
+
+func (c *pipeConn) Close() error {
+	werr := c.w.Close()
+	if rerr := c.r.Close(); werr == nil {
+		return rerr
+	}
+	return werr
+}
+
+func (c *pipeConn) LocalAddr() net.Addr                { return pipeAddr{} }
+func (c *pipeConn) RemoteAddr() net.Addr               { return pipeAddr{} }
+func (c *pipeConn) SetDeadline(t time.Time) error      { return nil }
+func (c *pipeConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *pipeConn) SetWriteDeadline(t time.Time) error { return nil }
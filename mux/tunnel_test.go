@@ -0,0 +1,103 @@
+package mux
+
+import (
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestTunnel(t *testing.T) {
+	tunnel, err := NewTunnel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := NewTunnel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		secret string
+		ok     bool
+	}{
+		{"OK", tunnel.Secret(), true},
+		{"Wrong certificate", strings.Split(other.Secret(), ".")[0] + "." + strings.Split(tunnel.Secret(), ".")[1], false},
+		{"Wrong token", strings.Split(tunnel.Secret(), ".")[0] + "." + strings.Split(other.Secret(), ".")[1], false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The OS pipes are buffered like the stdio of the agent, the TLS alerts don't block
+			r1, w1, err := os.Pipe()
+			if err != nil {
+				t.Fatal(err)
+			}
+			r2, w2, err := os.Pipe()
+			if err != nil {
+				t.Fatal(err)
+			}
+			type result struct {
+				ym  *YAMux
+				err error
+			}
+			clientCh := make(chan result, 1)
+			go func() {
+				conn, err := TunnelClient(tt.secret, r1, w2)
+				if err != nil {
+					// Let the server fail as well
+					r1.Close()
+					w2.Close()
+					clientCh <- result{nil, err}
+					return
+				}
+				clientCh <- result{NewYAMux(conn, conn, true), nil}
+			}()
+			conn, err := tunnel.Server(r2, w1)
+			if !tt.ok {
+				if err == nil {
+					t.Fatal("expected the server to fail")
+				}
+				r2.Close()
+				w1.Close()
+				<-clientCh
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			server := NewYAMux(conn, conn, false)
+			defer server.Shutdown()
+			res := <-clientCh
+			if res.err != nil {
+				t.Fatal(res.err)
+			}
+			defer res.ym.Shutdown()
+
+			go func() {
+				stream, err := server.Accept()
+				if err == nil {
+					io.Copy(stream, stream)
+					stream.Close()
+				}
+			}()
+			stream, err := res.ym.Connect()
+			if err != nil {
+				t.Fatal(err)
+			}
+			stream.Write([]byte("ping"))
+			buf := make([]byte, 4)
+			if _, err := io.ReadFull(stream, buf); err != nil || string(buf) != "ping" {
+				t.Fatalf("echo: %q, %v", buf, err)
+			}
+		})
+	}
+}
+
+func TestTunnelClientSecret(t *testing.T) {
+	for _, secret := range []string{"", "abc", "00.00", strings.Repeat("0", 64) + ".zz"} {
+		r, w := io.Pipe()
+		if _, err := TunnelClient(secret, r, w); err == nil {
+			t.Errorf("TunnelClient(%q): expected error", secret)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package portscan
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// lsofListeners lists the TCP listening sockets with lsof, for the platforms without /proc, eg. macOS.
+func lsofListeners() ([]Listener, error) {
+	out, err := exec.Command("lsof", "-nP", "-iTCP", "-sTCP:LISTEN", "-F", "un").Output()
+	// lsof exits with 1 if nothing is found
+	if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 && len(out) == 0 {
+		return []Listener{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return parseLsof(bytes.NewReader(out)), nil
+}
+
+// parseLsof parses the field output of lsof (-F un): a "p" line per process, followed by its "u" (uid)
+// line and a "f" line per file with its "n" (name) line, eg. "n127.0.0.1:8080" or "n[::1]:5432".
+func parseLsof(r io.Reader) []Listener {
+	listeners := make([]Listener, 0, 10)
+	var uid uint32
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if len(line) < 2 {
+			continue
+		}
+		switch line[0] {
+		case 'p':
+			uid = 0
+		case 'u':
+			if u, err := strconv.ParseUint(line[1:], 10, 32); err == nil {
+				uid = uint32(u)
+			}
+		case 'n':
+			i := strings.LastIndex(line, ":")
+			if i < 0 {
+				continue
+			}
+			port, err := strconv.ParseUint(line[i+1:], 10, 16)
+			if err != nil {
+				continue
+			}
+			listeners = append(listeners, Listener{Proto: TCP, Port: uint16(port), UID: uid})
+		}
+	}
+	return listeners
+}
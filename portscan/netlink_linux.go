@@ -0,0 +1,142 @@
+package portscan
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"syscall"
+	"unsafe"
+)
+
+// The NETLINK_SOCK_DIAG interface asks the kernel for the sockets in the given states only, so that
+// the cost doesn't grow with the established connections. See `man 7 sock_diag`.
+const (
+	NETLINK_SOCK_DIAG   = 4  // aka. NETLINK_INET_DIAG
+	SOCK_DIAG_BY_FAMILY = 20 // the message type of inet_diag_req_v2
+
+	TCP_ESTABLISHED = 1
+	TCP_CLOSE       = 7 // the state of the unconnected UDP sockets
+	TCP_LISTEN      = 10
+
+	sizeofInetDiagReqV2 = 56
+	sizeofInetDiagMsg   = 72
+)
+
+var nativeEndian binary.ByteOrder = binary.LittleEndian
+
+func init() {
+	x := uint16(1)
+	if *(*byte)(unsafe.Pointer(&x)) == 0 {
+		nativeEndian = binary.BigEndian
+	}
+}
+
+// netlinkListeners returns the listening TCP sockets and the unconnected UDP sockets, IPv4 and IPv6.
+func netlinkListeners() ([]Listener, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, NETLINK_SOCK_DIAG)
+	if err != nil {
+		return nil, err
+	}
+	defer syscall.Close(fd)
+	if err := syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return nil, err
+	}
+
+	listeners := make([]Listener, 0, 10)
+	seq := uint32(0)
+	for _, family := range []uint8{syscall.AF_INET, syscall.AF_INET6} {
+		for _, proto := range []uint8{syscall.IPPROTO_TCP, syscall.IPPROTO_UDP} {
+			seq++
+			found, err := sockDiag(fd, seq, family, proto)
+			if err != nil {
+				return nil, err
+			}
+			listeners = append(listeners, found...)
+		}
+	}
+	return listeners, nil
+}
+
+func sockDiag(fd int, seq uint32, family, proto uint8) ([]Listener, error) {
+	states := uint32(1 << TCP_LISTEN)
+	if proto == syscall.IPPROTO_UDP {
+		states = 1 << TCP_CLOSE
+	}
+	// struct nlmsghdr + struct inet_diag_req_v2, the socket id is left zero for the dump
+	req := make([]byte, syscall.NLMSG_HDRLEN+sizeofInetDiagReqV2)
+	nativeEndian.PutUint32(req[0:4], uint32(len(req)))
+	nativeEndian.PutUint16(req[4:6], SOCK_DIAG_BY_FAMILY)
+	nativeEndian.PutUint16(req[6:8], syscall.NLM_F_REQUEST|syscall.NLM_F_DUMP)
+	nativeEndian.PutUint32(req[8:12], seq)
+	body := req[syscall.NLMSG_HDRLEN:]
+	body[0] = family
+	body[1] = proto
+	nativeEndian.PutUint32(body[4:8], states)
+	if err := syscall.Sendto(fd, req, 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return nil, err
+	}
+
+	listeners := make([]Listener, 0, 10)
+	buf := make([]byte, 32*1024)
+	for {
+		n, _, err := syscall.Recvfrom(fd, buf, 0)
+		if err != nil {
+			return nil, err
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return nil, err
+		}
+		for _, msg := range msgs {
+			if msg.Header.Seq != seq {
+				continue
+			}
+			switch msg.Header.Type {
+			case syscall.NLMSG_DONE:
+				return listeners, nil
+			case syscall.NLMSG_ERROR:
+				if len(msg.Data) >= 4 {
+					if errno := int32(nativeEndian.Uint32(msg.Data[0:4])); errno != 0 {
+						return nil, syscall.Errno(-errno)
+					}
+				}
+				return nil, errors.New("sock_diag: error message")
+			case SOCK_DIAG_BY_FAMILY:
+				l, ok, err := parseInetDiagMsg(msg.Data, proto)
+				if err != nil {
+					return nil, err
+				}
+				if ok {
+					listeners = append(listeners, l)
+				}
+			}
+		}
+	}
+}
+
+// parseInetDiagMsg parses struct inet_diag_msg, the connected UDP sockets are skipped.
+func parseInetDiagMsg(b []byte, proto uint8) (l Listener, ok bool, err error) {
+	if len(b) < sizeofInetDiagMsg {
+		return l, false, fmt.Errorf("sock_diag: short message: %d bytes", len(b))
+	}
+	// struct inet_diag_sockid starts at offset 4: sport(be16), dport(be16), src[16], dst[16], if, cookie[2]
+	sport := binary.BigEndian.Uint16(b[4:6])
+	dport := binary.BigEndian.Uint16(b[6:8])
+	if dport != 0 {
+		return l, false, nil
+	}
+	l = Listener{
+		Proto: protoName(proto),
+		Port:  sport,
+		UID:   nativeEndian.Uint32(b[64:68]),
+		Inode: uint64(nativeEndian.Uint32(b[68:72])),
+	}
+	return l, true, nil
+}
+
+func protoName(proto uint8) string {
+	if proto == syscall.IPPROTO_UDP {
+		return UDP
+	}
+	return TCP
+}
@@ -0,0 +1,51 @@
+package portscan
+
+import (
+	"net"
+	"testing"
+)
+
+func Test_netlinkListeners(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	u, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer u.Close()
+	// An established connection should not be reported
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	listeners, err := netlinkListeners()
+	if err != nil {
+		t.Skipf("sock_diag is unavailable: %s", err)
+	}
+	want := map[Listener]bool{
+		{Proto: TCP, Port: uint16(l.Addr().(*net.TCPAddr).Port)}:      false,
+		{Proto: UDP, Port: uint16(u.LocalAddr().(*net.UDPAddr).Port)}: false,
+	}
+	for _, found := range listeners {
+		if found.Port == uint16(c.LocalAddr().(*net.TCPAddr).Port) {
+			t.Errorf("established socket reported: %v", found)
+		}
+		k := Listener{Proto: found.Proto, Port: found.Port}
+		if _, ok := want[k]; ok {
+			want[k] = true
+			if found.Inode == 0 {
+				t.Errorf("inode missing: %v", found)
+			}
+		}
+	}
+	for k, found := range want {
+		if !found {
+			t.Errorf("listener not found: %v", k)
+		}
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package portscan
+
+// netlinkListeners is only available on Linux, the agent runs in Linux containers anyway. The other
+// platforms (eg. apf on macOS discovering the local listeners) ask lsof instead.
+func netlinkListeners() ([]Listener, error) {
+	return lsofListeners()
+}
@@ -0,0 +1,49 @@
+package portscan
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// PortRange is an inclusive range of ports, eg. 3000-3999, or a single port
+type PortRange struct {
+	Min, Max uint16
+}
+
+func ParsePortRange(s string) (PortRange, error) {
+	lo, hi := s, s
+	if i := strings.Index(s, "-"); i >= 0 {
+		lo, hi = s[:i], s[i+1:]
+	}
+	min, err1 := strconv.ParseUint(strings.TrimSpace(lo), 10, 16)
+	max, err2 := strconv.ParseUint(strings.TrimSpace(hi), 10, 16)
+	if err1 != nil || err2 != nil || min == 0 || min > max {
+		return PortRange{}, fmt.Errorf("invalid port range: %s", s)
+	}
+	return PortRange{Min: uint16(min), Max: uint16(max)}, nil
+}
+
+// ParsePortRanges parses the port ranges, eg. ["3000-3999", "8080"]
+func ParsePortRanges(specs []string) ([]PortRange, error) {
+	ranges := make([]PortRange, 0, len(specs))
+	for _, spec := range specs {
+		r, err := ParsePortRange(spec)
+		if err != nil {
+			return nil, err
+		}
+		ranges = append(ranges, r)
+	}
+	return ranges, nil
+}
+
+func (r PortRange) Contains(port uint16) bool {
+	return port >= r.Min && port <= r.Max
+}
+
+func (r PortRange) String() string {
+	if r.Min == r.Max {
+		return strconv.Itoa(int(r.Min))
+	}
+	return fmt.Sprintf("%d-%d", r.Min, r.Max)
+}
@@ -0,0 +1,100 @@
+package portscan
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const PROC = "/proc"
+
+// Process is the owner of a listening socket
+type Process struct {
+	PID     uint32
+	UID     uint32
+	Name    string // /proc/{pid}/comm
+	Command string // /proc/{pid}/cmdline, the arguments are joined with spaces
+}
+
+// String returns the command line of the process, or its name if the command line is not available.
+func (p Process) String() string {
+	if p.Command != "" {
+		return p.Command
+	}
+	return p.Name
+}
+
+// FindProcesses maps the listening sockets to their owning processes by scanning the file
+// descriptors of all the processes, a socket fd is a symlink to "socket:[{inode}]".
+// The listeners whose owners can not be found (eg. no permission) are omitted.
+func FindProcesses(listeners []Listener) map[uint16]Process {
+	return findProcesses(PROC, listeners)
+}
+
+func findProcesses(procRoot string, listeners []Listener) map[uint16]Process {
+	inodes := make(map[uint64]Listener)
+	for _, l := range listeners {
+		// The procs are keyed by the forwarded (TCP) ports
+		if l.Inode != 0 && l.Proto != UDP {
+			inodes[l.Inode] = l
+		}
+	}
+	procs := make(map[uint16]Process)
+	if len(inodes) == 0 {
+		return procs
+	}
+
+	entries, err := os.ReadDir(procRoot)
+	if err != nil {
+		return procs
+	}
+	for _, entry := range entries {
+		pid, err := strconv.ParseUint(entry.Name(), 10, 32)
+		if err != nil {
+			continue
+		}
+		fdDir := filepath.Join(procRoot, entry.Name(), "fd")
+		fds, err := os.ReadDir(fdDir)
+		if err != nil {
+			continue
+		}
+		for _, fd := range fds {
+			link, err := os.Readlink(filepath.Join(fdDir, fd.Name()))
+			if err != nil || !strings.HasPrefix(link, "socket:[") {
+				continue
+			}
+			var inode uint64
+			if _, err := fmt.Sscanf(link, "socket:[%d]", &inode); err != nil {
+				continue
+			}
+			l, ok := inodes[inode]
+			if !ok {
+				continue
+			}
+			if _, found := procs[l.Port]; found {
+				continue
+			}
+			procs[l.Port] = readProcess(procRoot, uint32(pid), l.UID)
+		}
+		if len(procs) == len(inodes) {
+			break
+		}
+	}
+	return procs
+}
+
+func readProcess(procRoot string, pid, uid uint32) Process {
+	p := Process{PID: pid, UID: uid}
+	dir := filepath.Join(procRoot, strconv.FormatUint(uint64(pid), 10))
+	if comm, err := os.ReadFile(filepath.Join(dir, "comm")); err == nil {
+		p.Name = strings.TrimSpace(string(comm))
+	}
+	if cmdline, err := os.ReadFile(filepath.Join(dir, "cmdline")); err == nil {
+		args := bytes.Split(bytes.TrimRight(cmdline, "\x00"), []byte{0})
+		p.Command = string(bytes.TrimSpace(bytes.Join(args, []byte(" "))))
+	}
+	return p
+}
@@ -0,0 +1,42 @@
+package portscan
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func Test_findProcesses(t *testing.T) {
+	root := t.TempDir()
+	mkproc := func(pid, comm, cmdline string, sockets ...string) {
+		fdDir := filepath.Join(root, pid, "fd")
+		if err := os.MkdirAll(fdDir, 0700); err != nil {
+			t.Fatal(err)
+		}
+		os.WriteFile(filepath.Join(root, pid, "comm"), []byte(comm+"\n"), 0600)
+		os.WriteFile(filepath.Join(root, pid, "cmdline"), []byte(cmdline), 0600)
+		os.Symlink("/dev/null", filepath.Join(fdDir, "0"))
+		for i, s := range sockets {
+			os.Symlink(s, filepath.Join(fdDir, string(rune('3'+i))))
+		}
+	}
+	mkproc("1", "sh", "sh\x00")
+	mkproc("42", "node", "node\x00server.js\x00", "socket:[1001]", "pipe:[7]")
+	mkproc("43", "redis-server", "redis-server *:6379\x00", "socket:[1002]", "socket:[1003]")
+	os.MkdirAll(filepath.Join(root, "self"), 0700)
+
+	listeners := []Listener{
+		{Port: 8080, UID: 1000, Inode: 1001},
+		{Port: 6379, UID: 999, Inode: 1002},
+		{Port: 6379, UID: 999, Inode: 1003}, // IPv6
+		{Port: 9000, UID: 0, Inode: 2000},   // unknown owner
+	}
+	want := map[uint16]Process{
+		8080: {PID: 42, UID: 1000, Name: "node", Command: "node server.js"},
+		6379: {PID: 43, UID: 999, Name: "redis-server", Command: "redis-server *:6379"},
+	}
+	if got := findProcesses(root, listeners); !reflect.DeepEqual(got, want) {
+		t.Errorf("findProcesses() = %v, want %v", got, want)
+	}
+}
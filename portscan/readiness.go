@@ -0,0 +1,307 @@
+package portscan
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultProbeTimeout = 1 * time.Second
+	maxProbeBackoff     = 8 * time.Second // the max interval to re-probe a port that isn't ready
+)
+
+// Prober checks if the listening port is ready to serve, the probes are made to 127.0.0.1, the same as
+// the forwarded connections.
+type Prober interface {
+	Probe(port uint16) error
+}
+
+// TCPProber is ready when the port accepts a connection
+type TCPProber struct {
+	Timeout time.Duration
+}
+
+func (p *TCPProber) Probe(port uint16) error {
+	conn, err := net.DialTimeout("tcp", fmt.Sprintf("127.0.0.1:%d", port), p.Timeout)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// HTTPProber is ready when a GET of the path gets a response that is not a server error
+type HTTPProber struct {
+	Path    string
+	Timeout time.Duration
+}
+
+func (p *HTTPProber) Probe(port uint16) error {
+	client := &http.Client{
+		Timeout: p.Timeout,
+		// A redirect is a response as well
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	resp, err := client.Get(fmt.Sprintf("http://127.0.0.1:%d%s", port, p.Path))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("http status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// CommandProber is ready when the command exits with 0, the port is given in the APF_PORT environment variable
+type CommandProber struct {
+	Command string
+	Timeout time.Duration
+}
+
+func (p *CommandProber) Probe(port uint16) error {
+	ctx, cancel := context.WithTimeout(context.Background(), p.Timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", p.Command)
+	cmd.Env = append(os.Environ(), fmt.Sprintf("APF_PORT=%d", port))
+	return cmd.Run()
+}
+
+// ParseProber parses the probe spec:
+//   - tcp: connect to the port
+//   - http[:{path}]: GET the path, / by default
+//   - exec:{command}: run the shell command
+func ParseProber(spec string) (Prober, error) {
+	kind, arg := spec, ""
+	if i := strings.Index(spec, ":"); i >= 0 {
+		kind, arg = spec[:i], spec[i+1:]
+	}
+	switch kind {
+	case "tcp":
+		if arg != "" {
+			break
+		}
+		return &TCPProber{Timeout: DefaultProbeTimeout}, nil
+	case "http":
+		if arg == "" {
+			arg = "/"
+		}
+		if !strings.HasPrefix(arg, "/") {
+			break
+		}
+		return &HTTPProber{Path: arg, Timeout: DefaultProbeTimeout}, nil
+	case "exec":
+		if arg == "" {
+			break
+		}
+		return &CommandProber{Command: arg, Timeout: 5 * DefaultProbeTimeout}, nil
+	}
+	return nil, errors.New("invalid probe (tcp, http[:{path}] or exec:{command}): " + spec)
+}
+
+// ReadinessGate sits between the scanner and the manager: a new port is only passed on after it has been
+// listened for the debounce period and it passes the probe, and a closed port is only withdrawn after it
+// has been gone for the debounce period. So the ports that bind early or flap don't make the peer create
+// and destroy the listeners repeatedly. The ports are probed concurrently, a port that isn't ready is
+// re-probed with backoff.
+type ReadinessGate struct {
+	Prober   Prober        // optional
+	Debounce time.Duration // optional
+	Interval time.Duration // the interval to re-check the pending ports, DefaultMinInterval if zero
+
+	now        func() time.Time
+	current    map[uint16]Listener // the latest TCP listeners from the scanner
+	others     []Listener          // not gated, eg. UDP
+	seen       map[uint16]time.Time
+	gone       map[uint16]time.Time
+	advertised map[uint16]Listener
+	probing    map[uint16]bool          // the ports being probed
+	ready      map[uint16]bool          // the ports passed the probe
+	backoff    map[uint16]time.Duration // the ports failed the probe => the interval to re-probe
+	nextProbe  map[uint16]time.Time
+	results    chan probeResult
+	done       chan struct{}
+}
+
+type probeResult struct {
+	port uint16
+	err  error
+}
+
+// Run gates the listeners from the scanner until the in channel is closed.
+func (g *ReadinessGate) Run(in <-chan []Listener, out chan<- []Listener) {
+	g.init()
+	defer close(g.done)
+	tick := time.NewTicker(g.interval())
+	defer tick.Stop()
+	var prev []Listener
+	for {
+		select {
+		case listeners, ok := <-in:
+			if !ok {
+				return
+			}
+			g.update(listeners)
+		case r := <-g.results:
+			g.probed(r)
+		case <-tick.C:
+			if !g.pending() {
+				continue
+			}
+		}
+		if current := g.check(); prev == nil || listenersChanged(prev, current) {
+			prev = current
+			out <- current
+		}
+	}
+}
+
+func (g *ReadinessGate) init() {
+	if g.now == nil {
+		g.now = time.Now
+	}
+	g.current = make(map[uint16]Listener)
+	g.seen = make(map[uint16]time.Time)
+	g.gone = make(map[uint16]time.Time)
+	g.advertised = make(map[uint16]Listener)
+	g.probing = make(map[uint16]bool)
+	g.ready = make(map[uint16]bool)
+	g.backoff = make(map[uint16]time.Duration)
+	g.nextProbe = make(map[uint16]time.Time)
+	g.results = make(chan probeResult)
+	g.done = make(chan struct{})
+}
+
+func (g *ReadinessGate) interval() time.Duration {
+	if g.Interval <= 0 {
+		return DefaultMinInterval
+	}
+	return g.Interval
+}
+
+// update records the listeners from the scanner
+func (g *ReadinessGate) update(listeners []Listener) {
+	now := g.now()
+	g.current = make(map[uint16]Listener)
+	g.others = make([]Listener, 0)
+	for _, l := range listeners {
+		if l.Proto != TCP {
+			g.others = append(g.others, l)
+			continue
+		}
+		// One listener per port is enough, pick the same one among the IPv4 / IPv6 / SO_REUSEPORT sockets
+		if cur, ok := g.current[l.Port]; ok && cur.Inode < l.Inode {
+			continue
+		}
+		g.current[l.Port] = l
+		if _, ok := g.seen[l.Port]; !ok {
+			g.seen[l.Port] = now
+		}
+		delete(g.gone, l.Port)
+	}
+	for port := range g.seen {
+		if _, ok := g.current[port]; !ok {
+			delete(g.seen, port)
+			delete(g.ready, port)
+			delete(g.backoff, port)
+			delete(g.nextProbe, port)
+		}
+	}
+	for port := range g.advertised {
+		if _, ok := g.current[port]; !ok {
+			if _, ok := g.gone[port]; !ok {
+				g.gone[port] = now
+			}
+		}
+	}
+}
+
+// pending returns true if some ports are waiting to be advertised or withdrawn
+func (g *ReadinessGate) pending() bool {
+	if len(g.gone) > 0 {
+		return true
+	}
+	for port := range g.current {
+		if _, ok := g.advertised[port]; !ok {
+			return true
+		}
+	}
+	return false
+}
+
+// check advertises the ready ports and withdraws the gone ports, it returns the advertised listeners.
+func (g *ReadinessGate) check() []Listener {
+	now := g.now()
+	for port, since := range g.gone {
+		if now.Sub(since) >= g.Debounce {
+			delete(g.gone, port)
+			delete(g.advertised, port)
+		}
+	}
+	for port, l := range g.current {
+		if _, ok := g.advertised[port]; ok {
+			g.advertised[port] = l // the socket may be re-listened, eg. SO_REUSEPORT workers
+			continue
+		}
+		if now.Sub(g.seen[port]) < g.Debounce {
+			continue
+		}
+		if g.Prober != nil && !g.ready[port] {
+			g.probe(port, now)
+			continue
+		}
+		g.advertised[port] = l
+	}
+	listeners := make([]Listener, 0, len(g.advertised)+len(g.others))
+	for _, l := range g.advertised {
+		listeners = append(listeners, l)
+	}
+	return append(listeners, g.others...)
+}
+
+// probe starts probing the port in the background unless it's being probed or backing off, the result
+// is sent back to the loop of Run.
+func (g *ReadinessGate) probe(port uint16, now time.Time) {
+	if g.probing[port] || now.Before(g.nextProbe[port]) {
+		return
+	}
+	g.probing[port] = true
+	go func() {
+		r := probeResult{port: port, err: g.Prober.Probe(port)}
+		select {
+		case g.results <- r:
+		case <-g.done:
+		}
+	}()
+}
+
+// probed records the result of the probe, the port is advertised on the next check if it's ready.
+func (g *ReadinessGate) probed(r probeResult) {
+	delete(g.probing, r.port)
+	if _, ok := g.current[r.port]; !ok {
+		return
+	}
+	if r.err == nil {
+		g.ready[r.port] = true
+		delete(g.backoff, r.port)
+		delete(g.nextProbe, r.port)
+		return
+	}
+	backoff := g.backoff[r.port] * 2
+	if backoff == 0 {
+		backoff = g.interval()
+	}
+	if backoff > maxProbeBackoff {
+		backoff = maxProbeBackoff
+	}
+	g.backoff[r.port] = backoff
+	g.nextProbe[r.port] = g.now().Add(backoff)
+}
@@ -0,0 +1,143 @@
+package portscan
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+type fakeProber map[uint16]bool
+
+func (f fakeProber) Probe(port uint16) error {
+	if !f[port] {
+		return errors.New("not ready")
+	}
+	return nil
+}
+
+func advertisedPorts(listeners []Listener) []uint16 {
+	ports := Ports(listeners)
+	sort.Slice(ports, func(i, j int) bool { return ports[i] < ports[j] })
+	return ports
+}
+
+// checkProbed checks the gate after the probes started by the check are done
+func checkProbed(g *ReadinessGate) []Listener {
+	g.check()
+	for len(g.probing) > 0 {
+		g.probed(<-g.results)
+	}
+	return g.check()
+}
+
+func TestReadinessGate(t *testing.T) {
+	now := time.Unix(0, 0)
+	ready := fakeProber{80: true}
+	g := &ReadinessGate{Prober: ready, Debounce: 2 * time.Second}
+	g.init()
+	g.now = func() time.Time { return now }
+
+	steps := []struct {
+		name      string
+		elapse    time.Duration
+		listeners []Listener // nil: no update from the scanner
+		want      []uint16
+	}{
+		{"New ports are debounced", 0, []Listener{{Proto: TCP, Port: 80, Inode: 1}, {Proto: TCP, Port: 8080, Inode: 2}}, []uint16{}},
+		{"Only the ready port after debounce", 2 * time.Second, nil, []uint16{80}},
+		{"A closed port is kept during debounce", time.Second, []Listener{{Proto: TCP, Port: 8080, Inode: 2}}, []uint16{80}},
+		{"The port is back", time.Second, []Listener{{Proto: TCP, Port: 80, Inode: 3}, {Proto: TCP, Port: 8080, Inode: 2}}, []uint16{80}},
+		{"Closed again", time.Second, []Listener{{Proto: TCP, Port: 8080, Inode: 2}}, []uint16{80}},
+		{"Withdrawn after debounce", 2 * time.Second, nil, []uint16{}},
+	}
+	for _, step := range steps {
+		now = now.Add(step.elapse)
+		if step.listeners != nil {
+			g.update(step.listeners)
+		}
+		got := advertisedPorts(checkProbed(g))
+		if !reflect.DeepEqual(got, step.want) {
+			t.Fatalf("%s: advertised %v, want %v", step.name, got, step.want)
+		}
+	}
+
+	// 8080 gets ready, it's re-probed after the backoff
+	ready[8080] = true
+	if got := advertisedPorts(checkProbed(g)); len(got) != 0 {
+		t.Fatalf("advertised %v during the backoff", got)
+	}
+	now = now.Add(maxProbeBackoff)
+	if got := advertisedPorts(checkProbed(g)); !reflect.DeepEqual(got, []uint16{8080}) {
+		t.Fatalf("advertised %v, want [8080]", got)
+	}
+}
+
+func TestReadinessGateBackoff(t *testing.T) {
+	now := time.Unix(0, 0)
+	probes := 0
+	g := &ReadinessGate{Prober: proberFunc(func(port uint16) error {
+		probes++
+		return errors.New("not ready")
+	}), Interval: time.Second}
+	g.init()
+	g.now = func() time.Time { return now }
+	g.update([]Listener{{Proto: TCP, Port: 8080, Inode: 1}})
+
+	// Probed at 0s, 1s, 3s, 7s, 15s, 23s
+	for i := 0; i < 24; i++ {
+		checkProbed(g)
+		now = now.Add(time.Second)
+	}
+	if probes != 6 {
+		t.Fatalf("probed %d times, want 6", probes)
+	}
+}
+
+type proberFunc func(port uint16) error
+
+func (f proberFunc) Probe(port uint16) error {
+	return f(port)
+}
+
+func TestReadinessGateConcurrentProbes(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	g := &ReadinessGate{Prober: proberFunc(func(port uint16) error {
+		if port == 8080 {
+			<-release // a slow probe
+		}
+		return nil
+	}), Interval: 10 * time.Millisecond}
+	in := make(chan []Listener)
+	out := make(chan []Listener)
+	go g.Run(in, out)
+	defer close(in)
+
+	in <- []Listener{{Proto: TCP, Port: 8080, Inode: 1}, {Proto: TCP, Port: 80, Inode: 2}}
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case listeners := <-out:
+			if got := advertisedPorts(listeners); reflect.DeepEqual(got, []uint16{80}) {
+				return
+			}
+		case <-timeout:
+			t.Fatal("the ready port is blocked by the slow probe")
+		}
+	}
+}
+
+func TestParseProber(t *testing.T) {
+	for _, spec := range []string{"tcp", "http", "http:/healthz", "exec:curl -f localhost:$APF_PORT"} {
+		if _, err := ParseProber(spec); err != nil {
+			t.Errorf("ParseProber(%q): %s", spec, err)
+		}
+	}
+	for _, spec := range []string{"", "udp", "tcp:80", "http:healthz", "exec:"} {
+		if _, err := ParseProber(spec); err == nil {
+			t.Errorf("ParseProber(%q): expected error", spec)
+		}
+	}
+}
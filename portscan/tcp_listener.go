@@ -7,6 +7,7 @@ import (
 	"io"
 	"os"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -19,47 +20,100 @@ import (
 //   2: 00000000:0050 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 86197589 1 0000000000000000 100 0 0 10 0
 // What we want to get is the `local_address` of those line that has `st` == `0A`.
 // the `0A` is the TCP_LISTEN state of a TCP socket, see `/include/net/tcp_states.h` in kernel source.
+// /proc/net/udp{,6} has the same format, the unconnected UDP sockets are in the `07` (TCP_CLOSE) state.
+//
+// The proc files are the fallback of the NETLINK_SOCK_DIAG scanner, which is much cheaper as the kernel
+// only returns the sockets in the requested states.
 const (
 	PROC_TCP  = "/proc/net/tcp"
 	PROC_TCP6 = "/proc/net/tcp6"
+	PROC_UDP  = "/proc/net/udp"
+	PROC_UDP6 = "/proc/net/udp6"
 )
 
-type TCPListenerScanner struct{}
+const (
+	TCP = "tcp"
+	UDP = "udp"
+)
+
+const (
+	DefaultMinInterval = 250 * time.Millisecond
+	DefaultMaxInterval = 4 * time.Second
+)
+
+// TCPListenerScanner polls the listening sockets adaptively: fast right after a change, and backing
+// off exponentially while the listeners are stable.
+type TCPListenerScanner struct {
+	MinInterval time.Duration   // the interval right after a change, DefaultMinInterval if zero
+	MaxInterval time.Duration   // the interval to back off up to, DefaultMaxInterval if zero
+	Trigger     <-chan struct{} // optional, scan soon when notified, eg. by the TracepointTrigger
+	Done        <-chan struct{} // optional, stop scanning when closed
+	procOnly    bool            // netlink is unavailable, eg. not permitted by seccomp
+}
+
+// Listener is a listening TCP socket or an unconnected UDP socket
+type Listener struct {
+	Proto string // tcp or udp
+	Port  uint16
+	UID   uint32
+	Inode uint64
+}
 
 func parseProcNetTcp(f io.Reader) []uint16 {
-	ports := make([]uint16, 0, 10)
+	listeners := parseProcNet(f, TCP)
+	ports := make([]uint16, 0, len(listeners))
+	for _, l := range listeners {
+		ports = append(ports, l.Port)
+	}
+	return ports
+}
+
+// parseProcNet parses /proc/net/{tcp,udp}{,6}, only the listening sockets are returned. NB: the listening
+// sockets are not necessarily listed first, the established ones may come in between.
+func parseProcNet(f io.Reader, proto string) []Listener {
+	listeners := make([]Listener, 0, 10)
 	scanner := bufio.NewScanner(f)
 	scanner.Scan() // skip first line
 	for scanner.Scan() {
-		segments := strings.SplitN(strings.TrimSpace(scanner.Text()), " ", 5)
+		segments := strings.Fields(scanner.Text())
+		if len(segments) < 10 {
+			continue
+		}
 		st := segments[3]
-		if st != "0A" {
-			break
+		if proto == TCP && st != "0A" {
+			continue
+		}
+		if proto == UDP && (st != "07" || !strings.HasSuffix(segments[2], ":0000")) {
+			continue
 		}
 		portStr := strings.SplitN(segments[1], ":", 2)[1]
 		buf, _ := hex.DecodeString(portStr)
-		port := binary.BigEndian.Uint16(buf)
-		ports = append(ports, port)
+		if len(buf) != 2 {
+			continue
+		}
+		uid, _ := strconv.ParseUint(segments[7], 10, 32)
+		inode, _ := strconv.ParseUint(segments[9], 10, 64)
+		listeners = append(listeners, Listener{
+			Proto: proto,
+			Port:  binary.BigEndian.Uint16(buf),
+			UID:   uint32(uid),
+			Inode: inode,
+		})
 	}
-	return ports
+	return listeners
 }
 
-func portsChanged(a, b []uint16) bool {
-	if len(a) != len(b) {
-		return true
-	}
-	sort.SliceStable(a, func(i, j int) bool {
-		return a[i] < a[j]
-	})
-	sort.SliceStable(b, func(i, j int) bool {
-		return b[i] < b[j]
-	})
-	for i := range a {
-		if a[i] != b[i] {
-			return true
+func procListeners() []Listener {
+	listeners := make([]Listener, 0, 10)
+	for path, proto := range map[string]string{PROC_TCP: TCP, PROC_TCP6: TCP, PROC_UDP: UDP, PROC_UDP6: UDP} {
+		f, err := os.Open(path)
+		if err != nil {
+			continue
 		}
+		listeners = append(listeners, parseProcNet(f, proto)...)
+		f.Close()
 	}
-	return false
+	return listeners
 }
 
 func mergePorts(portsV4, portsV6 []uint16) []uint16 {
@@ -77,25 +131,127 @@ func mergePorts(portsV4, portsV6 []uint16) []uint16 {
 }
 
 func (t *TCPListenerScanner) Parse() []uint16 {
-	f, _ := os.Open(PROC_TCP)
-	defer f.Close()
-	f2, _ := os.Open(PROC_TCP6)
-	defer f2.Close()
-	ports := parseProcNetTcp(f)
-	ports2 := parseProcNetTcp(f2)
-	return mergePorts(ports, ports2)
+	return Ports(t.Listeners())
+}
+
+// Listeners returns the listening sockets, a port may be listened by multiple sockets (eg. IPv4 and IPv6).
+// It asks the kernel via NETLINK_SOCK_DIAG, and falls back to the proc files if netlink is unavailable.
+func (t *TCPListenerScanner) Listeners() []Listener {
+	if !t.procOnly {
+		listeners, err := netlinkListeners()
+		if err == nil {
+			return listeners
+		}
+		t.procOnly = true
+	}
+	return procListeners()
+}
+
+// Ports returns the deduplicated and sorted TCP ports of the listeners, which are the ones to be forwarded
+func Ports(listeners []Listener) []uint16 {
+	ports := make([]uint16, 0, len(listeners))
+	for _, l := range listeners {
+		if l.Proto == TCP {
+			ports = append(ports, l.Port)
+		}
+	}
+	return mergePorts(ports, nil)
+}
+
+// listenersChanged compares the TCP listeners only. The unconnected UDP sockets come and go with the
+// short-lived clients (eg. the DNS lookups), they would keep the scanner from backing off.
+func listenersChanged(a, b []Listener) bool {
+	set := make(map[Listener]bool)
+	for _, l := range a {
+		if l.Proto == TCP {
+			set[l] = true
+		}
+	}
+	n := 0
+	for _, l := range b {
+		if l.Proto != TCP {
+			continue
+		}
+		if !set[l] {
+			return true
+		}
+		n++
+	}
+	return n != len(set)
+}
+
+func (t *TCPListenerScanner) intervals() (min, max time.Duration) {
+	min, max = t.MinInterval, t.MaxInterval
+	if min <= 0 {
+		min = DefaultMinInterval
+	}
+	if max <= 0 {
+		max = DefaultMaxInterval
+	}
+	if max < min {
+		max = min
+	}
+	return min, max
 }
 
-func (t *TCPListenerScanner) Run(emit chan<- []uint16) {
-	tick := time.NewTicker(1 * time.Second)
-	prev := t.Parse()
-	emit <- prev
-	for range tick.C {
-		current := t.Parse()
-		if portsChanged(prev, current) {
-			prev = make([]uint16, len(current))
-			copy(prev, current)
-			emit <- current
+// nextInterval resets the interval to min after a change, otherwise doubles it up to max.
+func nextInterval(cur, min, max time.Duration, changed bool) time.Duration {
+	if changed {
+		return min
+	}
+	cur *= 2
+	if cur > max {
+		cur = max
+	}
+	return cur
+}
+
+// Run emits the listeners whenever the TCP listeners change, including a port being re-listened by
+// another socket (eg. the process is restarted), until Done is closed.
+func (t *TCPListenerScanner) Run(emit chan<- []Listener) {
+	min, max := t.intervals()
+	interval := min
+	deadline := time.Now().Add(interval)
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+	prev := t.Listeners()
+	select {
+	case emit <- prev:
+	case <-t.Done:
+		return
+	}
+	for {
+		select {
+		case <-t.Done:
+			return
+		case <-timer.C:
+		case <-t.Trigger:
+			// Bring the next scan forward, but no sooner than the min interval, so that a burst of
+			// triggers doesn't turn into a busy loop
+			if time.Until(deadline) > min {
+				timer.Stop()
+				select {
+				case <-timer.C:
+				default:
+				}
+				interval = min
+				deadline = time.Now().Add(interval)
+				timer.Reset(interval)
+			}
+			continue
+		}
+		current := t.Listeners()
+		changed := listenersChanged(prev, current)
+		if changed {
+			prev = current
+			select {
+			case emit <- current:
+			case <-t.Done:
+				return
+			}
 		}
+		interval = nextInterval(interval, min, max, changed)
+		deadline = time.Now().Add(interval)
+		timer.Reset(interval)
 	}
 }
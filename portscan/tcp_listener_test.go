@@ -4,6 +4,7 @@ import (
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 )
 
 const content = `sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
@@ -47,3 +48,121 @@ func Test_mergePorts(t *testing.T) {
 		})
 	}
 }
+
+func Test_parseProcNetListeners(t *testing.T) {
+	f := strings.NewReader(content)
+	listeners := parseProcNet(f, TCP)
+	want := Listener{Proto: TCP, Port: 111, UID: 0, Inode: 18129}
+	if len(listeners) != 3 || listeners[1] != want {
+		t.Errorf("parseProcNet() = %v, want %v at 1", listeners, want)
+	}
+}
+
+const mixedContent = `sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+0: 00000000:232C 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 86255494 1 0000000000000000 100 0 0 10 0
+1: 0100007F:C350 0100007F:232C 01 00000000:00000000 00:00000000 00000000  1000        0 86255999 1 0000000000000000 20 4 30 10 -1
+2: 00000000:0050 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 86197589 1 0000000000000000 100 0 0 10 0
+`
+
+const udpContent = `sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode ref pointer drops
+1: 00000000:0035 00000000:0000 07 00000000:00000000 00:00000000 00000000     0        0 4242 2 0000000000000000 0
+2: 0100007F:D431 0100007F:0035 01 00000000:00000000 00:00000000 00000000  1000        0 4343 2 0000000000000000 0
+`
+
+func Test_parseProcNet(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		proto   string
+		want    []uint16
+	}{
+		{"Listeners after established sockets", mixedContent, TCP, []uint16{9004, 80}},
+		{"Unconnected UDP sockets", udpContent, UDP, []uint16{53}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ports := make([]uint16, 0)
+			for _, l := range parseProcNet(strings.NewReader(tt.content), tt.proto) {
+				ports = append(ports, l.Port)
+			}
+			if !reflect.DeepEqual(ports, tt.want) {
+				t.Errorf("parseProcNet() = %v, want %v", ports, tt.want)
+			}
+		})
+	}
+}
+
+func Test_nextInterval(t *testing.T) {
+	min, max := 250*time.Millisecond, 4*time.Second
+	tests := []struct {
+		name    string
+		cur     time.Duration
+		changed bool
+		want    time.Duration
+	}{
+		{"Back off while stable", min, false, 500 * time.Millisecond},
+		{"Capped by max", 3 * time.Second, false, max},
+		{"Stay at max", max, false, max},
+		{"Reset after a change", max, true, min},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := nextInterval(tt.cur, min, max, tt.changed); got != tt.want {
+				t.Errorf("nextInterval() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_listenersChanged(t *testing.T) {
+	web := Listener{Proto: TCP, Port: 80, Inode: 1}
+	dns := Listener{Proto: UDP, Port: 41234, Inode: 2}
+	tests := []struct {
+		name string
+		a, b []Listener
+		want bool
+	}{
+		{"Same", []Listener{web}, []Listener{web}, false},
+		{"UDP socket added", []Listener{web}, []Listener{web, dns}, false},
+		{"UDP socket removed", []Listener{dns, web}, []Listener{web}, false},
+		{"TCP listener added", []Listener{dns}, []Listener{dns, web}, true},
+		{"TCP listener removed", []Listener{web}, nil, true},
+		{"Re-listened", []Listener{web}, []Listener{{Proto: TCP, Port: 80, Inode: 3}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := listenersChanged(tt.a, tt.b); got != tt.want {
+				t.Errorf("listenersChanged() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParsePortRange(t *testing.T) {
+	for s, want := range map[string]PortRange{
+		"8080":      {8080, 8080},
+		"3000-3999": {3000, 3999},
+		"1-65535":   {1, 65535},
+	} {
+		if r, err := ParsePortRange(s); err != nil || r != want || r.String() != s {
+			t.Errorf("ParsePortRange(%q) = %v, %v, want %v", s, r, err, want)
+		}
+	}
+	for _, s := range []string{"", "0", "3999-3000", "80-", "http", "70000"} {
+		if _, err := ParsePortRange(s); err == nil {
+			t.Errorf("ParsePortRange(%q): expected error", s)
+		}
+	}
+}
+
+func TestParseLsof(t *testing.T) {
+	out := "p812\nu501\nf23\nn*:3000\nf24\nn[::1]:5432\np990\nu0\nf5\nn127.0.0.1:8080\n"
+	want := []Listener{
+		{Proto: TCP, Port: 3000, UID: 501},
+		{Proto: TCP, Port: 5432, UID: 501},
+		{Proto: TCP, Port: 8080, UID: 0},
+	}
+	if got := parseLsof(strings.NewReader(out)); !reflect.DeepEqual(got, want) {
+		t.Errorf("parseLsof() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,81 @@
+package portscan
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// The mount points of tracefs, the latter is the legacy one under debugfs
+var tracefsDirs = []string{"/sys/kernel/tracing", "/sys/kernel/debug/tracing"}
+
+// TracepointTrigger notifies the scanner when a TCP socket enters or leaves the LISTEN state, by
+// reading the `sock:inet_sock_set_state` tracepoint. It needs tracefs to be writable, ie. the agent is
+// running in a privileged container, NewTracepointTrigger fails otherwise.
+//
+// The tracepoint is host-wide, so a notification may come from another container, it only makes the
+// scanner scan sooner. A dedicated trace instance is used to leave the global trace buffer alone.
+type TracepointTrigger struct {
+	instance string
+	pipe     *os.File
+}
+
+func NewTracepointTrigger() (*TracepointTrigger, error) {
+	var root string
+	for _, dir := range tracefsDirs {
+		if _, err := os.Stat(filepath.Join(dir, "instances")); err == nil {
+			root = dir
+			break
+		}
+	}
+	if root == "" {
+		return nil, errors.New("tracefs is not available")
+	}
+	instance := filepath.Join(root, "instances", fmt.Sprintf("apf-agent-%d", os.Getpid()))
+	if err := os.Mkdir(instance, 0700); err != nil {
+		return nil, err
+	}
+	t := &TracepointTrigger{instance: instance}
+	event := filepath.Join(instance, "events", "sock", "inet_sock_set_state")
+	// 6: IPPROTO_TCP, 10: TCP_LISTEN
+	filter := "protocol == 6 && (newstate == 10 || oldstate == 10)"
+	if err := os.WriteFile(filepath.Join(event, "filter"), []byte(filter), 0600); err != nil {
+		t.Close()
+		return nil, err
+	}
+	if err := os.WriteFile(filepath.Join(event, "enable"), []byte("1"), 0600); err != nil {
+		t.Close()
+		return nil, err
+	}
+	pipe, err := os.Open(filepath.Join(instance, "trace_pipe"))
+	if err != nil {
+		t.Close()
+		return nil, err
+	}
+	t.pipe = pipe
+	return t, nil
+}
+
+// Run notifies for every traced event until the trigger is closed, the notifications are dropped if
+// the scanner is busy.
+func (t *TracepointTrigger) Run(notify chan<- struct{}) {
+	scanner := bufio.NewScanner(t.pipe)
+	for scanner.Scan() {
+		select {
+		case notify <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Close disables the tracepoint and removes the trace instance.
+func (t *TracepointTrigger) Close() error {
+	event := filepath.Join(t.instance, "events", "sock", "inet_sock_set_state")
+	os.WriteFile(filepath.Join(event, "enable"), []byte("0"), 0600)
+	if t.pipe != nil {
+		t.pipe.Close()
+	}
+	return os.Remove(t.instance)
+}
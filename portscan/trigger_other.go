@@ -0,0 +1,18 @@
+//go:build !linux
+// +build !linux
+
+package portscan
+
+import "errors"
+
+type TracepointTrigger struct{}
+
+func NewTracepointTrigger() (*TracepointTrigger, error) {
+	return nil, errors.New("tracepoints are not supported on this platform")
+}
+
+func (t *TracepointTrigger) Run(notify chan<- struct{}) {}
+
+func (t *TracepointTrigger) Close() error {
+	return nil
+}
@@ -0,0 +1,132 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/ruoshan/autoportforward/mux"
+)
+
+// The results of dialing an address, replied by the forwarder. They are the same as the replies of SOCKS5.
+const (
+	StatusOK              byte = 0x00
+	StatusFailure         byte = 0x01
+	StatusNotAllowed      byte = 0x02
+	StatusNetUnreachable  byte = 0x03
+	StatusHostUnreachable byte = 0x04
+	StatusRefused         byte = 0x05
+)
+
+const dialTimeout = 10 * time.Second
+
+// DialError is returned by DialAddr when the forwarder failed to dial the address
+type DialError struct {
+	Addr   string
+	Status byte
+}
+
+func (e *DialError) Error() string {
+	reason := "failure"
+	switch e.Status {
+	case StatusNotAllowed:
+		reason = "not allowed"
+	case StatusNetUnreachable:
+		reason = "network unreachable"
+	case StatusHostUnreachable:
+		reason = "host unreachable"
+	case StatusRefused:
+		reason = "connection refused"
+	}
+	return fmt.Sprintf("failed to dial %s: %s", e.Addr, reason)
+}
+
+// DialStatus returns the status of the error of dialing.
+func DialStatus(err error) byte {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	switch {
+	case errors.Is(err, ErrNotAllowed):
+		return StatusNotAllowed
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return StatusRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return StatusNetUnreachable
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.As(err, &dnsErr):
+		return StatusHostUnreachable
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return StatusHostUnreachable
+	}
+	return StatusFailure
+}
+
+// DialAddr opens a stream to the address (host:port) dialed by the forwarder on the other side of the mux,
+// eg. a DNS name that is only resolvable in the container, or unix:{path} of the destinations of the
+// reverse ports. rport is the reverse port of the destination, 0 if it's not for a port (eg. SOCKS5).
+func DialAddr(m mux.MuxClient, rport uint16, addr string) (io.ReadWriteCloser, error) {
+	if len(addr) > 255 {
+		return nil, fmt.Errorf("address is too long: %s", addr)
+	}
+	stream, err := m.Connect()
+	if err != nil {
+		return nil, err
+	}
+
+	// Prelude: the port 0, followed by the reverse port and the address
+	buf := make([]byte, 0, 5+len(addr))
+	buf = append(buf, 0, 0, byte(rport>>8), byte(rport), byte(len(addr)))
+	buf = append(buf, addr...)
+	if _, err := stream.Write(buf); err != nil {
+		stream.Close()
+		return nil, err
+	}
+	status := make([]byte, 1)
+	if _, err := io.ReadFull(stream, status); err != nil {
+		stream.Close()
+		return nil, err
+	}
+	if status[0] != StatusOK {
+		stream.Close()
+		return nil, &DialError{Addr: addr, Status: status[0]}
+	}
+	return stream, nil
+}
+
+// UnixPrefix prefixes the local unix socket paths as the destinations, eg. unix:/tmp/ssh-XXXX/agent.1
+const UnixPrefix = "unix:"
+
+// unixPath returns the path of the unix socket address, false if it's not a unix socket.
+func unixPath(addr string) (string, bool) {
+	if !strings.HasPrefix(addr, UnixPrefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(addr, UnixPrefix), true
+}
+
+// readAddr reads the reverse port and the address of the extended prelude, after the port 0.
+func readAddr(r io.Reader) (uint16, string, error) {
+	hdr := make([]byte, 3)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return 0, "", err
+	}
+	rport := binary.BigEndian.Uint16(hdr)
+	addr := make([]byte, hdr[2])
+	if _, err := io.ReadFull(r, addr); err != nil {
+		return 0, "", err
+	}
+	if path, ok := unixPath(string(addr)); ok {
+		if path == "" {
+			return 0, "", errors.New("empty unix socket path")
+		}
+		return rport, string(addr), nil
+	}
+	if _, _, err := net.SplitHostPort(string(addr)); err != nil {
+		return 0, "", err
+	}
+	return rport, string(addr), nil
+}
@@ -0,0 +1,100 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+var ErrNotAllowed = errors.New("destination is not allowed")
+
+// Allowlist restricts the addresses dialed by the forwarder for the SOCKS5 and HTTP proxies. The entries are:
+//   - CIDR or IP, eg. 10.0.0.0/8: the IPs, and the names resolved to them
+//   - domain, eg. svc.cluster.local: the domain and its subdomains, as they are resolved by the forwarder
+type Allowlist struct {
+	nets    []*net.IPNet
+	domains []string
+}
+
+func ParseAllowlist(entries []string) (*Allowlist, error) {
+	a := &Allowlist{}
+	for _, e := range entries {
+		e = strings.ToLower(strings.TrimSpace(e))
+		if e == "" {
+			return nil, errors.New("invalid allowlist entry: empty")
+		}
+		if strings.Contains(e, "/") {
+			_, ipnet, err := net.ParseCIDR(e)
+			if err != nil {
+				return nil, fmt.Errorf("invalid allowlist entry: %s", e)
+			}
+			a.nets = append(a.nets, ipnet)
+			continue
+		}
+		if ip := net.ParseIP(e); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			a.nets = append(a.nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		a.domains = append(a.domains, strings.TrimPrefix(strings.TrimPrefix(e, "*"), "."))
+	}
+	return a, nil
+}
+
+func (a *Allowlist) allowIP(ip net.IP) bool {
+	for _, n := range a.nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *Allowlist) allowDomain(host string) bool {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	for _, d := range a.domains {
+		if host == d || strings.HasSuffix(host, "."+d) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check returns the address to dial for the requested address (host:port), or ErrNotAllowed. A name that
+// is not allowed by the domains is resolved, and dialed by the resolved IP allowed by the CIDRs, so that
+// it can't be resolved to another IP when dialing. A nil Allowlist allows all the addresses.
+func (a *Allowlist) Check(addr string) (string, error) {
+	if a == nil {
+		return addr, nil
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if a.allowIP(ip) {
+			return addr, nil
+		}
+		return "", ErrNotAllowed
+	}
+	if a.allowDomain(host) {
+		return addr, nil
+	}
+	if len(a.nets) == 0 {
+		return "", ErrNotAllowed
+	}
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return "", err
+	}
+	for _, ip := range ips {
+		if a.allowIP(ip) {
+			return net.JoinHostPort(ip.String(), port), nil
+		}
+	}
+	return "", ErrNotAllowed
+}
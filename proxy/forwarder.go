@@ -14,61 +14,204 @@ import (
 type ProxyForwarder struct {
 	muxServer mux.MuxServer
 	logger    *log.Logger
+	stats     *Stats
+	services  *Services
+	allowlist *Allowlist
+	dests     map[uint16]string // target port => destination, nil if any destination is allowed
+	connCb    func(ev ConnEvent)
+	mu        sync.Mutex
+	paused    map[uint16]bool // target port => paused
 }
 
 func NewProxyForwarder(m mux.MuxServer, logger *log.Logger) *ProxyForwarder {
 	return &ProxyForwarder{
 		muxServer: m,
 		logger:    logger,
+		paused:    make(map[uint16]bool),
 	}
 }
 
+func (p *ProxyForwarder) SetStats(stats *Stats) {
+	p.stats = stats
+}
+
+func (p *ProxyForwarder) SetServices(services *Services) {
+	p.services = services
+}
+
+// SetAllowlist restricts the addresses dialed for the extended prelude, all the addresses are allowed if nil.
+func (p *ProxyForwarder) SetAllowlist(allowlist *Allowlist) {
+	p.allowlist = allowlist
+}
+
+// SetDestinations only allows the given destinations (target port => host:port) to be dialed for the
+// extended prelude of their target ports, they are accounted as the target ports. It's for the side that
+// forwards the ports to the peer, so that the peer can't dial anything else.
+func (p *ProxyForwarder) SetDestinations(dests map[uint16]string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.dests = make(map[uint16]string)
+	for rport, dest := range dests {
+		p.dests[rport] = dest
+	}
+}
+
+// destination returns the target port the destination is accounted as, false if it's not allowed.
+func (p *ProxyForwarder) destination(rport uint16, addr string) (uint16, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.dests == nil {
+		return 0, true
+	}
+	dest, ok := p.dests[rport]
+	return rport, ok && rport != 0 && dest == addr
+}
+
+// SetConnCallback sets the callback that is invoked when a connection is opened or closed.
+func (p *ProxyForwarder) SetConnCallback(cb func(ev ConnEvent)) {
+	p.connCb = cb
+}
+
+func (p *ProxyForwarder) reportConn(ev ConnEvent) {
+	if p.connCb != nil {
+		ev.Dir = Reverse
+		p.connCb(ev)
+	}
+}
+
+// Pause makes the forwarder reject new streams to the target port (rport) until resumed.
+func (p *ProxyForwarder) Pause(rport uint16) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.paused[rport] = true
+}
+
+func (p *ProxyForwarder) Resume(rport uint16) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.paused, rport)
+}
+
+func (p *ProxyForwarder) IsPaused(rport uint16) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.paused[rport]
+}
+
 func (p *ProxyForwarder) Start() {
 	for {
-		stream, rport := p.acceptStream()
-		if stream == nil {
+		stream, err := p.muxServer.Accept()
+		if err != nil {
+			p.logger.Printf("Failed to accept new stream: %s", err)
 			return
 		}
-		go p.forwardLoop(stream, rport)
+		go p.serveStream(stream)
 	}
 }
 
-func (p *ProxyForwarder) acceptStream() (stream io.ReadWriteCloser, rport uint16) {
-	stream, err := p.muxServer.Accept()
+// serveStream reads the prelude of the stream and forwards it, the streams of the malformed preludes
+// are closed.
+func (p *ProxyForwarder) serveStream(stream io.ReadWriteCloser) {
+	rport, err := readPrelude(stream)
 	if err != nil {
-		p.logger.Printf("Failed to accept new stream: %s", err)
-		return nil, 0
+		p.logger.Printf("Failed to read prelude: %s", err)
+		stream.Close()
+		return
+	}
+	if rport == 0 {
+		p.forwardAddr(stream)
+		return
 	}
+	p.forwardLoop(stream, rport)
+}
 
-	// Prelude: parse the target port (2 bytes)
+// readPrelude reads the target port (2 bytes) of the prelude, 0 for the extended prelude.
+func readPrelude(r io.Reader) (rport uint16, err error) {
 	buf := make([]byte, 2)
-	_, err = stream.Read(buf)
-	if err != nil {
-		p.logger.Println("Failed to read prelude")
-		return nil, 0
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return 0, err
 	}
-	rport = binary.BigEndian.Uint16(buf)
-	return stream, rport
+	return binary.BigEndian.Uint16(buf), nil
 }
 
 func (p *ProxyForwarder) forwardLoop(stream io.ReadWriteCloser, rport uint16) {
-	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", rport))
+	if p.IsPaused(rport) {
+		p.logger.Printf("Drop stream to paused port: %d", rport)
+		stream.Close()
+		return
+	}
+	addr := fmt.Sprintf("127.0.0.1:%d", rport)
+	conn, err := net.Dial("tcp", addr)
 	if err != nil {
 		p.logger.Printf("Failed to dial: %d", rport)
+		stream.Close()
+		p.reportConn(ConnEvent{Port: rport, Addr: addr, Err: err})
 		return
 	}
 
-	wg := sync.WaitGroup{}
-	wg.Add(2)
-	go func() {
-		io.Copy(conn, stream)
+	p.reportConn(ConnEvent{Port: rport, Addr: addr, Opened: true})
+	in, out := splice(conn, stream, p.stats.Port(Reverse, rport), p.services.sniffer(Reverse, rport), false)
+	p.reportConn(ConnEvent{Port: rport, Addr: addr, BytesIn: in, BytesOut: out})
+}
+
+// forwardAddr serves the stream of the extended prelude: the port 0 is followed by the reverse port (2 bytes, 0 if none)
+// and the address to dial, 1-byte length + "{host}:{port}" (or "unix:{path}"), the host may be a DNS name resolved by the forwarder. Unlike the port
+// streams, the forwarder replies the result of the dialing (1 byte, see DialStatus) before the bi-streaming.
+func (p *ProxyForwarder) forwardAddr(stream io.ReadWriteCloser) {
+	port, addr, err := readAddr(stream)
+	if err != nil {
+		p.logger.Printf("Failed to read the address of prelude: %s", err)
+		stream.Write([]byte{StatusFailure})
+		stream.Close()
+		return
+	}
+	rport, ok := p.destination(port, addr)
+	if _, unix := unixPath(addr); unix && rport == 0 {
+		// The unix sockets are only dialed as the destinations of the reverse ports
+		ok = false
+	}
+	if !ok {
+		p.logger.Printf("Destination is not allowed: %s", addr)
+		stream.Write([]byte{StatusNotAllowed})
+		stream.Close()
+		return
+	}
+	if rport != 0 && p.IsPaused(rport) {
+		p.logger.Printf("Drop stream to paused port: %d", rport)
+		stream.Write([]byte{StatusFailure})
+		stream.Close()
+		return
+	}
+	conn, err := p.dialAddr(addr)
+	if err != nil {
+		p.logger.Printf("Failed to dial: %s: %s", addr, err)
+		stream.Write([]byte{DialStatus(err)})
+		stream.Close()
+		p.reportConn(ConnEvent{Port: rport, Addr: addr, Err: err})
+		return
+	}
+	if _, err := stream.Write([]byte{StatusOK}); err != nil {
 		conn.Close()
-		wg.Done()
-	}()
-	go func() {
-		io.Copy(stream, conn)
 		stream.Close()
-		wg.Done()
-	}()
-	wg.Wait()
+		return
+	}
+
+	ps, sn := (*PortStats)(nil), (*sniffer)(nil)
+	if rport != 0 {
+		ps, sn = p.stats.Port(Reverse, rport), p.services.sniffer(Reverse, rport)
+	}
+	p.reportConn(ConnEvent{Port: rport, Addr: addr, Opened: true})
+	in, out := splice(conn, stream, ps, sn, false)
+	p.reportConn(ConnEvent{Port: rport, Addr: addr, BytesIn: in, BytesOut: out})
+}
+
+func (p *ProxyForwarder) dialAddr(addr string) (net.Conn, error) {
+	if path, ok := unixPath(addr); ok {
+		return net.DialTimeout("unix", path, dialTimeout)
+	}
+	dialAddr, err := p.allowlist.Check(addr)
+	if err != nil {
+		return nil, err
+	}
+	return net.DialTimeout("tcp", dialAddr, dialTimeout)
 }
@@ -0,0 +1,161 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"time"
+
+	"github.com/ruoshan/autoportforward/mux"
+)
+
+// HTTPProxy is an HTTP proxy (CONNECT and plain HTTP) whose connections are dialed by the forwarder on the
+// other side of the mux, like the SocksServer, for the tools only supporting HTTP proxies.
+type HTTPProxy struct {
+	muxClient mux.MuxClient
+	addr      string
+	logger    *log.Logger
+	listener  net.Listener
+	http      *http.Server
+	forward   *httputil.ReverseProxy
+}
+
+func NewHTTPProxy(m mux.MuxClient, addr string, logger *log.Logger) *HTTPProxy {
+	p := &HTTPProxy{
+		muxClient: m,
+		addr:      addr,
+		logger:    logger,
+	}
+	p.http = &http.Server{Handler: p, ReadHeaderTimeout: socksTimeout}
+	p.forward = &httputil.ReverseProxy{
+		Director: func(r *http.Request) {
+			// The request is forwarded as it is, not as a reverse proxy
+			r.Header["X-Forwarded-For"] = nil
+		},
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				stream, err := DialAddr(p.muxClient, 0, addr)
+				if err != nil {
+					return nil, err
+				}
+				return asConn(stream), nil
+			},
+			IdleConnTimeout: 90 * time.Second,
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			p.logger.Printf("HTTP proxy: %s %s: %s", r.Method, r.URL, err)
+			w.WriteHeader(httpStatus(err))
+		},
+	}
+	return p
+}
+
+func (p *HTTPProxy) Listen() error {
+	l, err := net.Listen("tcp", p.addr)
+	if err != nil {
+		return err
+	}
+	p.listener = l
+	return nil
+}
+
+// Addr returns the listening address, it's only valid after Listen.
+func (p *HTTPProxy) Addr() net.Addr {
+	return p.listener.Addr()
+}
+
+func (p *HTTPProxy) Serve() {
+	p.logger.Printf("Serving HTTP proxy on %s", p.listener.Addr())
+	p.http.Serve(p.listener)
+}
+
+func (p *HTTPProxy) Close() error {
+	return p.http.Close()
+}
+
+func (p *HTTPProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodConnect {
+		p.connect(w, r)
+		return
+	}
+	if r.URL.Scheme != "http" || r.URL.Host == "" {
+		http.Error(w, "only the absolute http URLs are proxied", http.StatusBadRequest)
+		return
+	}
+	p.forward.ServeHTTP(w, r)
+}
+
+// connect tunnels the connection to the requested address (host:port)
+func (p *HTTPProxy) connect(w http.ResponseWriter, r *http.Request) {
+	addr := r.Host
+	stream, err := DialAddr(p.muxClient, 0, addr)
+	if err != nil {
+		p.logger.Printf("HTTP proxy: CONNECT %s: %s", addr, err)
+		http.Error(w, err.Error(), httpStatus(err))
+		return
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		stream.Close()
+		http.Error(w, "hijacking is not supported", http.StatusInternalServerError)
+		return
+	}
+	conn, buf, err := hj.Hijack()
+	if err != nil {
+		stream.Close()
+		return
+	}
+	if _, err := conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n")); err != nil {
+		stream.Close()
+		conn.Close()
+		return
+	}
+	// The client may have sent the bytes after the request, eg. the ClientHello
+	if n := buf.Reader.Buffered(); n > 0 {
+		b, _ := buf.Reader.Peek(n)
+		if _, err := stream.Write(b); err != nil {
+			stream.Close()
+			conn.Close()
+			return
+		}
+	}
+
+	p.logger.Printf("HTTP proxy: connected to %s", addr)
+	in, out := splice(conn, stream, nil, nil, true)
+	p.logger.Printf("HTTP proxy: disconnected from %s, %d bytes in, %d bytes out", addr, in, out)
+}
+
+func httpStatus(err error) int {
+	var dialErr *DialError
+	if errors.As(err, &dialErr) && dialErr.Status == StatusNotAllowed {
+		return http.StatusForbidden
+	}
+	return http.StatusBadGateway
+}
+
+// asConn makes the stream a net.Conn for the http.Transport, the yamux streams are already.
+func asConn(stream io.ReadWriteCloser) net.Conn {
+	if conn, ok := stream.(net.Conn); ok {
+		return conn
+	}
+	return &streamConn{stream}
+}
+
+type streamConn struct {
+	io.ReadWriteCloser
+}
+
+type streamAddr struct{}
+
+func (streamAddr) Network() string { return "mux" }
+func (streamAddr) String() string  { return "mux" }
+
+func (c *streamConn) LocalAddr() net.Addr                { return streamAddr{} }
+func (c *streamConn) RemoteAddr() net.Addr               { return streamAddr{} }
+func (c *streamConn) SetDeadline(t time.Time) error      { return nil }
+func (c *streamConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *streamConn) SetWriteDeadline(t time.Time) error { return nil }
@@ -7,6 +7,8 @@ import (
 	"io"
 	"log"
 	"net"
+	"os"
+	"path/filepath"
 	"sync"
 	"syscall"
 
@@ -15,25 +17,266 @@ import (
 
 type ProxyListener struct {
 	muxClient mux.MuxClient
+	lmu       sync.Mutex // guards the listeners, portMap and sockets
 	listeners map[uint16]*net.TCPListener
 	portMap   map[uint16]uint16 // remote port => local port
 	logger    *log.Logger
+	bind      string // the address of the listeners, all the interfaces if empty
+	stats     *Stats
+	services  *Services
+	connCb    func(ev ConnEvent)
+	mu        sync.Mutex
+	paused    map[uint16]bool   // remote port => paused
+	pinned    map[uint16]uint16 // remote port => pinned local port
+	pinFall   bool              // fall back to the normal allocation when the pinned port is in use
+	excluded  map[uint16]bool   // remote port => excluded from forwarding
+	included  map[uint16]bool   // if not empty, only these remote ports are forwarded
+	procNames map[uint16]string // remote port => the name of the owning process
+	procIncl  map[string]bool   // if not empty, only the ports of these processes are forwarded
+	procExcl  map[string]bool   // the ports of these processes are not forwarded
+	dests     map[uint16]string // remote port => the destination dialed by the peer, eg. db.internal:5432
+	paths     map[uint16]string // remote port => the unix socket path listened instead of the port
+	sockets   map[uint16]net.Listener
+	sources   *Sources // the allowed source addresses, all if nil
 }
 
+var ErrExcluded = errors.New("port is excluded from forwarding")
+
 func NewProxyListener(m mux.MuxClient, logger *log.Logger) *ProxyListener {
 	return &ProxyListener{
 		muxClient: m,
 		listeners: make(map[uint16]*net.TCPListener),
 		portMap:   make(map[uint16]uint16),
 		logger:    logger,
+		paused:    make(map[uint16]bool),
+		pinned:    make(map[uint16]uint16),
+		excluded:  make(map[uint16]bool),
+		included:  make(map[uint16]bool),
+		procNames: make(map[uint16]string),
+		procIncl:  make(map[string]bool),
+		procExcl:  make(map[string]bool),
+		dests:     make(map[uint16]string),
+		paths:     make(map[uint16]string),
+		sockets:   make(map[uint16]net.Listener),
+	}
+}
+
+// SetBindAddress sets the address of the new listeners, eg. 127.0.0.1
+func (p *ProxyListener) SetBindAddress(addr string) {
+	p.bind = addr
+}
+
+// SetSources restricts the source addresses of the connections to the listeners, all are allowed if nil.
+func (p *ProxyListener) SetSources(sources *Sources) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.sources = sources
+}
+
+func (p *ProxyListener) allowSource(rport uint16, addr net.Addr) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.sources.Allow(rport, addr)
+}
+
+func (p *ProxyListener) SetStats(stats *Stats) {
+	p.stats = stats
+}
+
+func (p *ProxyListener) SetServices(services *Services) {
+	p.services = services
+}
+
+// SetConnCallback sets the callback that is invoked when a connection is opened or closed.
+func (p *ProxyListener) SetConnCallback(cb func(ev ConnEvent)) {
+	p.connCb = cb
+}
+
+func (p *ProxyListener) reportConn(ev ConnEvent) {
+	if p.connCb != nil {
+		ev.Dir = Forward
+		p.connCb(ev)
+	}
+}
+
+// Pause makes the listener of the remote port (rport) drop new connections until resumed.
+// The established connections are not affected.
+func (p *ProxyListener) Pause(rport uint16) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.paused[rport] = true
+}
+
+func (p *ProxyListener) Resume(rport uint16) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.paused, rport)
+}
+
+func (p *ProxyListener) IsPaused(rport uint16) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.paused[rport]
+}
+
+// Pin makes the remote port (rport) always forwarded from the local port (lport).
+// It takes effect on the next NewListener of the rport.
+func (p *ProxyListener) Pin(rport, lport uint16) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.pinned[rport] = lport
+}
+
+// SetPinFallback makes the pinned ports that are in use fall back to the normal allocation, rather
+// than failing the forwarding.
+func (p *ProxyListener) SetPinFallback(fallback bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.pinFall = fallback
+}
+
+func (p *ProxyListener) Unpin(rport uint16) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.pinned, rport)
+}
+
+// Exclude stops the remote port (rport) from being forwarded.
+// It takes effect on the next NewListener of the rport.
+func (p *ProxyListener) Exclude(rport uint16) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.excluded[rport] = true
+}
+
+func (p *ProxyListener) Unexclude(rport uint16) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.excluded, rport)
+}
+
+// SetIncluded makes only the given remote ports forwarded, an empty list means all the ports.
+// It takes effect on the next NewListener of the ports.
+func (p *ProxyListener) SetIncluded(rports []uint16) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.included = make(map[uint16]bool)
+	for _, rport := range rports {
+		p.included[rport] = true
+	}
+}
+
+// SetProcessFilter makes only the ports owned by the included processes forwarded (an empty list
+// means all the processes), except the ones owned by the excluded processes. The processes are
+// matched by name, eg. "node". It takes effect on the next NewListener of the ports.
+func (p *ProxyListener) SetProcessFilter(include, exclude []string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.procIncl = make(map[string]bool)
+	for _, name := range include {
+		p.procIncl[name] = true
+	}
+	p.procExcl = make(map[string]bool)
+	for _, name := range exclude {
+		p.procExcl[name] = true
+	}
+}
+
+// SetProcessNames sets the names of the processes owning the remote ports, they are matched
+// against the process filter.
+func (p *ProxyListener) SetProcessNames(names map[uint16]string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.procNames = names
+}
+
+// SetDestination makes the connections to the remote port (rport) forwarded to the destination dialed by
+// the peer (host:port) instead of the same port on its 127.0.0.1, an empty destination resets it.
+func (p *ProxyListener) SetDestination(rport uint16, dest string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if dest == "" {
+		delete(p.dests, rport)
+		return
+	}
+	p.dests[rport] = dest
+}
+
+func (p *ProxyListener) destination(rport uint16) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.dests[rport]
+}
+
+// SetUnixPath makes the remote port (rport) listened as the unix socket of the path instead of the local
+// port, the rport is only the ID of the socket then. An empty path resets it.
+func (p *ProxyListener) SetUnixPath(rport uint16, path string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if path == "" {
+		delete(p.paths, rport)
+		return
+	}
+	p.paths[rport] = path
+}
+
+func (p *ProxyListener) unixPath(rport uint16) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.paths[rport]
+}
+
+// Rules returns copies of the pinned and excluded ports.
+func (p *ProxyListener) Rules() (pinned map[uint16]uint16, excluded []uint16) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pinned = make(map[uint16]uint16)
+	for rport, lport := range p.pinned {
+		pinned[rport] = lport
+	}
+	excluded = make([]uint16, 0, len(p.excluded))
+	for rport := range p.excluded {
+		excluded = append(excluded, rport)
 	}
+	return pinned, excluded
+}
+
+func (p *ProxyListener) pinFallback() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.pinFall
+}
+
+func (p *ProxyListener) rule(rport uint16) (pinned uint16, excluded bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	excluded = p.excluded[rport] || (len(p.included) > 0 && !p.included[rport])
+	name := p.procNames[rport]
+	excluded = excluded || p.procExcl[name] || (len(p.procIncl) > 0 && !p.procIncl[name])
+	return p.pinned[rport], excluded
 }
 
 // Create new listener that would forward to the remote port (rport).
-// The local port will be the same as rport if possible, otherwise:
+// The local port will be the pinned port if any (see SetPinFallback), or the same as rport if possible, otherwise:
 //   - if rport < 1024, lport == rport + 10000
 //   - fallback: a random port is chosen for lport
 func (p *ProxyListener) NewListener(rport uint16) (lport uint16, err error) {
+	if path := p.unixPath(rport); path != "" {
+		if err := p.newUnixListener(path, rport); err != nil {
+			return 0, err
+		}
+		return rport, nil
+	}
+	pinned, excluded := p.rule(rport)
+	if excluded {
+		return 0, ErrExcluded
+	}
+	if pinned != 0 {
+		lport, err = p.newListener(pinned, rport)
+		if !errors.Is(err, syscall.EADDRINUSE) || !p.pinFallback() {
+			return lport, err
+		}
+	}
 	lport = rport
 	if rport < 1024 {
 		lport = rport + 5000
@@ -47,71 +290,184 @@ func (p *ProxyListener) NewListener(rport uint16) (lport uint16, err error) {
 
 func (p *ProxyListener) newListener(lport, rport uint16) (finalPort uint16, err error) {
 	p.logger.Printf("New listener: %d", lport)
-	laddr, _ := net.ResolveTCPAddr("tcp", fmt.Sprintf(":%d", lport))
-	l, err := net.ListenTCP("tcp4", laddr)
+	network := "tcp4"
+	if ip := net.ParseIP(p.bind); ip != nil && ip.To4() == nil {
+		network = "tcp6"
+	}
+	laddr, _ := net.ResolveTCPAddr(network, net.JoinHostPort(p.bind, fmt.Sprint(lport)))
+	l, err := net.ListenTCP(network, laddr)
 	if err != nil {
 		p.logger.Printf("Failed to listen: %s", err)
 		return 0, err
 	}
-	if lport != 0 {
-		p.listeners[lport] = l
-		p.portMap[rport] = lport
-	} else {
+	if lport == 0 {
 		tcpAddr := l.Addr().(*net.TCPAddr)
 		lport = uint16(tcpAddr.Port)
-		p.listeners[lport] = l
-		p.portMap[rport] = lport
 	}
+	p.lmu.Lock()
+	p.listeners[lport] = l
+	p.portMap[rport] = lport
+	p.lmu.Unlock()
 
 	go p.listenLoop(l, rport)
 	return lport, nil
 }
 
+// newUnixListener listens on the unix socket of the path, the stale socket file (eg. of a previous run) is
+// replaced, but not the live sockets (eg. /var/run/docker.sock) nor the other files.
+func (p *ProxyListener) newUnixListener(path string, rport uint16) error {
+	p.logger.Printf("New unix listener: %s", path)
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return fmt.Errorf("file exists and is not a socket: %s", path)
+		}
+		conn, err := net.Dial("unix", path)
+		if err == nil {
+			conn.Close()
+			return fmt.Errorf("socket is in use: %s", path)
+		}
+		if !errors.Is(err, syscall.ECONNREFUSED) {
+			return fmt.Errorf("socket exists: %s: %s", path, err)
+		}
+		os.Remove(path)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		p.logger.Printf("Failed to listen: %s", err)
+		return err
+	}
+	p.lmu.Lock()
+	p.sockets[rport] = l
+	p.lmu.Unlock()
+	go p.listenLoop(l, rport)
+	return nil
+}
+
 func (p *ProxyListener) PortInUsed(lport uint16) bool {
+	p.lmu.Lock()
+	defer p.lmu.Unlock()
 	_, ok := p.listeners[lport]
 	return ok
 }
 
+// PortMap returns a copy of the listening ports: remote port => local port.
+func (p *ProxyListener) PortMap() map[uint16]uint16 {
+	p.lmu.Lock()
+	defer p.lmu.Unlock()
+	portMap := make(map[uint16]uint16, len(p.portMap))
+	for rport, lport := range p.portMap {
+		portMap[rport] = lport
+	}
+	return portMap
+}
+
 func (p *ProxyListener) CloseListener(rport uint16) error {
-	lport := p.portMap[rport]
-	p.logger.Printf("Close listener: %d", lport)
-	err := p.listeners[lport].Close()
+	p.lmu.Lock()
+	if l, ok := p.sockets[rport]; ok {
+		delete(p.sockets, rport)
+		p.lmu.Unlock()
+		p.logger.Printf("Close unix listener: %s", l.Addr())
+		p.Resume(rport)
+		p.services.Forget(Forward, rport)
+		// The socket file is removed as well
+		return l.Close()
+	}
+	lport, ok := p.portMap[rport]
+	if !ok {
+		p.lmu.Unlock()
+		return nil
+	}
+	l := p.listeners[lport]
 	delete(p.listeners, lport)
+	delete(p.portMap, rport)
+	p.lmu.Unlock()
+	p.logger.Printf("Close listener: %d", lport)
+	err := l.Close()
+	p.Resume(rport)
+	p.services.Forget(Forward, rport)
 	return err
 }
 
+// CloseAll closes all the listeners, it's used when the session is over.
+func (p *ProxyListener) CloseAll() {
+	p.lmu.Lock()
+	rports := make([]uint16, 0, len(p.portMap)+len(p.sockets))
+	for rport := range p.portMap {
+		rports = append(rports, rport)
+	}
+	for rport := range p.sockets {
+		rports = append(rports, rport)
+	}
+	p.lmu.Unlock()
+	for _, rport := range rports {
+		p.CloseListener(rport)
+	}
+}
+
 func (p *ProxyListener) listenLoop(l net.Listener, rport uint16) {
 	for {
 		conn, err := l.Accept()
 		if err != nil {
 			return
 		}
-		go func() {
-			stream, err := p.muxClient.Connect()
-			if err != nil {
-				p.logger.Println("Failed to connect to proxy client")
-				return
-			}
-
-			// Prelude: before start the bi-streaming, need to tell the mux server which
-			// target port to proxy to
-			buf := make([]byte, 2)
-			binary.BigEndian.PutUint16(buf, rport)
-			stream.Write(buf)
-
-			wg := sync.WaitGroup{}
-			wg.Add(2)
-			go func() {
-				io.Copy(conn, stream)
-				conn.Close()
-				wg.Done()
-			}()
-			go func() {
-				io.Copy(stream, conn)
-				stream.Close()
-				wg.Done()
-			}()
-			wg.Wait()
-		}()
+		go p.ServeConn(conn, rport)
+	}
+}
+
+// dial opens a mux stream to the remote port (rport), or its destination.
+func (p *ProxyListener) dial(rport uint16) (io.ReadWriteCloser, error) {
+	if dest := p.destination(rport); dest != "" {
+		return DialAddr(p.muxClient, rport, dest)
+	}
+	stream, err := p.muxClient.Connect()
+	if err != nil {
+		return nil, err
+	}
+
+	// Prelude: before start the bi-streaming, need to tell the mux server which
+	// target port to proxy to
+	buf := make([]byte, 2)
+	binary.BigEndian.PutUint16(buf, rport)
+	if _, err := stream.Write(buf); err != nil {
+		stream.Close()
+		return nil, err
+	}
+	return stream, nil
+}
+
+// ServeConn forwards the local connection to the remote port (rport) over the mux, the connection is
+// closed when done. Besides the listeners of the ports, it serves the connections routed by the front
+// proxy, which don't need a listener per port. Either way the source address must be allowed, see SetSources.
+func (p *ProxyListener) ServeConn(conn net.Conn, rport uint16) {
+	// Rejected before opening a stream to the peer
+	if !p.allowSource(rport, conn.RemoteAddr()) {
+		addr := conn.RemoteAddr().String()
+		p.logger.Printf("Rejected connection from %s to port %d", addr, rport)
+		conn.Close()
+		p.reportConn(ConnEvent{Port: rport, Addr: addr, Err: ErrSourceNotAllowed})
+		return
+	}
+	if p.IsPaused(rport) {
+		p.logger.Printf("Drop connection to paused port: %d", rport)
+		conn.Close()
+		return
+	}
+	addr := ""
+	if raddr := conn.RemoteAddr(); raddr != nil {
+		// The unix socket peers may be unnamed
+		addr = raddr.String()
+	}
+	stream, err := p.dial(rport)
+	if err != nil {
+		p.logger.Println("Failed to connect to proxy client")
+		conn.Close()
+		p.reportConn(ConnEvent{Port: rport, Addr: addr, Err: err})
+		return
 	}
+	p.reportConn(ConnEvent{Port: rport, Addr: addr, Opened: true})
+	in, out := splice(conn, stream, p.stats.Port(Forward, rport), p.services.sniffer(Forward, rport), true)
+	p.reportConn(ConnEvent{Port: rport, Addr: addr, BytesIn: in, BytesOut: out})
 }
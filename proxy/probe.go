@@ -0,0 +1,41 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"time"
+
+	"github.com/ruoshan/autoportforward/sniff"
+)
+
+type deadliner interface {
+	SetDeadline(t time.Time) error
+}
+
+// ProbeHTTP sends a HEAD request to the remote port (rport) directly over the mux, bypassing the local
+// listener, and records the port as an HTTP service if it responds with HTTP. It's for the ports that
+// have not been classified by sniffing the connections yet.
+func (p *ProxyListener) ProbeHTTP(rport uint16, timeout time.Duration) (bool, error) {
+	stream, err := p.dial(rport)
+	if err != nil {
+		return false, err
+	}
+	defer stream.Close()
+	if d, ok := stream.(deadliner); ok {
+		d.SetDeadline(time.Now().Add(timeout))
+	}
+	if _, err := stream.Write([]byte("HEAD / HTTP/1.0\r\nHost: localhost\r\n\r\n")); err != nil {
+		return false, err
+	}
+	resp := make([]byte, 8)
+	if _, err := io.ReadFull(stream, resp); err != nil {
+		return false, err
+	}
+	if !bytes.HasPrefix(resp, []byte("HTTP/1.")) {
+		return false, nil
+	}
+	if p.services != nil {
+		p.services.set(Forward, rport, sniff.Service{Name: sniff.HTTP})
+	}
+	return true, nil
+}
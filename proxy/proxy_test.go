@@ -1,12 +1,21 @@
 package proxy
 
 import (
+	"bufio"
 	"bytes"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/ruoshan/autoportforward/sniff"
 )
 
 type pipe struct {
@@ -104,7 +113,14 @@ func Test_proxy(t *testing.T) {
 
 	go func() {
 		<-sig
-		stream, port := cli.acceptStream()
+		stream, err := mux.Accept()
+		if err != nil {
+			t.Error(err)
+		}
+		port, err := readPrelude(stream)
+		if err != nil {
+			t.Error(err)
+		}
 		<-sig
 		cli.forwardLoop(stream, port)
 		<-sig
@@ -114,3 +130,698 @@ func Test_proxy(t *testing.T) {
 	helperSender(t, fmt.Sprintf("127.0.0.1:%d", lport), "testmsg")
 	helperReceiver(t, 38889, "testmsg", sig)
 }
+
+func Test_splice(t *testing.T) {
+	stats := NewStats()
+	r1, w1 := io.Pipe()
+	r2, w2 := io.Pipe()
+	conn := &pipe{r: r1, w: nopWriteCloser{io.Discard}}
+	stream := &pipe{r: r2, w: nopWriteCloser{io.Discard}}
+
+	done := make(chan struct{})
+	go func() {
+		splice(conn, stream, stats.Port(Forward, 8080), nil, true)
+		close(done)
+	}()
+	w1.Write([]byte("hello"))
+	w2.Write([]byte("world!"))
+	w1.Close()
+	w2.Close()
+	<-done
+
+	st := stats.Get(Forward, 8080)
+	if st.Conns != 0 || st.Total != 1 || st.BytesOut != 5 || st.BytesIn != 6 {
+		t.Fatalf("unexpected stats: %+v", st)
+	}
+}
+
+func Test_spliceSniffing(t *testing.T) {
+	services := NewServices()
+	detected := make(chan sniff.Service, 1)
+	services.SetCallback(func(dir Direction, port uint16, svc sniff.Service) {
+		detected <- svc
+	})
+	r1, w1 := io.Pipe()
+	r2, w2 := io.Pipe()
+	conn := &pipe{r: r1, w: nopWriteCloser{io.Discard}}
+	stream := &pipe{r: r2, w: nopWriteCloser{io.Discard}}
+
+	done := make(chan struct{})
+	go func() {
+		splice(conn, stream, NewStats().Port(Forward, 8080), services.sniffer(Forward, 8080), true)
+		close(done)
+	}()
+	w1.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	w2.Write([]byte("HTTP/1.1 200 OK\r\n\r\n"))
+	w1.Close()
+	w2.Close()
+	<-done
+
+	want := sniff.Service{Name: sniff.HTTP, Detail: "localhost"}
+	if svc := <-detected; svc != want {
+		t.Fatalf("detected %v, want %v", svc, want)
+	}
+	if svc, ok := services.Get(Forward, 8080); !ok || svc != want {
+		t.Fatalf("service of 8080: %v, want %v", svc, want)
+	}
+	if services.sniffer(Forward, 8080) != nil {
+		t.Fatal("classified port should not be sniffed again")
+	}
+}
+
+// readerFromConn records if io.Copy takes the ReadFrom fast path
+type readerFromConn struct {
+	pipe
+	readFrom bool
+}
+
+func (c *readerFromConn) ReadFrom(r io.Reader) (int64, error) {
+	c.readFrom = true
+	return io.Copy(c.w, r)
+}
+
+func Test_spliceUncounted(t *testing.T) {
+	r1, w1 := io.Pipe()
+	r2, w2 := io.Pipe()
+	conn := &readerFromConn{pipe: pipe{r: r1, w: nopWriteCloser{io.Discard}}}
+	stream := &pipe{r: r2, w: nopWriteCloser{io.Discard}}
+
+	done := make(chan struct{})
+	var in, out uint64
+	go func() {
+		in, out = splice(conn, stream, nil, nil, true)
+		close(done)
+	}()
+	w1.Write([]byte("hello"))
+	w2.Write([]byte("world!"))
+	w1.Close()
+	w2.Close()
+	<-done
+
+	if in != 6 || out != 5 {
+		t.Fatalf("splice() = %d, %d, want 6, 5", in, out)
+	}
+	if !conn.readFrom {
+		t.Fatal("expected the connection to be written with ReadFrom")
+	}
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+func Test_processFilter(t *testing.T) {
+	p := NewProxyListener(newMockMux(), log.New(io.Discard, "", 0))
+	p.SetProcessNames(map[uint16]string{8080: "node", 5432: "postgres", 22: "sshd"})
+	tests := []struct {
+		include, exclude []string
+		port             uint16
+		excluded         bool
+	}{
+		{nil, nil, 22, false},
+		{nil, []string{"sshd"}, 22, true},
+		{nil, []string{"sshd"}, 8080, false},
+		{[]string{"node"}, nil, 8080, false},
+		{[]string{"node"}, nil, 5432, true},
+		{[]string{"node"}, nil, 9000, true}, // unknown owner
+	}
+	for _, tt := range tests {
+		p.SetProcessFilter(tt.include, tt.exclude)
+		if _, excluded := p.rule(tt.port); excluded != tt.excluded {
+			t.Errorf("rule(%d) with include %v exclude %v: excluded = %v, want %v", tt.port, tt.include, tt.exclude, excluded, tt.excluded)
+		}
+	}
+}
+
+func Test_pinFallback(t *testing.T) {
+	busy, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+	pinned := uint16(busy.Addr().(*net.TCPAddr).Port)
+
+	p := NewProxyListener(newMockMux(), log.New(io.Discard, "", 0))
+	p.SetBindAddress("127.0.0.1")
+	defer p.CloseAll()
+	p.Pin(9000, pinned)
+	if _, err := p.NewListener(9000); err == nil {
+		t.Fatal("expected the pinned port in use to fail")
+	}
+	p.SetPinFallback(true)
+	lport, err := p.NewListener(9000)
+	if err != nil || lport == pinned {
+		t.Fatalf("NewListener() = %d, %v, want another port than %d", lport, err, pinned)
+	}
+}
+
+func Test_ProbeHTTP(t *testing.T) {
+	tests := []struct {
+		name string
+		resp string
+		want bool
+	}{
+		{"HTTP", "HTTP/1.0 200 OK\r\n\r\n", true},
+		{"Not HTTP", "-ERR unknown command 'HEAD'\r\n", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newMockMux()
+			p := NewProxyListener(m, log.New(io.Discard, "", 0))
+			p.SetServices(NewServices())
+			go func() {
+				stream, _ := m.Accept()
+				buf := make([]byte, 2)
+				io.ReadFull(stream, buf)
+				io.ReadFull(stream, make([]byte, len("HEAD / HTTP/1.0\r\nHost: localhost\r\n\r\n")))
+				stream.Write([]byte(tt.resp))
+			}()
+			ok, err := p.ProbeHTTP(3000, time.Second)
+			if err != nil || ok != tt.want {
+				t.Fatalf("ProbeHTTP() = %v, %v, want %v", ok, err, tt.want)
+			}
+			if _, known := p.services.Get(Forward, 3000); known != tt.want {
+				t.Fatalf("service known: %v, want %v", known, tt.want)
+			}
+		})
+	}
+}
+
+func Test_socks(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		conn, err := echo.Accept()
+		if err == nil {
+			io.Copy(conn, conn)
+			conn.Close()
+		}
+	}()
+	closed, _ := net.Listen("tcp", "127.0.0.1:0")
+	closedPort := closed.Addr().(*net.TCPAddr).Port
+	closed.Close()
+
+	tests := []struct {
+		name   string
+		port   int
+		status byte
+	}{
+		{"Connected", echo.Addr().(*net.TCPAddr).Port, StatusOK},
+		{"Refused", closedPort, StatusRefused},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newMockMux()
+			logger := log.New(io.Discard, "", 0)
+			cli := NewProxyForwarder(m, logger)
+			go func() {
+				if stream, err := m.Accept(); err == nil {
+					cli.serveStream(stream)
+				}
+			}()
+			svr := NewSocksServer(m, "127.0.0.1:0", logger)
+			if err := svr.Listen(); err != nil {
+				t.Fatal(err)
+			}
+			defer svr.Close()
+			go svr.Serve()
+
+			conn, err := net.Dial("tcp", svr.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			conn.Write([]byte{5, 1, 0})
+			method := make([]byte, 2)
+			if _, err := io.ReadFull(conn, method); err != nil || method[1] != 0 {
+				t.Fatalf("method: %v, %v", method, err)
+			}
+			host := "localhost"
+			req := append([]byte{5, 1, 0, 3, byte(len(host))}, host...)
+			conn.Write(append(req, byte(tt.port>>8), byte(tt.port)))
+			reply := make([]byte, 10)
+			if _, err := io.ReadFull(conn, reply); err != nil || reply[1] != tt.status {
+				t.Fatalf("reply: %v, %v, want status %d", reply, err, tt.status)
+			}
+			if tt.status != StatusOK {
+				return
+			}
+			conn.Write([]byte("ping"))
+			buf := make([]byte, 4)
+			if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+				t.Fatalf("echo: %q, %v", buf, err)
+			}
+		})
+	}
+}
+
+// chanMux opens a new stream on every Connect, which is accepted by the other side
+type chanMux struct {
+	streams chan net.Conn
+}
+
+func newChanMux() *chanMux {
+	return &chanMux{streams: make(chan net.Conn)}
+}
+
+func (m *chanMux) Connect() (io.ReadWriteCloser, error) {
+	c1, c2 := net.Pipe()
+	m.streams <- c2
+	return c1, nil
+}
+
+func (m *chanMux) Accept() (io.ReadWriteCloser, error) {
+	return <-m.streams, nil
+}
+
+func (m *chanMux) Shutdown() error {
+	return nil
+}
+
+func Test_allowlist(t *testing.T) {
+	a, err := ParseAllowlist([]string{"10.0.0.0/8", "192.168.1.1", "svc.cluster.local", "*.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		addr    string
+		allowed bool
+	}{
+		{"10.1.2.3:80", true},
+		{"11.1.2.3:80", false},
+		{"192.168.1.1:22", true},
+		{"192.168.1.2:22", false},
+		{"svc.cluster.local:80", true},
+		{"db.default.svc.cluster.local:5432", true},
+		{"Example.COM:443", true},
+		{"www.example.com:443", true},
+		{"notexample.com:443", false},
+	}
+	for _, tt := range tests {
+		addr, err := a.Check(tt.addr)
+		if allowed := err == nil; allowed != tt.allowed || (allowed && addr != tt.addr) {
+			t.Errorf("Check(%s) = %s, %v, want allowed: %v", tt.addr, addr, err, tt.allowed)
+		}
+	}
+	if addr, err := (*Allowlist)(nil).Check("1.1.1.1:53"); err != nil || addr != "1.1.1.1:53" {
+		t.Errorf("nil allowlist should allow all, got %s, %v", addr, err)
+	}
+	if _, err := ParseAllowlist([]string{"10.0.0.0/33"}); err == nil {
+		t.Error("expected error for invalid CIDR")
+	}
+}
+
+func Test_HTTPProxy(t *testing.T) {
+	web := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "hello %s", r.URL.Path)
+	})}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go web.Serve(l)
+	defer web.Close()
+
+	tests := []struct {
+		name  string
+		allow []string
+		code  int
+	}{
+		{"Allowed", []string{"127.0.0.0/8"}, http.StatusOK},
+		{"Not allowed", []string{"10.0.0.0/8"}, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newChanMux()
+			logger := log.New(io.Discard, "", 0)
+			fwd := NewProxyForwarder(m, logger)
+			allowlist, _ := ParseAllowlist(tt.allow)
+			fwd.SetAllowlist(allowlist)
+			go fwd.Start()
+			p := NewHTTPProxy(m, "127.0.0.1:0", logger)
+			if err := p.Listen(); err != nil {
+				t.Fatal(err)
+			}
+			defer p.Close()
+			go p.Serve()
+			proxyURL, _ := url.Parse("http://" + p.Addr().String())
+
+			// Plain HTTP
+			client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}, Timeout: 5 * time.Second}
+			resp, err := client.Get("http://" + l.Addr().String() + "/world")
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != tt.code || (tt.code == http.StatusOK && string(body) != "hello /world") {
+				t.Fatalf("GET: %d %q, want %d", resp.StatusCode, body, tt.code)
+			}
+
+			// CONNECT
+			conn, err := net.Dial("tcp", p.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", l.Addr(), l.Addr())
+			br := bufio.NewReader(conn)
+			resp, err = http.ReadResponse(br, nil)
+			if err != nil || resp.StatusCode != tt.code {
+				t.Fatalf("CONNECT: %v, %v, want %d", resp, err, tt.code)
+			}
+			if tt.code != http.StatusOK {
+				return
+			}
+			fmt.Fprintf(conn, "GET /tunnel HTTP/1.1\r\nHost: %s\r\n\r\n", l.Addr())
+			resp, err = http.ReadResponse(br, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ = io.ReadAll(resp.Body)
+			if string(body) != "hello /tunnel" {
+				t.Fatalf("tunnel: %q", body)
+			}
+		})
+	}
+}
+
+func Test_destination(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	m := newChanMux()
+	logger := log.New(io.Discard, "", 0)
+	// The agent's listener of the reverse ports, and the local forwarder dialing the destinations
+	pl := NewProxyListener(m, logger)
+	pl.SetDestination(9000, echo.Addr().String())
+	pl.SetDestination(9001, "127.0.0.1:1")
+	pl.SetDestination(9002, echo.Addr().String())
+	pl.SetDestination(9003, echo.Addr().String())
+	pf := NewProxyForwarder(m, logger)
+	stats := NewStats()
+	pf.SetStats(stats)
+	// Two reverse ports to the same destination
+	pf.SetDestinations(map[uint16]string{9000: echo.Addr().String(), 9002: echo.Addr().String()})
+	go pf.Start()
+
+	buf := make([]byte, 4)
+	for _, rport := range []uint16{9000, 9002} {
+		c1, c2 := net.Pipe()
+		go pl.ServeConn(c2, rport)
+		c1.SetDeadline(time.Now().Add(5 * time.Second))
+		c1.Write([]byte("ping"))
+		if _, err := io.ReadFull(c1, buf); err != nil || string(buf) != "ping" {
+			t.Fatalf("echo of %d: %q, %v", rport, buf, err)
+		}
+		c1.Close()
+	}
+	for _, rport := range []uint16{9000, 9002} {
+		if st := stats.Get(Reverse, rport); st.Total != 1 {
+			t.Fatalf("unexpected stats of %d: %+v", rport, st)
+		}
+	}
+
+	// The destination not given to the forwarder is not dialed, nor the one given to another port
+	for _, rport := range []uint16{9001, 9003} {
+		c1, c2 := net.Pipe()
+		go pl.ServeConn(c2, rport)
+		c1.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err := c1.Read(buf); err != io.EOF {
+			t.Fatalf("expected the connection to %d to be closed, got %v", rport, err)
+		}
+	}
+}
+
+func Test_unixSocket(t *testing.T) {
+	dir := t.TempDir()
+	local := filepath.Join(dir, "local.sock")
+	echo, err := net.Listen("unix", local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	m := newChanMux()
+	logger := log.New(io.Discard, "", 0)
+	// The agent listens on the path for the port ID, and the local forwarder dials the local socket
+	remote := filepath.Join(dir, "remote", "agent.sock")
+	pl := NewProxyListener(m, logger)
+	pl.SetUnixPath(65535, remote)
+	pl.SetDestination(65535, UnixPrefix+local)
+	pf := NewProxyForwarder(m, logger)
+	pf.SetDestinations(map[uint16]string{65535: UnixPrefix + local})
+	go pf.Start()
+
+	if lport, err := pl.NewListener(65535); err != nil || lport != 65535 {
+		t.Fatalf("NewListener() = %d, %v", lport, err)
+	}
+	conn, err := net.DialTimeout("unix", remote, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("echo: %q, %v", buf, err)
+	}
+	conn.Close()
+
+	pl.CloseListener(65535)
+	if _, err := os.Stat(remote); !os.IsNotExist(err) {
+		t.Fatalf("expected the socket to be removed, got %v", err)
+	}
+
+	// The other unix sockets are not dialed
+	if _, err := DialAddr(m, 65535, UnixPrefix+filepath.Join(dir, "other.sock")); err == nil {
+		t.Fatal("expected the unix socket not to be dialed")
+	}
+}
+
+func Test_newUnixListener(t *testing.T) {
+	dir := t.TempDir()
+	pl := NewProxyListener(newChanMux(), log.New(io.Discard, "", 0))
+
+	live := filepath.Join(dir, "live.sock")
+	l, err := net.Listen("unix", live)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	stale := filepath.Join(dir, "stale.sock")
+	sl, err := net.Listen("unix", stale)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sl.(*net.UnixListener).SetUnlinkOnClose(false)
+	sl.Close()
+	file := filepath.Join(dir, "file")
+	os.WriteFile(file, nil, 0644)
+
+	if err := pl.newUnixListener(live, 65535); err == nil {
+		t.Fatal("expected the live socket not to be replaced")
+	}
+	if conn, err := net.Dial("unix", live); err != nil {
+		t.Fatalf("the live socket is broken: %s", err)
+	} else {
+		conn.Close()
+	}
+	if err := pl.newUnixListener(file, 65534); err == nil {
+		t.Fatal("expected the file not to be replaced")
+	}
+	if err := pl.newUnixListener(stale, 65533); err != nil {
+		t.Fatalf("expected the stale socket to be replaced, got %s", err)
+	}
+	pl.CloseAll()
+}
+
+func Test_sources(t *testing.T) {
+	sources, err := ParseSources([]string{"10.0.0.0/8", "6379=192.168.1.10", "5432=fd00::/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		port  uint16
+		ip    string
+		allow bool
+	}{
+		{8080, "10.1.2.3", true},
+		{8080, "192.168.1.10", false},
+		{8080, "127.0.0.1", true},
+		{6379, "192.168.1.10", true},
+		{6379, "192.168.1.11", false},
+		{6379, "10.1.2.3", true},
+		{5432, "fd00::1", true},
+		{5432, "::1", true},
+		{5432, "fe80::1", false},
+	}
+	for _, tt := range tests {
+		addr := &net.TCPAddr{IP: net.ParseIP(tt.ip), Port: 40000}
+		if got := sources.Allow(tt.port, addr); got != tt.allow {
+			t.Errorf("Allow(%d, %s) = %v, want %v", tt.port, tt.ip, got, tt.allow)
+		}
+	}
+
+	// Only the given ports are restricted without the sources of all the ports
+	sources, _ = ParseSources([]string{"6379=192.168.1.10"})
+	if !sources.Allow(8080, &net.TCPAddr{IP: net.ParseIP("192.0.2.1")}) {
+		t.Error("expected the other ports to be open")
+	}
+	if (*Sources)(nil).Allow(6379, &net.TCPAddr{IP: net.ParseIP("192.0.2.1")}) != true {
+		t.Error("expected nil Sources to allow all")
+	}
+	for _, entry := range []string{"", "10.0.0.0/33", "host", "0=10.0.0.1", "http=10.0.0.1", "6379="} {
+		if _, err := ParseSources([]string{entry}); err == nil {
+			t.Errorf("ParseSources(%q): expected error", entry)
+		}
+	}
+}
+
+// remoteConn is a connection from the remote address
+type remoteConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (c *remoteConn) RemoteAddr() net.Addr { return c.addr }
+
+type connListener struct {
+	conns chan net.Conn
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	conn, ok := <-l.conns
+	if !ok {
+		return nil, net.ErrClosed
+	}
+	return conn, nil
+}
+
+func (l *connListener) Close() error   { return nil }
+func (l *connListener) Addr() net.Addr { return &net.TCPAddr{} }
+
+func Test_listenLoopSources(t *testing.T) {
+	p := NewProxyListener(newMockMux(), log.New(io.Discard, "", 0))
+	sources, _ := ParseSources([]string{"10.0.0.0/8"})
+	p.SetSources(sources)
+	events := make(chan ConnEvent, 1)
+	p.SetConnCallback(func(ev ConnEvent) { events <- ev })
+
+	l := &connListener{conns: make(chan net.Conn, 1)}
+	go p.listenLoop(l, 6379)
+	c1, c2 := net.Pipe()
+	l.conns <- &remoteConn{Conn: c2, addr: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 40000}}
+	close(l.conns)
+
+	ev := <-events
+	if ev.Err != ErrSourceNotAllowed || ev.Port != 6379 || ev.Addr != "192.0.2.1:40000" {
+		t.Fatalf("unexpected event: %+v", ev)
+	}
+	c1.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c1.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected the connection to be closed, got %v", err)
+	}
+}
+
+func Test_serveConnSources(t *testing.T) {
+	p := NewProxyListener(newMockMux(), log.New(io.Discard, "", 0))
+	sources, _ := ParseSources([]string{"6379=10.0.0.0/8"})
+	p.SetSources(sources)
+	events := make(chan ConnEvent, 1)
+	p.SetConnCallback(func(ev ConnEvent) { events <- ev })
+
+	// The connections routed by the front proxy are checked as well
+	c1, c2 := net.Pipe()
+	go p.ServeConn(&remoteConn{Conn: c2, addr: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 40000}}, 6379)
+	if ev := <-events; ev.Err != ErrSourceNotAllowed || ev.Port != 6379 {
+		t.Fatalf("unexpected event: %+v", ev)
+	}
+	c1.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c1.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected the connection to be closed, got %v", err)
+	}
+}
+
+func Test_listenerConcurrency(t *testing.T) {
+	p := NewProxyListener(newMockMux(), log.New(io.Discard, "", 0))
+	p.SetBindAddress("127.0.0.1")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(rport uint16) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				lport, err := p.newListener(0, rport)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if !p.PortInUsed(lport) {
+					t.Errorf("port %d is not in use", lport)
+				}
+				if err := p.CloseListener(rport); err != nil {
+					t.Error(err)
+				}
+			}
+			p.newListener(0, rport)
+		}(uint16(9000 + i))
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for j := 0; j < 100; j++ {
+			for rport, lport := range p.PortMap() {
+				if rport < 9000 || lport == 0 {
+					t.Errorf("unexpected listener %d => %d", lport, rport)
+				}
+			}
+		}
+	}()
+	wg.Wait()
+
+	if portMap := p.PortMap(); len(portMap) != 4 {
+		t.Fatalf("unexpected listeners: %v", portMap)
+	}
+	p.CloseAll()
+	if portMap := p.PortMap(); len(portMap) != 0 {
+		t.Fatalf("unexpected listeners after CloseAll: %v", portMap)
+	}
+}
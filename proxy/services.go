@@ -0,0 +1,109 @@
+package proxy
+
+import (
+	"sync"
+
+	"github.com/ruoshan/autoportforward/sniff"
+)
+
+// Services holds the services of the ports classified by sniffing their first connections, it's
+// shared by the ProxyListener and ProxyForwarder like the Stats.
+type Services struct {
+	mu       sync.Mutex
+	ports    map[statsKey]sniff.Service
+	callback func(dir Direction, port uint16, svc sniff.Service)
+}
+
+func NewServices() *Services {
+	return &Services{
+		ports: make(map[statsKey]sniff.Service),
+	}
+}
+
+// SetCallback sets the callback that is invoked when the service of a port is classified.
+func (s *Services) SetCallback(cb func(dir Direction, port uint16, svc sniff.Service)) {
+	s.callback = cb
+}
+
+func (s *Services) Get(dir Direction, port uint16) (sniff.Service, bool) {
+	if s == nil {
+		return sniff.Service{}, false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	svc, ok := s.ports[statsKey{dir, port}]
+	return svc, ok
+}
+
+func (s *Services) set(dir Direction, port uint16, svc sniff.Service) {
+	s.mu.Lock()
+	old, ok := s.ports[statsKey{dir, port}]
+	s.ports[statsKey{dir, port}] = svc
+	s.mu.Unlock()
+	if (!ok || old != svc) && s.callback != nil {
+		s.callback(dir, port, svc)
+	}
+}
+
+// Forget removes the service of the port, eg. the port is closed so it may be reused by another service.
+func (s *Services) Forget(dir Direction, port uint16) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.ports, statsKey{dir, port})
+}
+
+// sniffer returns a sniffer for a new connection to the port, nil if the service is known already.
+func (s *Services) sniffer(dir Direction, port uint16) *sniffer {
+	if s == nil {
+		return nil
+	}
+	if _, ok := s.Get(dir, port); ok {
+		return nil
+	}
+	return &sniffer{onDetect: func(svc sniff.Service) {
+		s.set(dir, port, svc)
+	}}
+}
+
+// sniffer accumulates the first bytes of both directions of a connection until it's classified.
+type sniffer struct {
+	mu       sync.Mutex
+	client   []byte
+	server   []byte
+	done     bool
+	onDetect func(svc sniff.Service)
+}
+
+func (s *sniffer) feedClient(b []byte) {
+	s.feed(&s.client, b)
+}
+
+func (s *sniffer) feedServer(b []byte) {
+	s.feed(&s.server, b)
+}
+
+func (s *sniffer) feed(buf *[]byte, b []byte) {
+	s.mu.Lock()
+	if s.done {
+		s.mu.Unlock()
+		return
+	}
+	if room := sniff.MaxPeek - len(*buf); room > 0 {
+		if len(b) > room {
+			b = b[:room]
+		}
+		*buf = append(*buf, b...)
+	}
+	svc, ok := sniff.Classify(s.client, s.server)
+	if ok || len(s.client) >= sniff.MaxPeek || len(s.server) >= sniff.MaxPeek {
+		s.done = true
+		s.client, s.server = nil, nil
+	}
+	s.mu.Unlock()
+	if ok {
+		s.onDetect(svc)
+	}
+}
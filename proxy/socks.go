@@ -0,0 +1,182 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/ruoshan/autoportforward/mux"
+)
+
+const (
+	socksVersion    = 0x05
+	socksNoAuth     = 0x00
+	socksNoMethod   = 0xff
+	socksConnect    = 0x01
+	socksIPv4       = 0x01
+	socksDomain     = 0x03
+	socksIPv6       = 0x04
+	socksNoCommand  = 0x07
+	socksNoAddrType = 0x08
+)
+
+// The time to negotiate the SOCKS request
+const socksTimeout = 10 * time.Second
+
+// SocksServer is a SOCKS5 server (CONNECT only, no authentication) whose connections are dialed by the
+// forwarder on the other side of the mux, so that the addresses reachable from the container (eg. the
+// other pods, the internal DNS names) are reachable locally.
+type SocksServer struct {
+	muxClient mux.MuxClient
+	addr      string
+	logger    *log.Logger
+	listener  net.Listener
+}
+
+func NewSocksServer(m mux.MuxClient, addr string, logger *log.Logger) *SocksServer {
+	return &SocksServer{
+		muxClient: m,
+		addr:      addr,
+		logger:    logger,
+	}
+}
+
+func (s *SocksServer) Listen() error {
+	l, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return err
+	}
+	s.listener = l
+	return nil
+}
+
+// Addr returns the listening address, it's only valid after Listen.
+func (s *SocksServer) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+func (s *SocksServer) Serve() {
+	s.logger.Printf("Serving SOCKS5 on %s", s.listener.Addr())
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *SocksServer) Close() error {
+	return s.listener.Close()
+}
+
+func (s *SocksServer) handle(conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(socksTimeout))
+	addr, err := socksHandshake(conn)
+	if err != nil {
+		s.logger.Printf("SOCKS5: %s", err)
+		conn.Close()
+		return
+	}
+	stream, err := DialAddr(s.muxClient, 0, addr)
+	if err != nil {
+		s.logger.Printf("SOCKS5: %s", err)
+		status := StatusFailure
+		var dialErr *DialError
+		if errors.As(err, &dialErr) {
+			status = dialErr.Status
+		}
+		socksReply(conn, status)
+		conn.Close()
+		return
+	}
+	if err := socksReply(conn, StatusOK); err != nil {
+		stream.Close()
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	s.logger.Printf("SOCKS5: connected to %s", addr)
+	in, out := splice(conn, stream, nil, nil, true)
+	s.logger.Printf("SOCKS5: disconnected from %s, %d bytes in, %d bytes out", addr, in, out)
+}
+
+// socksHandshake negotiates the method and reads the CONNECT request, it returns the requested address.
+func socksHandshake(conn io.ReadWriter) (string, error) {
+	// Version, number of methods, methods
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return "", err
+	}
+	if buf[0] != socksVersion {
+		return "", fmt.Errorf("unsupported version: %d", buf[0])
+	}
+	methods := make([]byte, buf[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return "", err
+	}
+	method := byte(socksNoMethod)
+	for _, m := range methods {
+		if m == socksNoAuth {
+			method = socksNoAuth
+		}
+	}
+	if _, err := conn.Write([]byte{socksVersion, method}); err != nil {
+		return "", err
+	}
+	if method == socksNoMethod {
+		return "", errors.New("no acceptable authentication method")
+	}
+
+	// Version, command, reserved, address type, address, port
+	buf = make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return "", err
+	}
+	if buf[1] != socksConnect {
+		socksReply(conn, socksNoCommand)
+		return "", fmt.Errorf("unsupported command: %d", buf[1])
+	}
+	var host string
+	switch buf[3] {
+	case socksIPv4, socksIPv6:
+		ip := make([]byte, net.IPv4len)
+		if buf[3] == socksIPv6 {
+			ip = make([]byte, net.IPv6len)
+		}
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return "", err
+		}
+		host = net.IP(ip).String()
+	case socksDomain:
+		size := make([]byte, 1)
+		if _, err := io.ReadFull(conn, size); err != nil {
+			return "", err
+		}
+		domain := make([]byte, size[0])
+		if _, err := io.ReadFull(conn, domain); err != nil {
+			return "", err
+		}
+		host = string(domain)
+	default:
+		socksReply(conn, socksNoAddrType)
+		return "", fmt.Errorf("unsupported address type: %d", buf[3])
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+// socksReply replies the status of the request, the bound address is not known (0.0.0.0:0).
+func socksReply(w io.Writer, status byte) error {
+	_, err := w.Write([]byte{socksVersion, status, 0, socksIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
@@ -0,0 +1,92 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+var ErrSourceNotAllowed = errors.New("source address is not allowed")
+
+// Sources restricts the source addresses of the connections to the local listeners, when they are bound
+// beyond the loopback. The entries are:
+//   - CIDR or IP, eg. 192.168.1.0/24: allowed to connect to all the ports
+//   - {remote port}={CIDR or IP}, eg. 6379=192.168.1.10: allowed to connect to the port
+//
+// The ports without any allowed source are open to all, the loopback is always allowed.
+type Sources struct {
+	all   []*net.IPNet
+	ports map[uint16][]*net.IPNet // remote port => the allowed sources
+}
+
+func ParseSources(entries []string) (*Sources, error) {
+	s := &Sources{ports: make(map[uint16][]*net.IPNet)}
+	for _, e := range entries {
+		e = strings.TrimSpace(e)
+		var port uint64
+		if splits := strings.SplitN(e, "=", 2); len(splits) == 2 {
+			var err error
+			if port, err = strconv.ParseUint(splits[0], 10, 16); err != nil || port == 0 {
+				return nil, fmt.Errorf("invalid source: %s", e)
+			}
+			e = splits[1]
+		}
+		ipnet, err := parseIPNet(e)
+		if err != nil {
+			return nil, fmt.Errorf("invalid source: %s", e)
+		}
+		if port == 0 {
+			s.all = append(s.all, ipnet)
+		} else {
+			s.ports[uint16(port)] = append(s.ports[uint16(port)], ipnet)
+		}
+	}
+	return s, nil
+}
+
+// parseIPNet parses the CIDR, or the IP as a single address CIDR
+func parseIPNet(s string) (*net.IPNet, error) {
+	if strings.Contains(s, "/") {
+		_, ipnet, err := net.ParseCIDR(s)
+		return ipnet, err
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, errors.New("invalid IP")
+	}
+	bits := 8 * net.IPv6len
+	if ip.To4() != nil {
+		ip, bits = ip.To4(), 8*net.IPv4len
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
+
+// Allow returns true if the source address is allowed to connect to the remote port (rport). A nil
+// Sources allows all the addresses.
+func (s *Sources) Allow(rport uint16, addr net.Addr) bool {
+	if s == nil || len(s.all)+len(s.ports[rport]) == 0 {
+		return true
+	}
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		// Not from the network, eg. the unix sockets
+		return true
+	}
+	if tcpAddr.IP.IsLoopback() {
+		return true
+	}
+	// Not appended to one slice, it may write to the backing array shared by the connections
+	for _, n := range s.ports[rport] {
+		if n.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	for _, n := range s.all {
+		if n.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
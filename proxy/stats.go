@@ -0,0 +1,150 @@
+package proxy
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+type Direction uint8
+
+const (
+	Forward Direction = iota // local listener ==> remote port
+	Reverse                  // local port <== remote listener
+)
+
+// PortStats holds the live counters of one forwarded port. All the fields are updated atomically.
+type PortStats struct {
+	Conns    int64  // currently opened connections
+	Total    int64  // connections opened since the port was forwarded
+	BytesIn  uint64 // bytes received from the remote side
+	BytesOut uint64 // bytes sent to the remote side
+}
+
+type statsKey struct {
+	dir  Direction
+	port uint16
+}
+
+// Stats collects the per-port counters of the proxies, it's shared by the ProxyListener and ProxyForwarder
+// so that the status consumers (eg. the dashboard) can display them.
+type Stats struct {
+	mu    sync.Mutex
+	ports map[statsKey]*PortStats
+}
+
+func NewStats() *Stats {
+	return &Stats{
+		ports: make(map[statsKey]*PortStats),
+	}
+}
+
+// Port returns the counters of the target port, creating them if needed. A nil Stats returns nil,
+// the traffic isn't counted then, see splice.
+func (s *Stats) Port(dir Direction, port uint16) *PortStats {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k := statsKey{dir, port}
+	ps, ok := s.ports[k]
+	if !ok {
+		ps = &PortStats{}
+		s.ports[k] = ps
+	}
+	return ps
+}
+
+// Get returns a copy of the counters of the target port.
+func (s *Stats) Get(dir Direction, port uint16) PortStats {
+	ps := s.Port(dir, port)
+	if ps == nil {
+		return PortStats{}
+	}
+	return PortStats{
+		Conns:    atomic.LoadInt64(&ps.Conns),
+		Total:    atomic.LoadInt64(&ps.Total),
+		BytesIn:  atomic.LoadUint64(&ps.BytesIn),
+		BytesOut: atomic.LoadUint64(&ps.BytesOut),
+	}
+}
+
+// ConnEvent is reported by the proxies when a connection is opened, closed or failed to be established.
+type ConnEvent struct {
+	Dir      Direction
+	Port     uint16 // the target port
+	Addr     string // the address of the local end of the connection
+	Opened   bool
+	BytesIn  uint64 // only set when closed
+	BytesOut uint64 // only set when closed
+	Err      error
+}
+
+type countingWriter struct {
+	w        io.Writer
+	counter  *uint64 // optional
+	subtotal uint64
+	peek     func(b []byte) // optional
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	if c.peek != nil {
+		c.peek(b)
+	}
+	n, err := c.w.Write(b)
+	if c.counter != nil {
+		atomic.AddUint64(c.counter, uint64(n))
+	}
+	c.subtotal += uint64(n)
+	return n, err
+}
+
+// copyCounted copies from src to dst, it returns the bytes copied. dst is only wrapped when the bytes
+// have to be counted as they go or peeked, so that io.Copy can take the fast path (eg. splice(2))
+// of the connections otherwise.
+func copyCounted(dst io.Writer, src io.Reader, counter *uint64, peek func(b []byte)) uint64 {
+	if counter == nil && peek == nil {
+		n, _ := io.Copy(dst, src)
+		return uint64(n)
+	}
+	w := &countingWriter{w: dst, counter: counter, peek: peek}
+	io.Copy(w, src)
+	return w.subtotal
+}
+
+// splice copies data in both directions between the local connection and the mux stream until
+// both sides are done, accounting the connection and the traffic in ps if it's not nil. It returns
+// the bytes transferred in each direction of this connection. The first bytes are fed to the sniffer
+// if it's not nil, connIsClient tells which side is the client.
+func splice(conn, stream io.ReadWriteCloser, ps *PortStats, sn *sniffer, connIsClient bool) (bytesIn, bytesOut uint64) {
+	var inCounter, outCounter *uint64
+	if ps != nil {
+		atomic.AddInt64(&ps.Conns, 1)
+		atomic.AddInt64(&ps.Total, 1)
+		defer atomic.AddInt64(&ps.Conns, -1)
+		inCounter, outCounter = &ps.BytesIn, &ps.BytesOut
+	}
+	var inPeek, outPeek func(b []byte)
+	if sn != nil {
+		// The bytes written to the conn are from the other side
+		inPeek, outPeek = sn.feedClient, sn.feedServer
+		if connIsClient {
+			inPeek, outPeek = sn.feedServer, sn.feedClient
+		}
+	}
+	wg := sync.WaitGroup{}
+	wg.Add(2)
+	go func() {
+		bytesIn = copyCounted(conn, stream, inCounter, inPeek)
+		conn.Close()
+		wg.Done()
+	}()
+	go func() {
+		bytesOut = copyCounted(stream, conn, outCounter, outPeek)
+		stream.Close()
+		wg.Done()
+	}()
+	wg.Wait()
+	return bytesIn, bytesOut
+}
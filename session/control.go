@@ -0,0 +1,182 @@
+package session
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/ruoshan/autoportforward/control"
+	"github.com/ruoshan/autoportforward/proxy"
+)
+
+// Session serves the control API of itself
+var _ control.Backend = &Session{}
+
+func (s *Session) Status() control.Status {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := control.Status{
+		Target:  s.opts.Target,
+		Ports:   make([]control.Port, 0, 10),
+		Reverse: append([]uint16{}, s.reversePorts...),
+		Dests:   make(map[uint16]string),
+		Sockets: make(map[string]string),
+	}
+	for port, dest := range s.dests {
+		st.Dests[port] = dest
+	}
+	for path, local := range s.sockets {
+		st.Sockets[path] = local
+	}
+	localPortMap, peerPortMap := s.mgr.PortMaps()
+	procs := s.mgr.Processes()
+	for targetPort, listenPort := range localPortMap {
+		port := control.Port{Direction: "forward", Local: listenPort, Remote: targetPort, Paused: s.pl.IsPaused(targetPort)}
+		if p, ok := procs[targetPort]; ok {
+			port.Process = &control.Process{PID: p.PID, UID: p.UID, Name: p.Name, Command: p.Command}
+		}
+		if svc, ok := s.services.Get(proxy.Forward, targetPort); ok {
+			port.Service = svc.String()
+		}
+		st.Ports = append(st.Ports, port)
+	}
+	for targetPort, listenPort := range peerPortMap {
+		port := control.Port{Direction: "reverse", Local: targetPort, Remote: listenPort, Paused: s.pf.IsPaused(targetPort)}
+		if svc, ok := s.services.Get(proxy.Reverse, targetPort); ok {
+			port.Service = svc.String()
+		}
+		st.Ports = append(st.Ports, port)
+	}
+	sort.Slice(st.Ports, func(i, j int) bool {
+		if st.Ports[i].Direction != st.Ports[j].Direction {
+			return st.Ports[i].Direction < st.Ports[j].Direction
+		}
+		return st.Ports[i].Local < st.Ports[j].Local
+	})
+	st.Pinned, st.Excluded = s.pl.Rules()
+	sort.Slice(st.Excluded, func(i, j int) bool { return st.Excluded[i] < st.Excluded[j] })
+	return st
+}
+
+// AddReversePort forwards the port in the container back to the destination, or the same local port if
+// it's empty. The destination of a port already forwarded is replaced.
+func (s *Session) AddReversePort(port uint16, dest string) error {
+	if dest != "" {
+		if _, _, err := net.SplitHostPort(dest); err != nil {
+			return fmt.Errorf("invalid destination: %s", dest)
+		}
+	}
+	s.mu.Lock()
+	found := false
+	for _, p := range s.reversePorts {
+		found = found || p == port
+	}
+	if !found {
+		s.reversePorts = append(s.reversePorts, port)
+	}
+	if dest == "" {
+		delete(s.dests, port)
+	} else {
+		s.dests[port] = dest
+	}
+	s.mu.Unlock()
+	s.updateReversePorts()
+	s.changed()
+	return nil
+}
+
+func (s *Session) RemoveReversePort(port uint16) error {
+	s.mu.Lock()
+	ports := make([]uint16, 0, len(s.reversePorts))
+	for _, p := range s.reversePorts {
+		if p != port {
+			ports = append(ports, p)
+		}
+	}
+	s.reversePorts = ports
+	delete(s.dests, port)
+	s.mu.Unlock()
+	s.updateReversePorts()
+	s.changed()
+	return nil
+}
+
+// AddUnixSocket forwards the local unix socket to the path in the container, the agent creates the socket.
+// The local socket of a path already forwarded is replaced.
+func (s *Session) AddUnixSocket(path, local string) error {
+	if !strings.HasPrefix(path, "/") || local == "" {
+		return fmt.Errorf("invalid unix socket forwarding: %s => %s", local, path)
+	}
+	s.mu.Lock()
+	s.sockets[path] = local
+	s.mu.Unlock()
+	s.updateReversePorts()
+	s.changed()
+	return nil
+}
+
+func (s *Session) RemoveUnixSocket(path string) error {
+	s.mu.Lock()
+	delete(s.sockets, path)
+	s.mu.Unlock()
+	s.updateReversePorts()
+	s.changed()
+	return nil
+}
+
+// SetReversePorts replaces the reverse ports, their destinations and the unix sockets, eg. with the
+// reloaded configuration.
+func (s *Session) SetReversePorts(ports []uint16, dests map[uint16]string, sockets map[string]string) {
+	s.mu.Lock()
+	s.reversePorts = append([]uint16{}, ports...)
+	s.dests = make(map[uint16]string)
+	for port, dest := range dests {
+		s.dests[port] = dest
+	}
+	s.sockets = make(map[string]string)
+	for path, local := range sockets {
+		s.sockets[path] = local
+	}
+	s.mu.Unlock()
+	s.updateReversePorts()
+	s.changed()
+}
+
+func (s *Session) Pin(rport, lport uint16) error {
+	s.pl.Pin(rport, lport)
+	s.mgr.RefreshPorts([]uint16{rport})
+	s.changed()
+	return nil
+}
+
+func (s *Session) Unpin(rport uint16) error {
+	s.pl.Unpin(rport)
+	s.mgr.RefreshPorts([]uint16{rport})
+	s.changed()
+	return nil
+}
+
+func (s *Session) Exclude(rport uint16) error {
+	s.pl.Exclude(rport)
+	s.mgr.RefreshPorts([]uint16{rport})
+	s.changed()
+	return nil
+}
+
+func (s *Session) Unexclude(rport uint16) error {
+	s.pl.Unexclude(rport)
+	s.mgr.RefreshPorts([]uint16{rport})
+	s.changed()
+	return nil
+}
+
+func (s *Session) changed() {
+	if s.changeCb != nil {
+		s.changeCb()
+	}
+}
+
+func (s *Session) Shutdown() {
+	s.mgr.Shutdown()
+}
@@ -0,0 +1,137 @@
+package session
+
+import (
+	"net"
+	"sort"
+
+	"github.com/ruoshan/autoportforward/portscan"
+	"github.com/ruoshan/autoportforward/proxy"
+)
+
+// scanReversePorts discovers the local listeners in the ReverseScan ranges and forwards them back to
+// the container, along with the given reverse ports, until the session is over.
+func (s *Session) scanReversePorts() {
+	s.logger.Println("Scanning local listeners for reverse forwarding")
+	scanner := &portscan.TCPListenerScanner{Done: s.done}
+	listenersCh := make(chan []portscan.Listener)
+	go scanner.Run(listenersCh)
+	for {
+		select {
+		case <-s.done:
+			return
+		case listeners := <-listenersCh:
+			ports := make([]uint16, 0)
+			for _, p := range portscan.Ports(listeners) {
+				if s.reverseScanned(p) {
+					ports = append(ports, p)
+				}
+			}
+			s.mu.Lock()
+			s.scanned = ports
+			s.mu.Unlock()
+			s.updateReversePorts()
+		}
+	}
+}
+
+// reverseScanned returns true if the local listening port is to be forwarded back, the listeners of apf
+// itself (the forwarded ports and the proxies) are skipped.
+func (s *Session) reverseScanned(port uint16) bool {
+	if s.pl.PortInUsed(port) {
+		return false
+	}
+	for _, addr := range []net.Addr{s.SocksAddr(), s.HTTPProxyAddr()} {
+		if tcpAddr, ok := addr.(*net.TCPAddr); ok && tcpAddr.Port == int(port) {
+			return false
+		}
+	}
+	for _, r := range s.opts.ReverseScan {
+		if r.Contains(port) {
+			return true
+		}
+	}
+	return false
+}
+
+// updateReversePorts advertises the given and the discovered reverse ports, and the unix sockets. s.mu is
+// not held while waiting for the peer, so that the status isn't blocked by a slow peer.
+func (s *Session) updateReversePorts() {
+	s.updateMu.Lock()
+	defer s.updateMu.Unlock()
+	s.mu.Lock()
+	ports, dests, peerPaths := s.reverseTargets()
+	s.mu.Unlock()
+
+	s.mgr.SetPeerDestinations(dests)
+	s.mgr.SetPeerPaths(peerPaths)
+	s.pf.SetDestinations(dests)
+	s.mgr.UpdatePeerPorts(ports)
+}
+
+// reverseTargets returns the reverse ports, their destinations and the unix socket paths of the port IDs,
+// the caller holds s.mu.
+func (s *Session) reverseTargets() (ports []uint16, dests map[uint16]string, peerPaths map[uint16]string) {
+	ports = append([]uint16{}, s.reversePorts...)
+	for _, p := range s.scanned {
+		dup := false
+		for _, q := range s.reversePorts {
+			dup = dup || p == q
+		}
+		if !dup {
+			ports = append(ports, p)
+		}
+	}
+
+	dests = make(map[uint16]string)
+	for port, dest := range s.dests {
+		dests[port] = dest
+	}
+	for path := range s.socketIDs {
+		if _, ok := s.sockets[path]; !ok {
+			delete(s.socketIDs, path)
+		}
+	}
+	paths := make([]string, 0, len(s.sockets))
+	for path := range s.sockets {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	peerPaths = make(map[uint16]string)
+	for _, path := range paths {
+		id := s.socketID(path, ports)
+		if id == 0 {
+			s.logger.Printf("No port ID left for the unix socket: %s", path)
+			continue
+		}
+		ports = append(ports, id)
+		dests[id] = proxy.UnixPrefix + s.sockets[path]
+		peerPaths[id] = path
+	}
+	return ports, dests, peerPaths
+}
+
+// socketID returns the port ID of the unix socket of the path in the container, the caller holds s.mu. The
+// IDs are allocated downwards from 65535 skipping the used ports, and kept while the socket is forwarded,
+// unless the ID is taken by a reverse port added later.
+func (s *Session) socketID(path string, used []uint16) uint16 {
+	inUse := make(map[uint16]bool)
+	for _, p := range used {
+		inUse[p] = true
+	}
+	if id, ok := s.socketIDs[path]; ok {
+		if !inUse[id] {
+			return id
+		}
+		delete(s.socketIDs, path)
+	}
+	for _, id := range s.socketIDs {
+		inUse[id] = true
+	}
+	for id := uint16(65535); id > 0; id-- {
+		if !inUse[id] {
+			s.socketIDs[path] = id
+			return id
+		}
+	}
+	return 0
+}
@@ -0,0 +1,21 @@
+package session
+
+import "testing"
+
+func Test_socketID(t *testing.T) {
+	s := &Session{socketIDs: make(map[string]uint16)}
+	if id := s.socketID("/tmp/a.sock", []uint16{9090}); id != 65535 {
+		t.Fatalf("socketID() = %d, want 65535", id)
+	}
+	if id := s.socketID("/tmp/b.sock", []uint16{9090, 65535}); id != 65534 {
+		t.Fatalf("socketID() = %d, want 65534", id)
+	}
+	// Kept while forwarded
+	if id := s.socketID("/tmp/a.sock", []uint16{9090}); id != 65535 {
+		t.Fatalf("socketID() = %d, want 65535", id)
+	}
+	// Reallocated when a reverse port takes the ID
+	if id := s.socketID("/tmp/a.sock", []uint16{9090, 65535}); id != 65533 {
+		t.Fatalf("socketID() = %d, want 65533", id)
+	}
+}
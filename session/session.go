@@ -0,0 +1,400 @@
+// Package session sets up the forwarding to one container: it bootstraps the agent, establishes the
+// mux over the agent's stdio and wires the manager with the proxies.
+package session
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ruoshan/autoportforward/bootstrap"
+	"github.com/ruoshan/autoportforward/control"
+	"github.com/ruoshan/autoportforward/front"
+	"github.com/ruoshan/autoportforward/manager"
+	"github.com/ruoshan/autoportforward/mux"
+	"github.com/ruoshan/autoportforward/portscan"
+	"github.com/ruoshan/autoportforward/proxy"
+	"github.com/ruoshan/autoportforward/sniff"
+)
+
+type Options struct {
+	Runtime      bootstrap.RTType
+	Target       string // container ID / name, or {namespace}/{pod ID} for Kubernetes
+	ReversePorts []uint16
+	Destinations map[uint16]string    // reverse port => the destination dialed locally, the same local port if not set
+	ReverseScan  []portscan.PortRange // if not empty, the local listeners in the ranges are forwarded back as well
+	UnixSockets  map[string]string    // the path in the container => the local unix socket forwarded to it
+	Include      []uint16             // if not empty, only these remote ports are forwarded
+	Exclude      []uint16             // remote ports not to be forwarded
+	Pins         map[uint16]uint16    // remote port => local port
+	PinFallback  bool                 // the pinned ports in use are allocated as the unpinned ones
+	Processes    []string             // if not empty, only the ports owned by these processes are forwarded
+	ExcludeProcs []string             // the ports owned by these processes are not forwarded
+	Bind         string               // the address of the local listeners
+	Debug        bool                 // let the agent log debug info
+	ScanMin      time.Duration        // the min interval of the port scanning in the container, optional
+	ScanMax      time.Duration        // the max interval of the port scanning in the container, optional
+	Probe        string               // the readiness probe of the ports in the container, see portscan.ParseProber
+	Debounce     time.Duration        // the debounce of the port changes in the container
+	Socks        string               // the address of the SOCKS5 server dialing from the container, optional
+	HTTPProxy    string               // the address of the HTTP proxy dialing from the container, optional
+	Allow        []string             // the CIDRs / domains allowed to be dialed from the container, all if empty
+	Encrypt      bool                 // encrypt the tunnel to the agent, see mux.Tunnel
+	Sources      *proxy.Sources       // the source addresses allowed to connect to the local listeners, all if nil
+	Stats        *proxy.Stats         // optional
+}
+
+func (o Options) agentArgs() []string {
+	args := make([]string, 0, 3)
+	if o.Debug {
+		args = append(args, "-d")
+	}
+	if o.ScanMin > 0 {
+		args = append(args, "-scan-min="+o.ScanMin.String())
+	}
+	if o.ScanMax > 0 {
+		args = append(args, "-scan-max="+o.ScanMax.String())
+	}
+	if o.Probe != "" {
+		args = append(args, "-probe="+o.Probe)
+	}
+	if o.Debounce > 0 {
+		args = append(args, "-debounce="+o.Debounce.String())
+	}
+	if len(o.Allow) > 0 {
+		args = append(args, "-allow="+strings.Join(o.Allow, ","))
+	}
+	return args
+}
+
+type Session struct {
+	opts         Options
+	logger       *log.Logger
+	ms           *mux.CmdPipeMuxServer
+	mgr          *manager.Manager
+	pl           *proxy.ProxyListener
+	pf           *proxy.ProxyForwarder
+	services     *proxy.Services
+	serviceCb    func(dir proxy.Direction, port uint16, svc sniff.Service)
+	changeCb     func()
+	ctlServer    *control.Server
+	socks        *proxy.SocksServer
+	httpProxy    *proxy.HTTPProxy
+	done         chan struct{}
+	updateMu     sync.Mutex // serializes the updateReversePorts
+	mu           sync.Mutex
+	reversePorts []uint16          // guarded by mu
+	dests        map[uint16]string // the destinations of the reverse ports, guarded by mu
+	sockets      map[string]string // the path in the container => the local unix socket, guarded by mu
+	socketIDs    map[string]uint16 // the path in the container => the port ID of the socket, guarded by mu
+	scanned      []uint16          // the discovered local listeners, guarded by mu
+}
+
+// New bootstraps the agent into the target container and establishes the connection to it.
+func New(opts Options, logger *log.Logger) (*Session, error) {
+	// Bootstrap: copy the agent(tar archive) into the container
+	logger.Println("Bootstraping")
+	msg, err := bootstrap.Bootstrap(opts.Runtime, opts.Target)
+	if err != nil {
+		if len(msg) > 0 {
+			err = fmt.Errorf("%s: %s", err, bytes.TrimSpace(msg))
+		}
+		return nil, fmt.Errorf("failed to bootstrap: %s", err)
+	}
+
+	args := opts.agentArgs()
+	var tunnel *mux.Tunnel
+	if opts.Encrypt {
+		if tunnel, err = mux.NewTunnel(); err != nil {
+			return nil, fmt.Errorf("failed to create the tunnel key: %s", err)
+		}
+		args = append(args, "-tunnel="+tunnel.Secret())
+	}
+	cmd := bootstrap.AgentCommand(opts.Runtime, opts.Target, args...)
+	logger.Println("Creating pipe mux server")
+	var ms *mux.CmdPipeMuxServer
+	if tunnel != nil {
+		if ms, err = mux.NewSecureCmdPipeMuxServer(tunnel, cmd[0], cmd[1:]...); err != nil {
+			return nil, err
+		}
+	} else if ms = mux.NewCmdPipeMuxServer(cmd[0], cmd[1:]...); ms == nil {
+		return nil, fmt.Errorf("failed to create mux server")
+	}
+
+	logger.Println("Starting manager")
+	// Open two streams for manager. NB: the order of Accept() is different from Connect() in the remote agent
+	mgrReceivingStream, err := ms.Accept()
+	if err != nil {
+		ms.Shutdown()
+		return nil, fmt.Errorf("failed to establish manager stream: %s", err)
+	}
+	mgrSendingStream, err := ms.Accept()
+	if err != nil {
+		ms.Shutdown()
+		return nil, fmt.Errorf("failed to establish manager stream: %s", err)
+	}
+	mgr := manager.NewManager(mgrReceivingStream, mgrSendingStream, logger, func() {
+		ms.Shutdown()
+	})
+
+	pl := proxy.NewProxyListener(ms, logger)
+	pf := proxy.NewProxyForwarder(ms, logger)
+	pl.SetBindAddress(opts.Bind)
+	pl.SetSources(opts.Sources)
+	pl.SetIncluded(opts.Include)
+	for _, rport := range opts.Exclude {
+		pl.Exclude(rport)
+	}
+	for rport, lport := range opts.Pins {
+		pl.Pin(rport, lport)
+	}
+	pl.SetPinFallback(opts.PinFallback)
+	pl.SetProcessFilter(opts.Processes, opts.ExcludeProcs)
+	pl.SetStats(opts.Stats)
+	pf.SetStats(opts.Stats)
+	services := proxy.NewServices()
+	pl.SetServices(services)
+	pf.SetServices(services)
+	mgr.SetCallbacks(pl.NewListener, pl.CloseListener)
+	mgr.SetPeerDestinations(opts.Destinations)
+	pf.SetDestinations(opts.Destinations)
+	mgr.SetProcessCallback(func(procs map[uint16]portscan.Process) {
+		names := make(map[uint16]string)
+		for port, p := range procs {
+			names[port] = p.Name
+		}
+		pl.SetProcessNames(names)
+	})
+
+	var socks *proxy.SocksServer
+	if opts.Socks != "" {
+		socks = proxy.NewSocksServer(ms, opts.Socks, logger)
+		if err := socks.Listen(); err != nil {
+			ms.Shutdown()
+			return nil, fmt.Errorf("failed to listen SOCKS5: %s", err)
+		}
+	}
+	var httpProxy *proxy.HTTPProxy
+	if opts.HTTPProxy != "" {
+		httpProxy = proxy.NewHTTPProxy(ms, opts.HTTPProxy, logger)
+		if err := httpProxy.Listen(); err != nil {
+			if socks != nil {
+				socks.Close()
+			}
+			ms.Shutdown()
+			return nil, fmt.Errorf("failed to listen HTTP proxy: %s", err)
+		}
+	}
+
+	s := &Session{
+		opts:         opts,
+		logger:       logger,
+		ms:           ms,
+		mgr:          mgr,
+		pl:           pl,
+		pf:           pf,
+		services:     services,
+		socks:        socks,
+		httpProxy:    httpProxy,
+		done:         make(chan struct{}),
+		reversePorts: append([]uint16{}, opts.ReversePorts...),
+		dests:        make(map[uint16]string),
+		sockets:      make(map[string]string),
+		socketIDs:    make(map[string]uint16),
+	}
+	for port, dest := range opts.Destinations {
+		s.dests[port] = dest
+	}
+	for path, local := range opts.UnixSockets {
+		s.sockets[path] = local
+	}
+	services.SetCallback(func(dir proxy.Direction, port uint16, svc sniff.Service) {
+		logger.Printf("Service of port %d: %s", port, svc)
+		if s.serviceCb != nil {
+			s.serviceCb(dir, port, svc)
+		}
+		s.mgr.DumpPorts()
+	})
+	return s, nil
+}
+
+func (s *Session) Target() string {
+	return s.opts.Target
+}
+
+func (s *Session) ProxyListener() *proxy.ProxyListener {
+	return s.pl
+}
+
+func (s *Session) ProxyForwarder() *proxy.ProxyForwarder {
+	return s.pf
+}
+
+func (s *Session) Services() *proxy.Services {
+	return s.services
+}
+
+// SetServiceCallback sets the callback that is invoked when the service of a port is classified.
+func (s *Session) SetServiceCallback(cb func(dir proxy.Direction, port uint16, svc sniff.Service)) {
+	s.serviceCb = cb
+}
+
+// SetChangeCallback sets the callback that is invoked after the reverse ports, the unix sockets or the
+// port rules are changed at runtime, eg. by `apf ctl`. It must be called before Run.
+func (s *Session) SetChangeCallback(cb func()) {
+	s.changeCb = cb
+}
+
+// PortLabel describes the target port with its URL, owning process and service, eg.
+// "http://localhost:8080 (node server.js, http)". It's meant to be used with manager.DumpWithLabelsToStderr.
+func (s *Session) PortLabel(reverse bool, targetPort uint16) string {
+	labels := make([]string, 0, 2)
+	dir := proxy.Forward
+	if reverse {
+		dir = proxy.Reverse
+		if path := s.mgr.PeerPath(targetPort); path != "" {
+			labels = append(labels, path)
+		}
+		if dest := s.mgr.PeerDestination(targetPort); dest != "" {
+			labels = append(labels, dest)
+		}
+	} else if p, ok := s.mgr.Processes()[targetPort]; ok {
+		labels = append(labels, p.String())
+	}
+	if svc, ok := s.services.Get(dir, targetPort); ok {
+		labels = append(labels, svc.String())
+	}
+	label := ""
+	if len(labels) > 0 {
+		label = fmt.Sprintf("(%s)", strings.Join(labels, ", "))
+	}
+	if url := s.URL(targetPort); url != "" && !reverse {
+		label = strings.TrimSpace(url + " " + label)
+	}
+	return label
+}
+
+// URL returns the local URL of the forwarded port (the port in the container) if it's known to speak HTTP.
+func (s *Session) URL(targetPort uint16) string {
+	if svc, ok := s.services.Get(proxy.Forward, targetPort); !ok || svc.Name != sniff.HTTP {
+		return ""
+	}
+	return s.LocalURL(targetPort)
+}
+
+// LocalURL returns the local http URL of the forwarded port (the port in the container), empty if the
+// port is not forwarded.
+func (s *Session) LocalURL(targetPort uint16) string {
+	localPortMap, _ := s.mgr.PortMaps()
+	lport, ok := localPortMap[targetPort]
+	if !ok {
+		return ""
+	}
+	host := "localhost"
+	if ip := net.ParseIP(s.opts.Bind); ip != nil && !ip.IsUnspecified() {
+		host = s.opts.Bind
+	}
+	return fmt.Sprintf("http://%s", net.JoinHostPort(host, strconv.Itoa(int(lport))))
+}
+
+// Ports returns the forwarded ports (the ports in the container) for the front proxy.
+func (s *Session) Ports() []front.Port {
+	localPortMap, _ := s.mgr.PortMaps()
+	procs := s.mgr.Processes()
+	ports := make([]front.Port, 0, len(localPortMap))
+	for targetPort := range localPortMap {
+		port := front.Port{Port: targetPort, Process: procs[targetPort].Name}
+		if svc, ok := s.services.Get(proxy.Forward, targetPort); ok {
+			port.Service = svc.Name
+		}
+		ports = append(ports, port)
+	}
+	return ports
+}
+
+// ServeConn forwards the connection routed by the front proxy to the port in the container.
+func (s *Session) ServeConn(conn net.Conn, targetPort uint16) {
+	s.pl.ServeConn(conn, targetPort)
+}
+
+// Processes returns the owning processes of the ports in the container
+func (s *Session) Processes() map[uint16]portscan.Process {
+	return s.mgr.Processes()
+}
+
+func (s *Session) SetDumpCallback(dumpCallback func(localPortMap, peerPortMap map[uint16]uint16)) {
+	s.mgr.SetDumpCallback(dumpCallback)
+}
+
+func (s *Session) SetConnCallback(cb func(ev proxy.ConnEvent)) {
+	s.pl.SetConnCallback(cb)
+	s.pf.SetConnCallback(cb)
+}
+
+// Run starts forwarding and serves the control API of the session.
+func (s *Session) Run() {
+	s.mgr.DumpPorts()
+	s.mgr.Run()
+	if len(s.opts.ReversePorts) > 0 || len(s.opts.UnixSockets) > 0 {
+		s.updateReversePorts()
+	}
+
+	s.ctlServer = control.NewServer(control.SocketPath(s.opts.Target), s, s.logger)
+	if err := s.ctlServer.Listen(); err != nil {
+		s.logger.Printf("Failed to create control socket: %s", err)
+		s.ctlServer = nil
+	} else {
+		go s.ctlServer.Serve()
+	}
+
+	if s.socks != nil {
+		go s.socks.Serve()
+	}
+	if s.httpProxy != nil {
+		go s.httpProxy.Serve()
+	}
+
+	if len(s.opts.ReverseScan) > 0 {
+		go s.scanReversePorts()
+	}
+
+	s.logger.Println("Starting proxy forwarder")
+	go s.pf.Start()
+}
+
+// SocksAddr returns the address of the SOCKS5 server, nil if it's not running.
+func (s *Session) SocksAddr() net.Addr {
+	if s.socks == nil {
+		return nil
+	}
+	return s.socks.Addr()
+}
+
+// HTTPProxyAddr returns the address of the HTTP proxy, nil if it's not running.
+func (s *Session) HTTPProxyAddr() net.Addr {
+	if s.httpProxy == nil {
+		return nil
+	}
+	return s.httpProxy.Addr()
+}
+
+// Wait blocks until the session is shut down, either by Shutdown or the lost of connection.
+func (s *Session) Wait() {
+	s.mgr.Wait()
+	close(s.done)
+	if s.ctlServer != nil {
+		s.ctlServer.Close()
+	}
+	if s.socks != nil {
+		s.socks.Close()
+	}
+	if s.httpProxy != nil {
+		s.httpProxy.Close()
+	}
+	s.pl.CloseAll()
+}
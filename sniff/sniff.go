@@ -0,0 +1,185 @@
+// Package sniff classifies the service of a port by the first bytes of a connection: the client's
+// first bytes identify most of the protocols (HTTP, TLS, PostgreSQL, Redis...), the server's first
+// bytes identify the server-first protocols (MySQL, SSH). NB: the SSH client sends its banner as well,
+// the server's is used as it has the server version.
+package sniff
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// The max bytes of each direction needed for the classification
+const MaxPeek = 4096
+
+const (
+	HTTP       = "http"
+	HTTP2      = "http2"
+	GRPC       = "grpc"
+	TLS        = "tls"
+	PostgreSQL = "postgresql"
+	MySQL      = "mysql"
+	Redis      = "redis"
+	SSH        = "ssh"
+)
+
+type Service struct {
+	Name   string
+	Detail string // eg. the SNI of TLS, the Host of HTTP, the server version of MySQL / SSH
+}
+
+func (s Service) String() string {
+	if s.Detail == "" {
+		return s.Name
+	}
+	return fmt.Sprintf("%s %s", s.Name, s.Detail)
+}
+
+var http2Preface = []byte("PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n")
+
+// The HPACK Huffman encoding of "application/grpc", without the last byte which may be padded
+var grpcContentTypeHuffman = []byte{0x1d, 0x75, 0xd0, 0x62, 0x0d, 0x26, 0x3d, 0x4c, 0x4d, 0x65}
+
+var httpMethods = []string{"GET ", "POST ", "PUT ", "HEAD ", "DELETE ", "OPTIONS ", "PATCH ", "CONNECT ", "TRACE "}
+
+// Classify returns the service of the first bytes sent by the client and the server, false if it can't
+// tell (yet). Either of them may be empty.
+func Classify(client, server []byte) (Service, bool) {
+	if svc, ok := classifyClient(client); ok {
+		return svc, true
+	}
+	return classifyServer(server)
+}
+
+func classifyClient(b []byte) (Service, bool) {
+	switch {
+	case bytes.HasPrefix(b, http2Preface):
+		if bytes.Contains(b, []byte("application/grpc")) || bytes.Contains(b, grpcContentTypeHuffman) {
+			return Service{Name: GRPC}, true
+		}
+		return Service{Name: HTTP2}, true
+	case isHTTP(b):
+		return Service{Name: HTTP, Detail: httpHost(b)}, true
+	case len(b) >= 6 && b[0] == 0x16 && b[1] == 0x03 && b[5] == 0x01:
+		// TLS record of handshake, ClientHello
+		return Service{Name: TLS, Detail: TLSServerName(b)}, true
+	case isPostgreSQL(b):
+		return Service{Name: PostgreSQL}, true
+	case isRedis(b):
+		return Service{Name: Redis}, true
+	}
+	return Service{}, false
+}
+
+func classifyServer(b []byte) (Service, bool) {
+	switch {
+	case bytes.HasPrefix(b, []byte("SSH-")):
+		line := b
+		if i := bytes.IndexAny(b, "\r\n"); i >= 0 {
+			line = b[:i]
+		}
+		return Service{Name: SSH, Detail: string(line)}, true
+	case len(b) >= 5 && b[3] == 0 && b[4] == 0x0a:
+		// MySQL initial handshake packet: 3-byte length, sequence 0, protocol version 10, server version
+		version := b[5:]
+		if i := bytes.IndexByte(version, 0); i >= 0 {
+			return Service{Name: MySQL, Detail: string(version[:i])}, true
+		}
+	}
+	return Service{}, false
+}
+
+func isHTTP(b []byte) bool {
+	for _, m := range httpMethods {
+		if bytes.HasPrefix(b, []byte(m)) {
+			return bytes.Contains(b, []byte(" HTTP/1."))
+		}
+	}
+	return false
+}
+
+func httpHost(b []byte) string {
+	for _, line := range bytes.Split(b, []byte("\r\n")) {
+		if len(line) == 0 {
+			break
+		}
+		if i := bytes.IndexByte(line, ':'); i > 0 && bytes.EqualFold(line[:i], []byte("host")) {
+			return string(bytes.TrimSpace(line[i+1:]))
+		}
+	}
+	return ""
+}
+
+func isPostgreSQL(b []byte) bool {
+	if len(b) < 8 {
+		return false
+	}
+	length := binary.BigEndian.Uint32(b[0:4])
+	code := binary.BigEndian.Uint32(b[4:8])
+	switch code {
+	case 196608: // StartupMessage of protocol 3.0
+		return length >= 8 && length <= 10000
+	case 80877103, 80877104: // SSLRequest, GSSENCRequest
+		return length == 8
+	}
+	return false
+}
+
+func isRedis(b []byte) bool {
+	// RESP array of bulk strings, eg. "*1\r\n$4\r\nPING\r\n"
+	if len(b) < 4 || b[0] != '*' {
+		return false
+	}
+	i := 1
+	for i < len(b) && b[i] >= '0' && b[i] <= '9' {
+		i++
+	}
+	return i > 1 && bytes.HasPrefix(b[i:], []byte("\r\n$"))
+}
+
+// TLSServerName parses the SNI extension of the TLS record of ClientHello, empty if not found.
+func TLSServerName(b []byte) string {
+	// record header (5) + handshake header (4) + version (2) + random (32)
+	p := 5 + 4 + 2 + 32
+	if len(b) < p+1 {
+		return ""
+	}
+	p += 1 + int(b[p]) // session id
+	if len(b) < p+2 {
+		return ""
+	}
+	p += 2 + int(binary.BigEndian.Uint16(b[p:])) // cipher suites
+	if len(b) < p+1 {
+		return ""
+	}
+	p += 1 + int(b[p]) // compression methods
+	if len(b) < p+2 {
+		return ""
+	}
+	end := p + 2 + int(binary.BigEndian.Uint16(b[p:])) // extensions
+	p += 2
+	if end > len(b) {
+		end = len(b)
+	}
+	for p+4 <= end {
+		typ := binary.BigEndian.Uint16(b[p:])
+		size := int(binary.BigEndian.Uint16(b[p+2:]))
+		p += 4
+		if p+size > end {
+			return ""
+		}
+		if typ == 0 { // server_name: list length (2), name type (1), name length (2), name
+			ext := b[p : p+size]
+			if len(ext) >= 5 && ext[2] == 0 {
+				n := int(binary.BigEndian.Uint16(ext[3:]))
+				if 5+n <= len(ext) {
+					return string(ext[5 : 5+n])
+				}
+			}
+			return ""
+		}
+		p += size
+	}
+	return ""
+}
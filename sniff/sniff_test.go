@@ -0,0 +1,54 @@
+package sniff
+
+import (
+	"crypto/tls"
+	"net"
+	"testing"
+	"time"
+)
+
+// clientHello returns the first bytes sent by a TLS client
+func clientHello(t *testing.T, serverName string) []byte {
+	c, s := net.Pipe()
+	defer s.Close()
+	go func() {
+		tls.Client(c, &tls.Config{ServerName: serverName}).Handshake()
+	}()
+	s.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, MaxPeek)
+	n, err := s.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	return buf[:n]
+}
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		name           string
+		client, server []byte
+		want           Service
+		ok             bool
+	}{
+		{"HTTP", []byte("GET / HTTP/1.1\r\nhost: localhost:8080\r\nAccept: */*\r\n\r\n"), nil, Service{HTTP, "localhost:8080"}, true},
+		{"HTTP/2", append(http2Preface, 0, 0, 0, 4, 0, 0, 0, 0, 0), nil, Service{HTTP2, ""}, true},
+		{"gRPC", append(append(http2Preface, 0, 0, 0x20, 1, 4, 0, 0, 0, 1, 0x5f, 0x8b), grpcContentTypeHuffman...), nil, Service{GRPC, ""}, true},
+		{"TLS", clientHello(t, "api.example.com"), nil, Service{TLS, "api.example.com"}, true},
+		{"PostgreSQL", []byte{0, 0, 0, 41, 0, 3, 0, 0, 'u', 's', 'e', 'r', 0}, nil, Service{PostgreSQL, ""}, true},
+		{"PostgreSQL SSLRequest", []byte{0, 0, 0, 8, 0x04, 0xd2, 0x16, 0x2f}, nil, Service{PostgreSQL, ""}, true},
+		{"Redis", []byte("*1\r\n$4\r\nPING\r\n"), nil, Service{Redis, ""}, true},
+		{"MySQL", nil, []byte("\x4a\x00\x00\x00\x0a8.0.32\x00\x08\x00\x00\x00"), Service{MySQL, "8.0.32"}, true},
+		{"SSH", []byte("SSH-2.0-OpenSSH_9.0\r\n"), []byte("SSH-2.0-OpenSSH_8.9p1 Ubuntu-3\r\n"), Service{SSH, "SSH-2.0-OpenSSH_8.9p1 Ubuntu-3"}, true},
+		{"Not yet", []byte("GE"), nil, Service{}, false},
+		{"Unknown", []byte("hello"), []byte("world"), Service{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := Classify(tt.client, tt.server)
+			if got != tt.want || ok != tt.ok {
+				t.Errorf("Classify() = %v, %v, want %v, %v", got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,474 @@
+// Package tui implements a full-screen dashboard listing the forwarded ports with their live
+// connections and throughput. The dashboard is driven by the manager's dump callback and the
+// proxy stats, it redraws itself every second.
+package tui
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/term"
+
+	"github.com/ruoshan/autoportforward/browser"
+	"github.com/ruoshan/autoportforward/portscan"
+	"github.com/ruoshan/autoportforward/proxy"
+)
+
+// Pauser is implemented by the ProxyListener and ProxyForwarder
+type Pauser interface {
+	Pause(port uint16)
+	Resume(port uint16)
+	IsPaused(port uint16) bool
+}
+
+type row struct {
+	dir    proxy.Direction
+	local  uint16 // the port on the local machine
+	remote uint16 // the port in the container
+	target uint16 // the port the proxies and stats are keyed with
+}
+
+type rate struct {
+	in, out float64 // bytes per second
+}
+
+type Dashboard struct {
+	title    string
+	stats    *proxy.Stats
+	pausers  map[proxy.Direction]Pauser
+	logger   *log.Logger
+	in       *os.File
+	out      io.Writer
+	mu       sync.Mutex
+	rows     []row
+	selected int
+	offset   int // the index of the first row on the screen
+	prev     map[row]proxy.PortStats
+	rates    map[row]rate
+	lastTick time.Time
+	message  string
+	redrawCh chan struct{}
+	stopCh   chan struct{}
+	once     sync.Once
+	oldState *term.State
+	procs    func() map[uint16]portscan.Process
+	urls     func(targetPort uint16) string
+	services *proxy.Services
+}
+
+func NewDashboard(title string, stats *proxy.Stats, fwd, rev Pauser, logger *log.Logger) *Dashboard {
+	return &Dashboard{
+		title: title,
+		stats: stats,
+		pausers: map[proxy.Direction]Pauser{
+			proxy.Forward: fwd,
+			proxy.Reverse: rev,
+		},
+		logger:   logger,
+		in:       os.Stdin,
+		out:      os.Stdout,
+		prev:     make(map[row]proxy.PortStats),
+		rates:    make(map[row]rate),
+		redrawCh: make(chan struct{}, 1),
+		stopCh:   make(chan struct{}),
+	}
+}
+
+// SetProcessSource sets the function that returns the owning processes of the remote ports, they
+// are shown in the PROCESS column.
+func (d *Dashboard) SetProcessSource(procs func() map[uint16]portscan.Process) {
+	d.procs = procs
+}
+
+// SetURLSource sets the function that returns the local URL of a forwarded port (the port in the
+// container), eg. Session.LocalURL, which takes the bind address into account.
+func (d *Dashboard) SetURLSource(urls func(targetPort uint16) string) {
+	d.urls = urls
+}
+
+// SetServices sets the services of the ports, they are shown in the SERVICE column.
+func (d *Dashboard) SetServices(services *proxy.Services) {
+	d.services = services
+}
+
+// Update is meant to be used as the manager's dump callback.
+func (d *Dashboard) Update(localPortMap, peerPortMap map[uint16]uint16) {
+	rows := make([]row, 0, len(localPortMap)+len(peerPortMap))
+	for targetPort, listenPort := range localPortMap {
+		rows = append(rows, row{dir: proxy.Forward, local: listenPort, remote: targetPort, target: targetPort})
+	}
+	for targetPort, listenPort := range peerPortMap {
+		rows = append(rows, row{dir: proxy.Reverse, local: targetPort, remote: listenPort, target: targetPort})
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		if rows[i].dir != rows[j].dir {
+			return rows[i].dir < rows[j].dir
+		}
+		return rows[i].target < rows[j].target
+	})
+
+	d.mu.Lock()
+	d.rows = rows
+	if d.selected >= len(rows) {
+		d.selected = len(rows) - 1
+	}
+	if d.selected < 0 {
+		d.selected = 0
+	}
+	d.mu.Unlock()
+	d.requestRedraw()
+}
+
+func (d *Dashboard) requestRedraw() {
+	select {
+	case d.redrawCh <- struct{}{}:
+	default:
+	}
+}
+
+// Run takes over the terminal until the user quits (quit is called then) or Stop is called.
+func (d *Dashboard) Run(quit func()) error {
+	fd := int(d.in.Fd())
+	state, err := term.MakeRaw(fd)
+	if err != nil {
+		return err
+	}
+	d.oldState = state
+	// Switch to the alternate screen and hide the cursor
+	fmt.Fprint(d.out, "\x1b[?1049h\x1b[?25l")
+	defer d.Stop()
+
+	keyCh := make(chan []byte)
+	go d.readKeys(keyCh)
+
+	tick := time.NewTicker(1 * time.Second)
+	defer tick.Stop()
+	d.lastTick = time.Now()
+	d.draw()
+	for {
+		select {
+		case <-d.stopCh:
+			return nil
+		case <-tick.C:
+			d.sample()
+			d.draw()
+		case <-d.redrawCh:
+			d.draw()
+		case keys, ok := <-keyCh:
+			if !ok {
+				return nil
+			}
+			if !d.handleKeys(keys) {
+				quit()
+				return nil
+			}
+			d.draw()
+		}
+	}
+}
+
+// Stop restores the terminal, it's safe to be called multiple times.
+func (d *Dashboard) Stop() {
+	d.once.Do(func() {
+		close(d.stopCh)
+		if d.oldState != nil {
+			fmt.Fprint(d.out, "\x1b[?25h\x1b[?1049l")
+			term.Restore(int(d.in.Fd()), d.oldState)
+		}
+	})
+}
+
+func (d *Dashboard) readKeys(keyCh chan<- []byte) {
+	defer close(keyCh)
+	buf := make([]byte, 16)
+	for {
+		n, err := d.in.Read(buf)
+		if err != nil {
+			return
+		}
+		keys := make([]byte, n)
+		copy(keys, buf[:n])
+		select {
+		case keyCh <- keys:
+		case <-d.stopCh:
+			return
+		}
+	}
+}
+
+// handleKeys returns false if the user wants to quit.
+func (d *Dashboard) handleKeys(keys []byte) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	switch {
+	case len(keys) == 3 && keys[0] == 0x1b && keys[1] == '[' && keys[2] == 'A':
+		d.move(-1)
+	case len(keys) == 3 && keys[0] == 0x1b && keys[1] == '[' && keys[2] == 'B':
+		d.move(1)
+	case len(keys) == 1:
+		switch keys[0] {
+		case 'q', 0x03: // 0x03: Ctrl-C
+			return false
+		case 'k':
+			d.move(-1)
+		case 'j':
+			d.move(1)
+		case 'p', ' ':
+			d.togglePause()
+		case 'c':
+			d.copyURL()
+		case 'o':
+			d.openURL()
+		}
+	}
+	return true
+}
+
+func (d *Dashboard) move(delta int) {
+	d.selected += delta
+	if d.selected >= len(d.rows) {
+		d.selected = len(d.rows) - 1
+	}
+	if d.selected < 0 {
+		d.selected = 0
+	}
+}
+
+func (d *Dashboard) current() (row, bool) {
+	if d.selected < 0 || d.selected >= len(d.rows) {
+		return row{}, false
+	}
+	return d.rows[d.selected], true
+}
+
+func (d *Dashboard) togglePause() {
+	r, ok := d.current()
+	if !ok {
+		return
+	}
+	p := d.pausers[r.dir]
+	if p == nil {
+		return
+	}
+	if p.IsPaused(r.target) {
+		p.Resume(r.target)
+		d.message = fmt.Sprintf("Resumed port %d", r.local)
+	} else {
+		p.Pause(r.target)
+		d.message = fmt.Sprintf("Paused port %d", r.local)
+	}
+}
+
+// url returns the local URL of the selected row, the message is set if there is none, eg. for the
+// reverse ports, which are listened in the container.
+func (d *Dashboard) url() (string, bool) {
+	r, ok := d.current()
+	if !ok {
+		return "", false
+	}
+	if r.dir == proxy.Reverse {
+		d.message = fmt.Sprintf("Port %d is forwarded to the container, it has no local URL", r.local)
+		return "", false
+	}
+	if d.urls == nil {
+		return fmt.Sprintf("http://localhost:%d", r.local), true
+	}
+	url := d.urls(r.target)
+	if url == "" {
+		d.message = fmt.Sprintf("Port %d is no longer forwarded", r.remote)
+		return "", false
+	}
+	return url, true
+}
+
+func (d *Dashboard) copyURL() {
+	url, ok := d.url()
+	if !ok {
+		return
+	}
+	// OSC 52: ask the terminal emulator to set the clipboard, this works over ssh as well
+	fmt.Fprintf(d.out, "\x1b]52;c;%s\x07", base64.StdEncoding.EncodeToString([]byte(url)))
+	d.message = fmt.Sprintf("Copied %s", url)
+}
+
+func (d *Dashboard) openURL() {
+	url, ok := d.url()
+	if !ok {
+		return
+	}
+	if err := browser.Open(url); err != nil {
+		d.logger.Printf("Failed to open browser: %s", err)
+		d.message = fmt.Sprintf("Failed to open %s: %s", url, err)
+		return
+	}
+	d.message = fmt.Sprintf("Opened %s", url)
+}
+
+// sample computes the throughput of every port since the last tick.
+func (d *Dashboard) sample() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := time.Now()
+	elapsed := now.Sub(d.lastTick).Seconds()
+	d.lastTick = now
+	if elapsed <= 0 {
+		return
+	}
+	for _, r := range d.rows {
+		cur := d.stats.Get(r.dir, r.target)
+		prev, ok := d.prev[r]
+		if ok && cur.BytesIn >= prev.BytesIn && cur.BytesOut >= prev.BytesOut {
+			d.rates[r] = rate{
+				in:  float64(cur.BytesIn-prev.BytesIn) / elapsed,
+				out: float64(cur.BytesOut-prev.BytesOut) / elapsed,
+			}
+		}
+		d.prev[r] = cur
+	}
+}
+
+func formatRate(bps float64) string {
+	switch {
+	case bps >= 1<<20:
+		return fmt.Sprintf("%.1f MB/s", bps/(1<<20))
+	case bps >= 1<<10:
+		return fmt.Sprintf("%.1f KB/s", bps/(1<<10))
+	default:
+		return fmt.Sprintf("%.0f B/s", bps)
+	}
+}
+
+// formatRow formats the row of the table, the process is truncated to fit the column.
+func formatRow(r row, process, service string, st proxy.PortStats, rt rate, paused bool) string {
+	dir := "==>"
+	if r.dir == proxy.Reverse {
+		dir = "<=="
+	}
+	status := "active"
+	if paused {
+		status = "paused"
+	}
+	return fmt.Sprintf("%-4s %-7d %-7d %s %-10s %6d %12s %12s %s",
+		dir, r.local, r.remote, pad(truncate(process, 20), 20), service, st.Conns, formatRate(rt.in), formatRate(rt.out), status)
+}
+
+// scroll returns the index of the first visible row, so that the selected row stays on the screen
+// with as few changes as possible. visible is the number of the rows fitting the screen.
+func scroll(offset, selected, rows, visible int) int {
+	if visible <= 0 {
+		return selected
+	}
+	if selected < offset {
+		offset = selected
+	}
+	if selected >= offset+visible {
+		offset = selected - visible + 1
+	}
+	// Don't leave the screen half empty when the rows are removed
+	if offset > rows-visible {
+		offset = rows - visible
+	}
+	if offset < 0 {
+		offset = 0
+	}
+	return offset
+}
+
+// render lays out the screen: the header and the body at the top, the footer at the bottom. The body
+// must fit the screen already.
+func render(header, body, footer []string, width, height int) string {
+	buf := &strings.Builder{}
+	buf.WriteString("\x1b[H\x1b[2J")
+	lines := append(append([]string{}, header...), body...)
+	for _, l := range lines {
+		buf.WriteString(truncate(l, width))
+		buf.WriteString("\r\n")
+	}
+	for i := len(lines) + len(footer); i < height; i++ {
+		buf.WriteString("\r\n")
+	}
+	for i, l := range footer {
+		buf.WriteString(truncate(l, width))
+		if i != len(footer)-1 {
+			buf.WriteString("\r\n")
+		}
+	}
+	return buf.String()
+}
+
+func (d *Dashboard) draw() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	width, height, err := term.GetSize(int(d.in.Fd()))
+	if err != nil {
+		width, height = 80, 24
+	}
+
+	procs := map[uint16]portscan.Process{}
+	if d.procs != nil {
+		procs = d.procs()
+	}
+
+	header := []string{
+		fmt.Sprintf("apf: %s", d.title),
+		"",
+		fmt.Sprintf("%-4s %-7s %-7s %-20s %-10s %6s %12s %12s %s", "DIR", "LOCAL", "REMOTE", "PROCESS", "SERVICE", "CONNS", "IN", "OUT", "STATUS"),
+	}
+	footer := []string{"", d.message, "↑/↓ select  p pause/resume  c copy URL  o open in browser  q quit"}
+	// Keep the footer at the bottom, scroll the table if the screen is too small
+	visible := height - len(header) - len(footer)
+	if visible < 1 {
+		visible = 1
+	}
+	d.offset = scroll(d.offset, d.selected, len(d.rows), visible)
+
+	body := make([]string, 0, visible)
+	for i := d.offset; i < len(d.rows) && i < d.offset+visible; i++ {
+		r := d.rows[i]
+		process := "-"
+		if p, ok := procs[r.remote]; ok && r.dir == proxy.Forward {
+			process = fmt.Sprintf("%s (%d)", p.Name, p.PID)
+		}
+		service := "-"
+		if svc, ok := d.services.Get(r.dir, r.target); ok {
+			service = svc.Name
+		}
+		paused := false
+		if p := d.pausers[r.dir]; p != nil {
+			paused = p.IsPaused(r.target)
+		}
+		line := formatRow(r, process, service, d.stats.Get(r.dir, r.target), d.rates[r], paused)
+		if i == d.selected {
+			line = "\x1b[7m" + pad(truncate(line, width), width) + "\x1b[0m"
+		}
+		body = append(body, line)
+	}
+	if len(d.rows) == 0 {
+		body = append(body, "(no forwarded ports yet)")
+	}
+	io.WriteString(d.out, render(header, body, footer, width, height))
+}
+
+// pad pads the plain text with spaces to the width, in runes
+func pad(s string, width int) string {
+	if n := utf8.RuneCountInString(s); n < width {
+		return s + strings.Repeat(" ", width-n)
+	}
+	return s
+}
+
+// truncate cuts the plain text line to fit the screen width, lines with escape sequences are left intact
+func truncate(s string, width int) string {
+	if strings.Contains(s, "\x1b") || utf8.RuneCountInString(s) <= width {
+		return s
+	}
+	return string([]rune(s)[:width])
+}
@@ -0,0 +1,136 @@
+package tui
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"log"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/ruoshan/autoportforward/proxy"
+)
+
+func TestFormatRow(t *testing.T) {
+	r := row{dir: proxy.Forward, local: 8080, remote: 80, target: 80}
+	line := formatRow(r, "nginx (1)", "http", proxy.PortStats{Conns: 3}, rate{in: 2048}, false)
+	want := "==>  8080    80      nginx (1)            http            3     2.0 KB/s        0 B/s active"
+	if line != want {
+		t.Fatalf("formatRow() =\n%q, want\n%q", line, want)
+	}
+
+	// The process is truncated by runes, the columns stay aligned
+	long := formatRow(r, "サーバーサーバーサーバーサーバーサーバー (12345)", "-", proxy.PortStats{}, rate{}, true)
+	if !utf8.ValidString(long) {
+		t.Fatalf("invalid UTF-8: %q", long)
+	}
+	if !strings.HasPrefix(long, "==>  8080    80      サーバーサーバーサーバーサーバーサーバー -") {
+		t.Fatalf("unexpected row: %q", long)
+	}
+	if !strings.HasSuffix(long, "paused") {
+		t.Fatalf("unexpected status: %q", long)
+	}
+
+	rev := formatRow(row{dir: proxy.Reverse, local: 9090, remote: 9090, target: 9090}, "-", "-", proxy.PortStats{}, rate{}, false)
+	if !strings.HasPrefix(rev, "<==  9090") {
+		t.Fatalf("unexpected reverse row: %q", rev)
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	for _, tt := range []struct {
+		s     string
+		width int
+		want  string
+	}{
+		{"abc", 5, "abc"},
+		{"abcdef", 3, "abc"},
+		{"ポート転送", 2, "ポー"},
+		{"\x1b[7mabcdef\x1b[0m", 3, "\x1b[7mabcdef\x1b[0m"},
+	} {
+		if got := truncate(tt.s, tt.width); got != tt.want {
+			t.Errorf("truncate(%q, %d) = %q, want %q", tt.s, tt.width, got, tt.want)
+		}
+	}
+	if got := pad("ポート", 5); got != "ポート  " {
+		t.Errorf("pad() = %q", got)
+	}
+}
+
+func TestScroll(t *testing.T) {
+	for _, tt := range []struct {
+		offset, selected, rows, visible int
+		want                            int
+	}{
+		{0, 0, 3, 10, 0},  // all rows fit
+		{0, 9, 20, 10, 0}, // the last visible row
+		{0, 10, 20, 10, 1},
+		{5, 19, 20, 10, 10},
+		{10, 12, 20, 10, 10}, // stay still
+		{10, 3, 20, 10, 3},
+		{10, 4, 8, 5, 3}, // the rows are removed
+		{0, 0, 0, 5, 0},
+	} {
+		if got := scroll(tt.offset, tt.selected, tt.rows, tt.visible); got != tt.want {
+			t.Errorf("scroll(%d, %d, %d, %d) = %d, want %d", tt.offset, tt.selected, tt.rows, tt.visible, got, tt.want)
+		}
+	}
+}
+
+func TestSelection(t *testing.T) {
+	d := NewDashboard("redis", proxy.NewStats(), nil, nil, log.New(io.Discard, "", 0))
+	d.Update(map[uint16]uint16{80: 8080, 443: 8443, 6379: 6379}, map[uint16]uint16{9090: 9090})
+	for _, key := range []string{"j", "j", "j", "j", "\x1b[B"} {
+		d.handleKeys([]byte(key))
+	}
+	if r, ok := d.current(); !ok || d.selected != 3 || r.dir != proxy.Reverse || r.target != 9090 {
+		t.Fatalf("unexpected selection %d: %+v", d.selected, r)
+	}
+	d.handleKeys([]byte("\x1b[A"))
+	if r, _ := d.current(); r.target != 6379 {
+		t.Fatalf("unexpected selection: %+v", r)
+	}
+	// The selection is kept within the rows when they are removed
+	d.Update(map[uint16]uint16{80: 8080}, nil)
+	if r, ok := d.current(); !ok || d.selected != 0 || r.target != 80 {
+		t.Fatalf("unexpected selection %d: %+v", d.selected, r)
+	}
+	if d.handleKeys([]byte("q")) {
+		t.Fatal("expected q to quit")
+	}
+}
+
+func TestRender(t *testing.T) {
+	screen := render([]string{"title"}, []string{"row 1", "row 2 is too long"}, []string{"", "help"}, 10, 6)
+	want := "\x1b[H\x1b[2J" + "title\r\nrow 1\r\nrow 2 is t\r\n\r\n\r\nhelp"
+	if screen != want {
+		t.Fatalf("render() =\n%q, want\n%q", screen, want)
+	}
+}
+
+func TestCopyURL(t *testing.T) {
+	d := NewDashboard("redis", proxy.NewStats(), nil, nil, log.New(io.Discard, "", 0))
+	out := &bytes.Buffer{}
+	d.out = out
+	d.SetURLSource(func(targetPort uint16) string {
+		if targetPort == 80 {
+			return "http://192.168.1.10:8080"
+		}
+		return ""
+	})
+	d.Update(map[uint16]uint16{80: 8080}, map[uint16]uint16{9090: 9090})
+
+	// The URL of the bind address
+	d.copyURL()
+	if want := "\x1b]52;c;" + base64.StdEncoding.EncodeToString([]byte("http://192.168.1.10:8080")) + "\x07"; out.String() != want {
+		t.Fatalf("copyURL() wrote %q, want %q", out, want)
+	}
+	// No URL of the reverse port
+	out.Reset()
+	d.handleKeys([]byte("j"))
+	d.copyURL()
+	if out.Len() != 0 || !strings.Contains(d.message, "no local URL") {
+		t.Fatalf("unexpected output %q, message %q", out, d.message)
+	}
+}
@@ -0,0 +1,173 @@
+// Package watch attaches to the containers automatically as they start and detaches from them as
+// they stop.
+package watch
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/ruoshan/autoportforward/daemon"
+)
+
+// Sink is notified about the targets to attach or detach, it's implemented by daemon.Daemon
+type Sink interface {
+	Attach(att daemon.Attachment) error
+	Detach(target string) error
+}
+
+// The event emitted by `docker events --format '{{json .}}'` or `podman events --format json`
+type containerEvent struct {
+	ID     string `json:"id"`
+	Status string `json:"status"` // podman and the docker API before v1.44
+	Action string `json:"Action"` // docker only
+	Name   string `json:"name"`   // podman only
+	Actor  struct {
+		Attributes map[string]string `json:"Attributes"`
+	} `json:"Actor"` // docker only
+	Attributes map[string]string `json:"Attributes"` // podman only
+}
+
+func (e *containerEvent) name() string {
+	if e.Name != "" {
+		return e.Name
+	}
+	if name := e.Actor.Attributes["name"]; name != "" {
+		return name
+	}
+	return e.ID
+}
+
+func (e *containerEvent) action() string {
+	if e.Action != "" {
+		return e.Action
+	}
+	return e.Status
+}
+
+func (e *containerEvent) labels() map[string]string {
+	if e.Attributes != nil {
+		return e.Attributes
+	}
+	return e.Actor.Attributes
+}
+
+// ContainerWatcher watches the containers with the label of docker or podman
+type ContainerWatcher struct {
+	cli    string // "docker" or "podman"
+	label  string // eg. apf.enable=true
+	sink   Sink
+	logger *log.Logger
+}
+
+func NewContainerWatcher(cli, label string, sink Sink, logger *log.Logger) *ContainerWatcher {
+	return &ContainerWatcher{
+		cli:    cli,
+		label:  label,
+		sink:   sink,
+		logger: logger,
+	}
+}
+
+func (w *ContainerWatcher) attach(name string, labels map[string]string) {
+	att, err := attachmentFromLabels(name, w.cli, labels)
+	if err != nil {
+		w.logger.Printf("Ignore container %s: %s", name, err)
+		fmt.Printf("Ignore %s: %s\n", name, err)
+		return
+	}
+	if err := w.sink.Attach(att); err != nil {
+		w.logger.Printf("Failed to attach %s: %s", name, err)
+		return
+	}
+	fmt.Printf("Attached %s\n", name)
+}
+
+func (w *ContainerWatcher) detach(name string) {
+	if err := w.sink.Detach(name); err != nil {
+		w.logger.Printf("Failed to detach %s: %s", name, err)
+		return
+	}
+	fmt.Printf("Detached %s\n", name)
+}
+
+func (w *ContainerWatcher) labelsOf(name string) (map[string]string, error) {
+	out, err := exec.Command(w.cli, "inspect", "--format", "{{json .Config.Labels}}", name).Output()
+	if err != nil {
+		return nil, err
+	}
+	labels := make(map[string]string)
+	err = json.Unmarshal(out, &labels)
+	return labels, err
+}
+
+// attachRunning attaches to the running containers with the label
+func (w *ContainerWatcher) attachRunning() error {
+	out, err := exec.Command(w.cli, "ps", "--filter", "label="+w.label, "--format", "{{.Names}}").Output()
+	if err != nil {
+		return err
+	}
+	for _, name := range strings.Fields(string(out)) {
+		labels, err := w.labelsOf(name)
+		if err != nil {
+			w.logger.Printf("Failed to inspect %s: %s", name, err)
+			continue
+		}
+		w.attach(name, labels)
+	}
+	return nil
+}
+
+func (w *ContainerWatcher) watchEvents() error {
+	format := "{{json .}}"
+	if w.cli == "podman" {
+		format = "json"
+	}
+	cmd := exec.Command(w.cli, "events",
+		"--filter", "type=container",
+		"--filter", "event=start",
+		"--filter", "event=die",
+		"--filter", "label="+w.label,
+		"--format", format)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		ev := containerEvent{}
+		if err := json.Unmarshal(bytes.TrimSpace(scanner.Bytes()), &ev); err != nil {
+			w.logger.Printf("Failed to decode the event: %s", err)
+			continue
+		}
+		switch ev.action() {
+		case "start":
+			w.attach(ev.name(), ev.labels())
+		case "die":
+			w.detach(ev.name())
+		}
+	}
+	return cmd.Wait()
+}
+
+// Run attaches to the running containers and keeps watching the events, it never returns.
+func (w *ContainerWatcher) Run() {
+	for {
+		if err := w.attachRunning(); err != nil {
+			w.logger.Printf("Failed to list the containers: %s", err)
+		}
+		err := w.watchEvents()
+		w.logger.Printf("Watching events stops: %v", err)
+		// The container runtime may be restarting, the events in between are missed, so list the
+		// running containers again.
+		time.Sleep(5 * time.Second)
+	}
+}
@@ -0,0 +1,272 @@
+package watch
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ruoshan/autoportforward/bootstrap"
+	"github.com/ruoshan/autoportforward/daemon"
+)
+
+type pod struct {
+	Metadata struct {
+		Name              string            `json:"name"`
+		Namespace         string            `json:"namespace"`
+		Labels            map[string]string `json:"labels"`
+		DeletionTimestamp *string           `json:"deletionTimestamp"`
+		OwnerReferences   []struct {
+			Kind string `json:"kind"`
+			Name string `json:"name"`
+		} `json:"ownerReferences"`
+	} `json:"metadata"`
+	Status struct {
+		Phase string `json:"phase"`
+	} `json:"status"`
+}
+
+func (p *pod) target() string {
+	return p.Metadata.Namespace + "/" + p.Metadata.Name
+}
+
+func (p *pod) running() bool {
+	return p.Status.Phase == "Running" && p.Metadata.DeletionTimestamp == nil
+}
+
+// workload returns the key of the workload that owns the pod, eg. dev/Deployment/web. The pods
+// of a ReplicaSet are considered as owned by the Deployment.
+func (p *pod) workload() string {
+	ns := p.Metadata.Namespace
+	for _, owner := range p.Metadata.OwnerReferences {
+		if owner.Kind == "ReplicaSet" {
+			if hash := p.Metadata.Labels["pod-template-hash"]; hash != "" && strings.HasSuffix(owner.Name, "-"+hash) {
+				return fmt.Sprintf("%s/Deployment/%s", ns, strings.TrimSuffix(owner.Name, "-"+hash))
+			}
+		}
+		return fmt.Sprintf("%s/%s/%s", ns, owner.Kind, owner.Name)
+	}
+	return fmt.Sprintf("%s/Pod/%s", ns, p.Metadata.Name)
+}
+
+// The event emitted by `kubectl get pods --watch --output-watch-events -o json`
+type podEvent struct {
+	Type   string `json:"type"` // ADDED, MODIFIED, DELETED
+	Object pod    `json:"object"`
+}
+
+type workload struct {
+	holder string            // the target of the pod holding the pinned local ports
+	pods   map[string]pod    // the attached running pods: target => pod
+	pins   map[uint16]uint16 // the allocated local ports of the holder: remote port => local port
+}
+
+// PodWatcher attaches to every running pod of the workloads matching the selector. The local ports
+// allocated for the first pod of a workload are held by the workload, they're handed over to another
+// pod when it's gone, so the endpoints stay the same. The ports of the other pods are allocated as usual.
+type PodWatcher struct {
+	namespace string
+	selector  string
+	sink      Sink
+	logger    *log.Logger
+	mu        sync.Mutex
+	workloads map[string]*workload // workload key => workload
+	owners    map[string]string    // target => workload key
+}
+
+func NewPodWatcher(namespace, selector string, sink Sink, logger *log.Logger) *PodWatcher {
+	return &PodWatcher{
+		namespace: namespace,
+		selector:  selector,
+		sink:      sink,
+		logger:    logger,
+		workloads: make(map[string]*workload),
+		owners:    make(map[string]string),
+	}
+}
+
+// DumpPorts is meant to be used as the dump callback of the sessions, it records the allocated
+// local ports of the workloads.
+func (w *PodWatcher) DumpPorts(target string, localPortMap, peerPortMap map[uint16]uint16) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	wl, ok := w.workloads[w.owners[target]]
+	if !ok || wl.holder != target {
+		return
+	}
+	for rport, lport := range localPortMap {
+		wl.pins[rport] = lport
+	}
+}
+
+// attach must be called without holding the lock, as the sink may call back DumpPorts.
+func (w *PodWatcher) attach(key string, att daemon.Attachment) {
+	if err := w.sink.Attach(att); err != nil {
+		w.logger.Printf("Failed to attach %s: %s", att.Target, err)
+		w.mu.Lock()
+		wl := w.workloads[key]
+		delete(wl.pods, att.Target)
+		delete(w.owners, att.Target)
+		if wl.holder == att.Target {
+			wl.holder = ""
+		}
+		w.mu.Unlock()
+		return
+	}
+	fmt.Printf("Attached %s (%s)\n", att.Target, key)
+}
+
+func (w *PodWatcher) detach(key, target string) {
+	if err := w.sink.Detach(target); err != nil {
+		w.logger.Printf("Failed to detach %s: %s", target, err)
+		return
+	}
+	fmt.Printf("Detached %s (%s)\n", target, key)
+}
+
+// attachment returns the attachment of the pod, the holder takes the pinned ports of the workload.
+// The pinned ports in use (eg. by the other pods) fall back to the normal allocation.
+func (wl *workload) attachment(p pod) daemon.Attachment {
+	att := daemon.Attachment{
+		Target:      p.target(),
+		Runtime:     bootstrap.KUBERNETES.String(),
+		PinFallback: true,
+	}
+	if wl.holder == p.target() {
+		att.Pins = make(map[uint16]uint16)
+		for rport, lport := range wl.pins {
+			att.Pins[rport] = lport
+		}
+	}
+	return att
+}
+
+func (w *PodWatcher) update(p pod, running bool) {
+	key := p.workload()
+	target := p.target()
+	var toDetach []string
+	var toAttach *daemon.Attachment
+
+	w.mu.Lock()
+	wl, ok := w.workloads[key]
+	if !ok {
+		wl = &workload{
+			pods: make(map[string]pod),
+			pins: make(map[uint16]uint16),
+		}
+		w.workloads[key] = wl
+	}
+	_, attached := wl.pods[target]
+	if running && !attached {
+		w.owners[target] = key
+		wl.pods[target] = p
+		if wl.holder == "" {
+			wl.holder = target
+		}
+		att := wl.attachment(p)
+		toAttach = &att
+	} else if !running && attached {
+		delete(w.owners, target)
+		delete(wl.pods, target)
+		toDetach = append(toDetach, target)
+		if wl.holder == target {
+			wl.holder = ""
+			// Hand over the pinned ports to another running pod, it's attached again to take them
+			for other, op := range wl.pods {
+				wl.holder = other
+				toDetach = append(toDetach, other)
+				att := wl.attachment(op)
+				toAttach = &att
+				break
+			}
+		}
+	}
+	w.mu.Unlock()
+
+	// The old pod must be detached first to release the local ports
+	for _, t := range toDetach {
+		w.detach(key, t)
+	}
+	if toAttach != nil {
+		w.attach(key, *toAttach)
+	}
+}
+
+func (w *PodWatcher) kubectl(args ...string) *exec.Cmd {
+	args = append([]string{"get", "pods", "-n", w.namespace, "-o", "json"}, args...)
+	if w.selector != "" {
+		args = append(args, "-l", w.selector)
+	}
+	return exec.Command("kubectl", args...)
+}
+
+// reconcile lists the pods and detaches the pods that are gone, it's necessary as the events
+// may be missed while the watching is restarted.
+func (w *PodWatcher) reconcile() error {
+	out, err := w.kubectl().Output()
+	if err != nil {
+		return err
+	}
+	list := struct {
+		Items []pod `json:"items"`
+	}{}
+	if err := json.Unmarshal(out, &list); err != nil {
+		return err
+	}
+	existing := make(map[string]bool)
+	for _, p := range list.Items {
+		existing[p.target()] = true
+	}
+	w.mu.Lock()
+	gone := make([]pod, 0)
+	for _, wl := range w.workloads {
+		for target, p := range wl.pods {
+			if !existing[target] {
+				gone = append(gone, p)
+			}
+		}
+	}
+	w.mu.Unlock()
+	for _, p := range gone {
+		w.update(p, false)
+	}
+	for _, p := range list.Items {
+		w.update(p, p.running())
+	}
+	return nil
+}
+
+func (w *PodWatcher) watchEvents() error {
+	cmd := w.kubectl("--watch", "--output-watch-events")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	dec := json.NewDecoder(stdout)
+	for {
+		ev := podEvent{}
+		if err := dec.Decode(&ev); err != nil {
+			break
+		}
+		w.update(ev.Object, ev.Type != "DELETED" && ev.Object.running())
+	}
+	return cmd.Wait()
+}
+
+// Run keeps watching the pods, it never returns.
+func (w *PodWatcher) Run() {
+	for {
+		if err := w.reconcile(); err != nil {
+			w.logger.Printf("Failed to list the pods: %s", err)
+		}
+		err := w.watchEvents()
+		w.logger.Printf("Watching pods stops: %v", err)
+		time.Sleep(5 * time.Second)
+	}
+}
@@ -0,0 +1,78 @@
+package watch
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/ruoshan/autoportforward/config"
+	"github.com/ruoshan/autoportforward/daemon"
+)
+
+// The labels of a container to customize the forwarding, eg. apf.ports=8080,5432
+const (
+	LabelPorts   = "apf.ports"   // only forward these ports
+	LabelExclude = "apf.exclude" // don't forward these ports
+	LabelPins    = "apf.pins"    // pinned mappings of {remote port}:{local port}, eg. 80:8000,443:8443
+	LabelReverse = "apf.reverse" // reverse ports, eg. 9090,5432:db.internal:5432
+)
+
+// splitList splits the comma-separated list, the empty items are dropped
+func splitList(s string) []string {
+	lst := make([]string, 0)
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			lst = append(lst, item)
+		}
+	}
+	return lst
+}
+
+func parsePorts(s string) ([]uint16, error) {
+	var ports []uint16
+	for _, p := range splitList(s) {
+		i, err := strconv.ParseUint(p, 10, 16)
+		if err != nil || i == 0 {
+			return nil, fmt.Errorf("invalid port: %s", p)
+		}
+		ports = append(ports, uint16(i))
+	}
+	return ports, nil
+}
+
+// parseReverse parses the reverse ports of the label. The labels come with the images, they're not trusted
+// like the -r option: only {port} and {port}:{local port} are allowed, not the other destinations (eg.
+// db.internal:5432) nor the local unix sockets (eg. unix:$SSH_AUTH_SOCK:/tmp/agent).
+func parseReverse(specs []string) ([]uint16, map[uint16]string, error) {
+	for _, spec := range specs {
+		for _, p := range strings.SplitN(spec, ":", 2) {
+			if _, err := strconv.ParseUint(p, 10, 16); err != nil {
+				return nil, nil, fmt.Errorf("only the local ports are allowed: %s", spec)
+			}
+		}
+	}
+	ports, dests, _, err := config.ParseReverse(config.ReverseSpecs(specs))
+	return ports, dests, err
+}
+
+// attachmentFromLabels returns the attachment of the target customized by its labels
+func attachmentFromLabels(target, runtime string, labels map[string]string) (daemon.Attachment, error) {
+	att := daemon.Attachment{
+		Target:  target,
+		Runtime: runtime,
+	}
+	var err error
+	if att.Include, err = parsePorts(labels[LabelPorts]); err != nil {
+		return att, fmt.Errorf("label %s: %s", LabelPorts, err)
+	}
+	if att.Exclude, err = parsePorts(labels[LabelExclude]); err != nil {
+		return att, fmt.Errorf("label %s: %s", LabelExclude, err)
+	}
+	if att.Reverse, att.Destinations, err = parseReverse(splitList(labels[LabelReverse])); err != nil {
+		return att, fmt.Errorf("label %s: %s", LabelReverse, err)
+	}
+	if att.Pins, err = config.ParsePins(splitList(labels[LabelPins])); err != nil {
+		return att, fmt.Errorf("label %s: %s", LabelPins, err)
+	}
+	return att, nil
+}
@@ -0,0 +1,163 @@
+package watch
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"reflect"
+	"testing"
+
+	"github.com/ruoshan/autoportforward/daemon"
+)
+
+func Test_attachmentFromLabels(t *testing.T) {
+	att, err := attachmentFromLabels("redis", "docker", map[string]string{
+		"apf.enable":  "true",
+		"apf.ports":   "8080, 5432",
+		"apf.pins":    "80:8000,443:8443",
+		"apf.reverse": "9090,9000:8080",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(att.Include, []uint16{8080, 5432}) ||
+		!reflect.DeepEqual(att.Pins, map[uint16]uint16{80: 8000, 443: 8443}) ||
+		!reflect.DeepEqual(att.Reverse, []uint16{9090, 9000}) ||
+		!reflect.DeepEqual(att.Destinations, map[uint16]string{9000: "127.0.0.1:8080"}) ||
+		att.Exclude != nil {
+		t.Fatalf("unexpected attachment: %+v", att)
+	}
+
+	for _, labels := range []map[string]string{
+		{"apf.ports": "http"},
+		{"apf.pins": "80"},
+		{"apf.pins": "80:0"},
+		{"apf.exclude": "70000"},
+		{"apf.reverse": "unix:$SSH_AUTH_SOCK:/tmp/agent.sock"},
+		{"apf.reverse": "5432:db.internal:5432"},
+		{"apf.reverse": "8000:[fd00::1]:80"},
+		{"apf.reverse": "9090,unix:/var/run/docker.sock:/var/run/docker.sock"},
+	} {
+		if _, err := attachmentFromLabels("redis", "docker", labels); err == nil {
+			t.Errorf("expected error for labels: %v", labels)
+		}
+	}
+}
+
+func Test_containerEvent(t *testing.T) {
+	tests := []struct {
+		name   string
+		event  string
+		action string
+		target string
+	}{
+		{
+			name:   "docker",
+			event:  `{"Type":"container","Action":"start","Actor":{"ID":"0f2b","Attributes":{"apf.enable":"true","image":"redis","name":"redis"}},"scope":"local","time":1640995200}`,
+			action: "start",
+			target: "redis",
+		},
+		{
+			name:   "podman",
+			event:  `{"ID":"0f2b","Image":"docker.io/library/redis:latest","Name":"redis","Status":"die","Type":"container","Attributes":{"apf.enable":"true"}}`,
+			action: "die",
+			target: "redis",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ev := containerEvent{}
+			if err := json.Unmarshal([]byte(tt.event), &ev); err != nil {
+				t.Fatal(err)
+			}
+			if ev.action() != tt.action || ev.name() != tt.target || ev.labels()["apf.enable"] != "true" {
+				t.Errorf("unexpected event: %+v", ev)
+			}
+		})
+	}
+}
+
+type fakeSink struct {
+	attached []daemon.Attachment
+	detached []string
+}
+
+func (f *fakeSink) Attach(att daemon.Attachment) error {
+	f.attached = append(f.attached, att)
+	return nil
+}
+
+func (f *fakeSink) Detach(target string) error {
+	f.detached = append(f.detached, target)
+	return nil
+}
+
+func newPod(t *testing.T, name, phase string) pod {
+	p := pod{}
+	err := json.Unmarshal([]byte(`{
+		"metadata": {
+			"name": "`+name+`",
+			"namespace": "dev",
+			"labels": {"pod-template-hash": "5d8f7c9b4"},
+			"ownerReferences": [{"kind": "ReplicaSet", "name": "web-5d8f7c9b4"}]
+		},
+		"status": {"phase": "`+phase+`"}
+	}`), &p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestPodWatcher(t *testing.T) {
+	sink := &fakeSink{}
+	w := NewPodWatcher("dev", "team=payments", sink, log.New(io.Discard, "", 0))
+
+	p1 := newPod(t, "web-5d8f7c9b4-aaaaa", "Running")
+	if p1.workload() != "dev/Deployment/web" {
+		t.Fatalf("unexpected workload: %s", p1.workload())
+	}
+	w.update(p1, p1.running())
+	if len(sink.attached) != 1 || sink.attached[0].Target != "dev/web-5d8f7c9b4-aaaaa" {
+		t.Fatalf("unexpected attachments: %+v", sink.attached)
+	}
+	w.DumpPorts("dev/web-5d8f7c9b4-aaaaa", map[uint16]uint16{8080: 18080}, nil)
+
+	// The other pods are attached too, their ports are allocated as usual
+	p2 := newPod(t, "web-5d8f7c9b4-bbbbb", "Running")
+	w.update(p2, p2.running())
+	w.update(p2, p2.running())
+	if len(sink.attached) != 2 || sink.attached[1].Target != "dev/web-5d8f7c9b4-bbbbb" || len(sink.attached[1].Pins) != 0 {
+		t.Fatalf("unexpected attachments: %+v", sink.attached)
+	}
+	if !sink.attached[0].PinFallback || !sink.attached[1].PinFallback {
+		t.Fatalf("expected the pinned ports to fall back: %+v", sink.attached)
+	}
+	w.DumpPorts("dev/web-5d8f7c9b4-bbbbb", map[uint16]uint16{8080: 41234}, nil)
+
+	// The ports of the gone pod are handed over to the other pod
+	w.update(p1, false)
+	if want := []string{"dev/web-5d8f7c9b4-aaaaa", "dev/web-5d8f7c9b4-bbbbb"}; !reflect.DeepEqual(sink.detached, want) {
+		t.Fatalf("unexpected detachments: %v", sink.detached)
+	}
+	if len(sink.attached) != 3 || sink.attached[2].Target != "dev/web-5d8f7c9b4-bbbbb" {
+		t.Fatalf("unexpected attachments: %+v", sink.attached)
+	}
+	if !reflect.DeepEqual(sink.attached[2].Pins, map[uint16]uint16{8080: 18080}) {
+		t.Fatalf("unexpected pins: %v", sink.attached[2].Pins)
+	}
+	if _, ok := w.owners["dev/web-5d8f7c9b4-aaaaa"]; ok {
+		t.Fatalf("the gone pod is still owned: %v", w.owners)
+	}
+
+	// The last pod is gone, the ports are kept for the replacement
+	w.update(p2, false)
+	p3 := newPod(t, "web-5d8f7c9b4-ccccc", "Running")
+	w.update(p3, p3.running())
+	if len(sink.attached) != 4 || !reflect.DeepEqual(sink.attached[3].Pins, map[uint16]uint16{8080: 18080}) {
+		t.Fatalf("unexpected attachments: %+v", sink.attached)
+	}
+	if len(w.owners) != 1 {
+		t.Fatalf("unexpected owners: %v", w.owners)
+	}
+}